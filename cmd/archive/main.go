@@ -0,0 +1,121 @@
+// Command archive exports a node's chain into a single archive file and
+// imports it into fresh databases, e.g. for backups, moving a node or
+// seeding the data_template of cmd/test_s/t:
+//
+//	BLK_PATH=data/val1/blockchain.db ADS_PATH=data/val1/ads.db \
+//	  go run ./cmd/archive export -o chain.farc -ads
+//	BLK_PATH=data_template/node1/blockchain.db ADS_PATH=data_template/node1/ads.db \
+//	  go run ./cmd/archive import -i chain.farc
+//
+// An import accepts only an archive of the chain whose genesis validators
+// are the ones passed with -validators, keyed as cmd/test keys them, and
+// whose blocks are certified as -consensus requires.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	if err := block.Open(os.Getenv("BLK_PATH"), os.Getenv("ADS_PATH")); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	switch os.Args[1] {
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		out := fs.String("o", "chain.farc", "archive file to write")
+		withADS := fs.Bool("ads", false, "include ADS versions")
+		fs.Parse(os.Args[2:])
+
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("create %s: %v", *out, err)
+		}
+		var flags byte
+		if *withADS {
+			flags |= block.ArchiveADS
+		}
+		if err := block.ExportArchive(f, flags); err != nil {
+			f.Close()
+			os.Remove(*out)
+			log.Fatalf("export: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("close %s: %v", *out, err)
+		}
+		fmt.Println("exported to", *out)
+
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		in := fs.String("i", "chain.farc", "archive file to read")
+		vals := fs.String("validators", "validator1,validator2,validator3,validator4", "comma-separated genesis validator ids the archive must start from")
+		consensus := fs.String("consensus", os.Getenv("CONSENSUS"), "consensus engine of the chain; raft chains are certified by a majority")
+		fs.Parse(os.Args[2:])
+		commits := block.Quorum
+		if *consensus == "raft" {
+			commits = block.Majority
+		}
+		genesis, err := genesisValidators(*vals)
+		if err != nil {
+			log.Fatalf("import: %v", err)
+		}
+
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Fatalf("open %s: %v", *in, err)
+		}
+		defer f.Close()
+		if err := block.ImportArchive(f, genesis, commits); err != nil {
+			log.Fatalf("import: %v", err)
+		}
+		fmt.Println("imported", *in)
+
+	default:
+		usage()
+	}
+}
+
+// genesisValidators keys ids by the {ID}PK entries of cmd/test/app.env, or
+// by the test key derived from the id as cmd/test does for extra peers.
+func genesisValidators(ids string) (block.ValidatorSet, error) {
+	godotenv.Load("cmd/test/app.env")
+	vs := block.ValidatorSet{}
+	for _, id := range strings.Split(ids, ",") {
+		env := os.Getenv(strings.ToUpper(id) + "PK")
+		if env == "" {
+			seed := sha256.Sum256([]byte("falcondb-test:" + id))
+			vs[id] = ed25519.NewKeyFromSeed(seed[:]).Public().(ed25519.PublicKey)
+			continue
+		}
+		parts := strings.Fields(strings.Trim(env, "[]"))
+		pk := make(ed25519.PublicKey, len(parts))
+		for i, p := range parts {
+			v, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("bad %sPK byte %q: %v", strings.ToUpper(id), p, err)
+			}
+			pk[i] = byte(v)
+		}
+		vs[id] = pk
+	}
+	return vs, nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: archive export [-o file] [-ads] | import [-i file] [-validators ids]")
+	os.Exit(2)
+}
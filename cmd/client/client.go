@@ -29,16 +29,28 @@ func main() {
 	must(resp, &before)
 	fmt.Println("🍃 old root =", before.Sum)
 
-	var addRes struct {
-		Block  block.Block `json:"block"`
-		Digest string      `json:"digest"`
+	var rc block.Receipt
+	resp, err = http.Get(server + "/addblock?key=hey&value=bar&wait=1")
+	if err != nil {
+		log.Fatal(err)
 	}
-	resp, err = http.Get(server + "/addblock?key=hey&value=bar")
+	must(resp, &rc)
+	fmt.Println("tx=", rc.Tx, "new height=", rc.Height, "digest=", hex.EncodeToString(rc.Header.DataHash))
+
+	vals, err := fetchValidators(fmt.Sprintf("%s/validators?height=%d", server, rc.Height))
 	if err != nil {
 		log.Fatal(err)
 	}
-	must(resp, &addRes)
-	fmt.Println("new height=", addRes.Block.Header.Height, "digest=", addRes.Digest)
+	// the node is not asked: a lying one would lower the bar
+	commits := block.Quorum
+	if os.Getenv("CONSENSUS") == "raft" {
+		commits = block.Majority
+	}
+	if err := block.VerifyReceipt(rc, vals, commits); err != nil {
+		fmt.Println("receipt FAILED:", err)
+		os.Exit(1)
+	}
+	fmt.Println("receipt validated")
 
 	resp, err = http.Get(server + "/query?key=hey")
 	if err != nil {
@@ -51,7 +63,7 @@ func main() {
 	json.NewDecoder(resp.Body).Decode(&q)
 	resp.Body.Close()
 
-	if verifyProof(addRes.Digest, "hey", q.Value, q.Proof) {
+	if verifyProof(hex.EncodeToString(rc.Header.DataHash), "hey", q.Value, q.Proof) {
 		fmt.Println("proof validated")
 	} else {
 		fmt.Println("proof FAILED")
@@ -59,6 +71,27 @@ func main() {
 	}
 }
 
+func fetchValidators(url string) (block.ValidatorSet, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var pkHex map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&pkHex); err != nil {
+		return nil, err
+	}
+	vals := make(block.ValidatorSet, len(pkHex))
+	for id, h := range pkHex {
+		pk, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, err
+		}
+		vals[id] = pk
+	}
+	return vals, nil
+}
+
 func verifyProof(digest, key string, val []byte, proof []storage.ProofNode) bool {
 	curr := sha256.Sum256(append([]byte(key), val...))
 	for _, p := range proof {
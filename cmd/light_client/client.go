@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
+	"github.com/mauzec/falcondb/internal/block"
 	"github.com/mauzec/falcondb/internal/light"
 )
 
 func main() {
+	consensus := flag.String("consensus", os.Getenv("CONSENSUS"), "consensus engine of the chain; raft chains are certified by a majority")
+	flag.Parse()
+	// the node is not asked: a lying one would lower the bar
+	commits := block.Quorum
+	if *consensus == "raft" {
+		commits = block.Majority
+	}
 
-	lc, err := light.NewLightClient("http://127.0.0.1:8081")
+	lc, err := light.NewLightClient("http://127.0.0.1:8081", commits)
 	if err != nil {
 		log.Fatalf("failed to init light client: %v", err)
 	}
@@ -22,12 +33,23 @@ func main() {
 	}
 	fmt.Printf("foo = %s\n", string(val))
 
+	sub := light.Subscription{
+		Keys: []string{"foo"},
+		OnHeader: func(h block.BlockHeader) {
+			fmt.Println("New block height:", h.Height)
+		},
+		OnChange: func(c block.Change) {
+			if c.Deleted {
+				fmt.Printf("%s deleted at height %d (RW log checked)\n", c.Key, c.Height)
+				return
+			}
+			fmt.Printf("%s = %s at height %d (proof checked)\n", c.Key, c.Value, c.Height)
+		},
+	}
 	for {
-		time.Sleep(5 * time.Second)
-		if err := lc.SyncOne(); err != nil {
-			log.Printf("sync error: %v", err)
-			continue
+		if err := lc.Follow(context.Background(), sub); err != nil {
+			log.Printf("follow error: %v", err)
 		}
-		fmt.Println("New block height:", lc.Headers[len(lc.Headers)-1].Height)
+		time.Sleep(time.Second)
 	}
 }
@@ -0,0 +1,117 @@
+// Command reconfig approves a validator update with validator keys and
+// submits it once a quorum of the active validators approved it. Each
+// operator signs with the key of their own validator; the approvals are
+// then passed on with -approval:
+//
+//	go run ./cmd/reconfig -action add -id node3 -pk HEX -nonce n1 -sign validator1
+//	go run ./cmd/reconfig -action add -id node3 -pk HEX -nonce n1 -sign validator2
+//	go run ./cmd/reconfig -action add -id node3 -pk HEX -nonce n1 -sign validator3 \
+//	  -approval validator1:SIGHEX -approval validator2:SIGHEX -node http://127.0.0.1:8081
+//
+// Keys are read like cmd/test does, from <ID>SK in cmd/test/app.env, e.g.
+// VALIDATOR1SK for validator1.
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+type approvals []string
+
+func (a *approvals) String() string     { return strings.Join(*a, ",") }
+func (a *approvals) Set(s string) error { *a = append(*a, s); return nil }
+
+func main() {
+	var upd block.ValidatorUpdate
+	var pkHex, sign, node string
+	var extra approvals
+	flag.StringVar(&upd.Action, "action", "", "add, remove or rotate")
+	flag.StringVar(&upd.ID, "id", "", "validator id")
+	flag.StringVar(&pkHex, "pk", "", "hex public key, for add and rotate")
+	flag.StringVar(&upd.Nonce, "nonce", "", "update nonce, the same for every approval (random if empty)")
+	flag.StringVar(&sign, "sign", "", "comma-separated validator ids to approve with")
+	flag.Var(&extra, "approval", "approval of another validator, ID:SIGHEX (repeatable)")
+	flag.StringVar(&node, "node", "", "node URL to submit the update to once approved")
+	flag.Parse()
+
+	godotenv.Load("cmd/test/app.env")
+	if pkHex != "" {
+		pk, err := hex.DecodeString(pkHex)
+		if err != nil {
+			log.Fatalf("bad -pk: %v", err)
+		}
+		upd.PK = ed25519.PublicKey(pk)
+	}
+	if upd.Nonce == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		upd.Nonce = hex.EncodeToString(b)
+		fmt.Println("nonce", upd.Nonce)
+	}
+	for _, a := range extra {
+		id, sigHex, _ := strings.Cut(a, ":")
+		sig, err := hex.DecodeString(sigHex)
+		if err != nil || id == "" {
+			log.Fatalf("bad -approval %q", a)
+		}
+		if upd.Approvals == nil {
+			upd.Approvals = map[string][]byte{}
+		}
+		upd.Approvals[id] = sig
+	}
+	for _, id := range strings.Split(sign, ",") {
+		if id == "" {
+			continue
+		}
+		sk := parseSKEnv(strings.ToUpper(id) + "SK")
+		upd.Approve(id, sk)
+		fmt.Printf("approval %s:%x\n", id, upd.Approvals[id])
+	}
+	if node == "" {
+		return
+	}
+
+	body, _ := json.Marshal(upd)
+	resp, err := http.Post(node+"/reconfig", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		log.Fatalf("reconfig: %s: %s", resp.Status, bytes.TrimSpace(out))
+	}
+	fmt.Println(string(bytes.TrimSpace(out)))
+}
+
+func parseSKEnv(name string) ed25519.PrivateKey {
+	s := strings.Trim(os.Getenv(name), "[]")
+	parts := strings.Fields(s)
+	if len(parts) != ed25519.PrivateKeySize {
+		log.Fatalf("no key in %s", name)
+	}
+	sk := make([]byte, len(parts))
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			log.Fatalf("bad %s byte %q: %v", name, p, err)
+		}
+		sk[i] = byte(v)
+	}
+	return ed25519.PrivateKey(sk)
+}
@@ -0,0 +1,106 @@
+// Command sim runs consensus on an in-process simulated cluster, seed by
+// seed, and checks that the validators never fork and catch up in the
+// end. A failing seed is printed so it can be replayed with -seed and -v:
+//
+//	go run ./cmd/sim -engine pbft -validators 4 -seeds 100 -drop 0.05
+//	go run ./cmd/sim -engine hotstuff -seed 17 -partition 5s -v
+//	go run ./cmd/sim -byzantine 1 -faults all -seeds 50
+//
+// With -byzantine the first validators misbehave as -faults says; the
+// safety and convergence checks then cover the honest ones only.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/network"
+	"github.com/mauzec/falcondb/internal/sim"
+)
+
+var (
+	seed       = flag.Int64("seed", 1, "first seed")
+	seeds      = flag.Int("seeds", 1, "number of seeds to run from -seed")
+	engine     = flag.String("engine", "pbft", "consensus engine: pbft, hotstuff or raft")
+	validators = flag.Int("validators", 4, "number of validators")
+	drop       = flag.Float64("drop", 0, "fraction of messages lost")
+	delay      = flag.Duration("delay", 50*time.Millisecond, "maximum message delay")
+	writes     = flag.Int("writes", 20, "writes per run")
+	partition  = flag.Duration("partition", 0, "isolate the leader this long halfway through")
+	byzantine  = flag.Int("byzantine", 0, "number of Byzantine validators, from validator1")
+	faults     = flag.String("faults", "all", "behaviours of the Byzantine validators: "+network.FaultAll.String()+" or all")
+	verbose    = flag.Bool("v", false, "show node logs")
+)
+
+// faulty maps the Byzantine validators to their faults.
+var faulty map[string]network.Fault
+
+func main() {
+	flag.Parse()
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	fs, err := network.ParseFaults(*faults)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	faulty = map[string]network.Fault{}
+	for i := 1; i <= *byzantine; i++ {
+		faulty[sim.NodeID(i)] = fs
+	}
+
+	failed, violations := 0, 0
+	for s := *seed; s < *seed+int64(*seeds); s++ {
+		start := time.Now()
+		c, err := run(s)
+		if c == nil {
+			fmt.Fprintf(os.Stderr, "seed %d: %v\n", s, err)
+			os.Exit(2)
+		}
+		status := "ok"
+		if _, ok := err.(sim.Unsafe); ok {
+			status = "UNSAFE: " + err.Error()
+			violations++
+		} else if err != nil {
+			status = "STALLED: " + err.Error()
+		}
+		if err != nil {
+			failed++
+		}
+		fmt.Printf("seed=%d heights=%v msgs=%d dropped=%d slashed=%v virtual=%s real=%s digest=%s %s\n",
+			s, c.Heights(), c.Net.Sent, c.Net.Dropped, c.Slashed(), c.Clock.Elapsed().Round(time.Millisecond),
+			time.Since(start).Round(time.Millisecond), c.Digest(), status)
+		if err != nil {
+			fmt.Printf("  replay: go run ./cmd/sim -engine %s -validators %d -drop %g -delay %s -writes %d -partition %s -byzantine %d -faults %s -seed %d -v\n",
+				*engine, *validators, *drop, *delay, *writes, *partition, *byzantine, *faults, s)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d seeds failed, %d unsafe\n", failed, *seeds, violations)
+		os.Exit(1)
+	}
+}
+
+// run drives one seeded cluster through the writes, with the leader cut
+// off for -partition halfway.
+func run(s int64) (*sim.Cluster, error) {
+	c, err := sim.NewCluster(sim.Config{
+		Seed:       s,
+		Validators: *validators,
+		Engine:     *engine,
+		Drop:       *drop,
+		MinDelay:   *delay / 10,
+		MaxDelay:   *delay,
+		Byzantine:  faulty,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Run(sim.Scenario{Writes: *writes, Partition: *partition})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"log"
@@ -11,6 +12,7 @@ import (
 	"crypto/ed25519"
 
 	"github.com/joho/godotenv"
+	"github.com/mauzec/falcondb/internal/block"
 	"github.com/mauzec/falcondb/internal/network"
 )
 
@@ -44,6 +46,13 @@ func parseSKEnv(name string) ed25519.PrivateKey {
 	return ed25519.PrivateKey(sk)
 }
 
+// testKey derives the key of a node that has none in app.env, so that
+// benchmarks can run clusters of any size.
+func testKey(id string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte("falcondb-test:" + id))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
 func main() {
 
 	if err := godotenv.Load("cmd/test/app.env"); err != nil {
@@ -51,17 +60,38 @@ func main() {
 	}
 
 	var (
-		id   string
-		port int
+		id         string
+		port       int
+		validators string
+		peers      string
+		consensus  string
+		faults     string
+		seeds      string
+		useTLS     bool
+		transport  string
+		certDir    string
+		stateSync  bool
 	)
 	// var dataDir string
 	// flag.StringVar(&dataDir, "data", "", "data directory for this node")
 	flag.StringVar(&id, "id", "", "node id")
 	flag.IntVar(&port, "port", 0, "HTTP port")
+	flag.StringVar(&validators, "validators", "validator1,validator2,validator3,validator4", "comma-separated genesis validator ids, at least 4 to tolerate a faulty one")
+	flag.StringVar(&peers, "peers", "", "extra comma-separated id=port peers, keys derived from the id")
+	flag.StringVar(&consensus, "consensus", os.Getenv("CONSENSUS"), "consensus engine: pbft, hotstuff or raft")
+	flag.StringVar(&faults, "faults", os.Getenv("FAULTS"), "Byzantine behaviours of this node, comma-separated, for adversarial tests")
+	flag.StringVar(&seeds, "seeds", "", "comma-separated host:port of nodes to join through, instead of the configured peers")
+	flag.BoolVar(&useTLS, "tls", os.Getenv("TLS") != "", "mutual TLS between nodes, certificates derived from the node keys")
+	flag.StringVar(&certDir, "certs", os.Getenv("CERT_DIR"), "with --tls, write this node's certificate and key here")
+	flag.StringVar(&transport, "transport", os.Getenv("TRANSPORT"), "node-to-node transport: stream (default) or http")
+	flag.BoolVar(&stateSync, "state-sync", os.Getenv("STATE_SYNC") != "", "with an empty chain, install the state at the peers' tip instead of replaying every block")
 	flag.Parse()
 	if id == "" || port == 0 {
 		log.Fatalf("pass --id and --port")
 	}
+	if err := block.Open(os.Getenv("BLK_PATH"), os.Getenv("ADS_PATH")); err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	configs := []struct {
 		ID   string
@@ -69,22 +99,43 @@ func main() {
 	}{
 		{"validator1", 8081},
 		{"validator2", 8082},
+		{"validator3", 8083},
+		{"validator4", 8084},
 		{"node1", 8091},
 		{"node2", 8092},
 		{"node3", 8093},
 	}
 	peerAddrs := make(map[string]string, len(configs))
 	for _, c := range configs {
-		peerAddrs[c.ID] = fmt.Sprintf("127.0.0.1:%d", c.Port)
+		if seeds == "" || c.ID == id {
+			peerAddrs[c.ID] = fmt.Sprintf("127.0.0.1:%d", c.Port)
+		}
+	}
+	if _, ok := peerAddrs[id]; !ok {
+		peerAddrs[id] = fmt.Sprintf("127.0.0.1:%d", port)
 	}
 
 	peerPK := map[string]ed25519.PublicKey{
 		"validator1": parsePKEnv("VALIDATOR1PK"),
 		"validator2": parsePKEnv("VALIDATOR2PK"),
+		"validator3": parsePKEnv("VALIDATOR3PK"),
+		"validator4": parsePKEnv("VALIDATOR4PK"),
 		"node1":      parsePKEnv("NODE1PK"),
 		"node2":      parsePKEnv("NODE2PK"),
 		"node3":      parsePKEnv("NODE3PK"),
 	}
+	if peers != "" {
+		for _, p := range strings.Split(peers, ",") {
+			pid, pport, ok := strings.Cut(p, "=")
+			if !ok {
+				log.Fatalf("bad peer %q, want id=port", p)
+			}
+			peerAddrs[pid] = "127.0.0.1:" + pport
+			if _, known := peerPK[pid]; !known {
+				peerPK[pid] = testKey(pid).Public().(ed25519.PublicKey)
+			}
+		}
+	}
 
 	var sk ed25519.PrivateKey
 	switch id {
@@ -92,6 +143,10 @@ func main() {
 		sk = parseSKEnv("VALIDATOR1SK")
 	case "validator2":
 		sk = parseSKEnv("VALIDATOR2SK")
+	case "validator3":
+		sk = parseSKEnv("VALIDATOR3SK")
+	case "validator4":
+		sk = parseSKEnv("VALIDATOR4SK")
 	case "node1":
 		sk = parseSKEnv("NODE1SK")
 	case "node2":
@@ -99,11 +154,61 @@ func main() {
 	case "node3":
 		sk = parseSKEnv("NODE3SK")
 	default:
-		log.Fatalf("unknown id %s", id)
+		if _, ok := peerPK[id]; !ok && seeds == "" {
+			log.Fatalf("unknown id %s", id)
+		}
+		sk = testKey(id)
+	}
+
+	genesis := block.ValidatorSet{}
+	for _, v := range strings.Split(validators, ",") {
+		pk, ok := peerPK[v]
+		if !ok {
+			log.Fatalf("unknown validator %s", v)
+		}
+		genesis[v] = pk
 	}
+	block.SetGenesisValidators(genesis)
 
 	n := network.NewNode(id, port, peerAddrs, peerPK)
 	n.SK = sk
+	n.PK = sk.Public().(ed25519.PublicKey)
+	if consensus != "" {
+		if err := n.UseConsensus(consensus); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	fs, err := network.ParseFaults(faults)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	n.Faults = fs
+	n.StateSync = stateSync
+	if n.Faults != 0 {
+		log.Printf("%s is Byzantine: %s", id, n.Faults)
+	}
+	switch transport {
+	case "", "stream":
+	case "http":
+		n.UseHTTP()
+	default:
+		log.Fatalf("unknown transport %q", transport)
+	}
+	if useTLS {
+		if err := n.UseTLS(certDir); err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+	}
+	walPath := os.Getenv("WAL_PATH")
+	if walPath == "" {
+		walPath = os.Getenv("BLK_PATH") + ".wal"
+	}
+	if err := n.Recover(walPath); err != nil {
+		log.Fatalf("recover consensus wal: %v", err)
+	}
+	if seeds != "" {
+		n.Join(strings.Split(seeds, ","))
+	}
 	log.Printf("Starting %s on :%d", id, port)
 	n.StartServer()
 
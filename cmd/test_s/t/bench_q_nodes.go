@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -24,9 +25,20 @@ const (
 	ordinaryCnt = 10
 	targetH     = 10000
 	tplDir      = "data_template"
+	nodeBin     = "bin/fnode"
+)
+
+var (
+	engines = flag.String("consensus", "pbft,hotstuff", "comma-separated consensus engines to compare")
+	writes  = flag.Int("writes", 20, "client writes per run for the message count")
 )
 
 func main() {
+	flag.Parse()
+	if out, err := exec.Command("go", "build", "-o", nodeBin, "./cmd/test").CombinedOutput(); err != nil {
+		log.Fatalf("build node: %v\n%s", err, out)
+	}
+	engineList := strings.Split(*engines, ",")
 
 	var totalList []int
 	for i := 12; i <= 100; i += 2 {
@@ -37,7 +49,7 @@ func main() {
 	if _, err := os.Stat(tplDir); os.IsNotExist(err) {
 		fmt.Printf("❯ Pre-generate template cluster: validators=%d ordinary=%d up to H=%d\n",
 			vMax, ordinaryCnt, targetH)
-		if err := preGenerateTemplate(vMax, ordinaryCnt); err != nil {
+		if err := preGenerateTemplate(engineList[0], vMax, ordinaryCnt); err != nil {
 			log.Fatalf("template gen failed: %v", err)
 		}
 	}
@@ -51,43 +63,101 @@ func main() {
 		o := total - v
 		fmt.Printf("=== total=%d → v=%d, o=%d ===\n", total, v, o)
 
-		os.RemoveAll("data")
+		for _, engine := range engineList {
+			os.RemoveAll("data")
 
-		for i := 1; i <= v; i++ {
-			cpDir(filepath.Join(tplDir, fmt.Sprintf("validator%d", i)),
-				filepath.Join("data", fmt.Sprintf("validator%d", i)))
-		}
-		for i := 1; i <= o; i++ {
-			cpDir(filepath.Join(tplDir, fmt.Sprintf("node%d", i)),
-				filepath.Join("data", fmt.Sprintf("node%d", i)))
-		}
+			for i := 1; i <= v; i++ {
+				cpDir(filepath.Join(tplDir, fmt.Sprintf("validator%d", i)),
+					filepath.Join("data", fmt.Sprintf("validator%d", i)))
+			}
+			for i := 1; i <= o; i++ {
+				cpDir(filepath.Join(tplDir, fmt.Sprintf("node%d", i)),
+					filepath.Join("data", fmt.Sprintf("node%d", i)))
+			}
+
+			pids := startCluster(engine, v, o)
 
-		pids := startCluster(v, o)
+			time.Sleep(2 * time.Second)
 
-		time.Sleep(2 * time.Second)
+			server := serverBase + ":" + strconv.Itoa(basePort)
+			out, _ := exec.Command("go", "run", "cmd/test_s/bench_query.go",
+				"-server="+server,
+				"-key="+key,
+				"-runs="+strconv.Itoa(runs),
+				"-n="+strconv.Itoa(reqs),
+				"-c="+strconv.Itoa(conc),
+			).CombinedOutput()
 
-		server := serverBase + ":" + strconv.Itoa(basePort)
-		out, _ := exec.Command("go", "run", "cmd/test_s/bench_query.go",
-			"-server="+server,
-			"-key="+key,
-			"-runs="+strconv.Itoa(runs),
-			"-n="+strconv.Itoa(reqs),
-			"-c="+strconv.Itoa(conc),
-		).CombinedOutput()
+			last := lastLine(string(out))
+			fmt.Printf("→ %s total=%d, v=%d: %s\n", engine, total, v, last)
 
-		last := lastLine(string(out))
-		fmt.Printf("→ total=%d, v=%d: %s\n\n", total, v, last)
+			msgs, blocks, done := measureMessages(v, *writes)
+			fmt.Printf("→ %s v=%d: %d/%d writes, %d blocks, %d messages, %.1f msgs/write\n\n",
+				engine, v, done, *writes, blocks, msgs, float64(msgs)/float64(max(done, 1)))
+
+			for _, pid := range pids {
+				pid.Process.Kill()
+				pid.Process.Wait()
+			}
+		}
+	}
+}
+
+// measureMessages sends writes to the leader, following X-Leader, and
+// counts the consensus messages the validators sent meanwhile.
+func measureMessages(v, n int) (msgs int64, blocks int64, done int) {
+	client := &http.Client{Timeout: 15 * time.Second}
+	sum := func() (total int64, height int64) {
+		for i := 0; i < v; i++ {
+			var st struct {
+				Height int64 `json:"height"`
+				Total  int64 `json:"total"`
+			}
+			resp, err := client.Get(fmt.Sprintf("%s:%d/consensus/stats", serverBase, basePort+i))
+			if err != nil {
+				continue
+			}
+			json.NewDecoder(resp.Body).Decode(&st)
+			resp.Body.Close()
+			total += st.Total
+			if st.Height > height {
+				height = st.Height
+			}
+		}
+		return total, height
+	}
 
-		for _, pid := range pids {
-			pid.Process.Kill()
-			pid.Process.Wait()
+	msgs0, h0 := sum()
+	port := basePort
+	for i := 0; i < n; i++ {
+		for try := 0; try < 5; try++ {
+			resp, err := client.Get(fmt.Sprintf("%s:%d/addblock?key=msg%d&value=%d&wait=1", serverBase, port, i, i))
+			if err != nil {
+				time.Sleep(500 * time.Millisecond)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusMisdirectedRequest {
+				var idx int
+				if _, err := fmt.Sscanf(resp.Header.Get("X-Leader"), "validator%d", &idx); err == nil {
+					port = basePort + idx - 1
+				}
+				continue
+			}
+			if resp.StatusCode == http.StatusOK {
+				done++
+			}
+			break
 		}
 	}
+	time.Sleep(time.Second)
+	msgs1, h1 := sum()
+	return msgs1 - msgs0, h1 - h0, done
 }
 
-func preGenerateTemplate(vMax, oCnt int) error {
+func preGenerateTemplate(engine string, vMax, oCnt int) error {
 
-	pids := startCluster(vMax, oCnt, tplDir)
+	pids := startCluster(engine, vMax, oCnt, tplDir)
 
 	time.Sleep(2 * time.Second)
 
@@ -122,7 +192,7 @@ func preGenerateTemplate(vMax, oCnt int) error {
 	return nil
 }
 
-func startCluster(v, o int, baseDir ...string) []*exec.Cmd {
+func startCluster(engine string, v, o int, baseDir ...string) []*exec.Cmd {
 	dirRoot := "data"
 	if len(baseDir) > 0 {
 		dirRoot = baseDir[0]
@@ -130,11 +200,26 @@ func startCluster(v, o int, baseDir ...string) []*exec.Cmd {
 	var cmds []*exec.Cmd
 	port := basePort
 
+	var ids, peers, validators []string
+	for i := 1; i <= v; i++ {
+		ids = append(ids, fmt.Sprintf("validator%d", i))
+		validators = append(validators, ids[len(ids)-1])
+	}
+	for i := 1; i <= o; i++ {
+		ids = append(ids, fmt.Sprintf("node%d", i))
+	}
+	for i, id := range ids {
+		peers = append(peers, fmt.Sprintf("%s=%d", id, basePort+i))
+	}
+
 	spawn := func(id string) {
 		dir := filepath.Join(dirRoot, id)
 		os.MkdirAll(dir, 0o755)
-		cmd := exec.Command("go", "run", "cmd/test/main.go",
-			"--id="+id, "--port="+strconv.Itoa(port))
+		cmd := exec.Command(nodeBin,
+			"--id="+id, "--port="+strconv.Itoa(port),
+			"--validators="+strings.Join(validators, ","),
+			"--peers="+strings.Join(peers, ","),
+			"--consensus="+engine)
 		cmd.Env = append(os.Environ(),
 			"ADS_PATH="+filepath.Join(dir, "ads.db"),
 			"BLK_PATH="+filepath.Join(dir, "blockchain.db"),
@@ -149,11 +234,8 @@ func startCluster(v, o int, baseDir ...string) []*exec.Cmd {
 		port++
 	}
 
-	for i := 1; i <= v; i++ {
-		spawn(fmt.Sprintf("validator%d", i))
-	}
-	for i := 1; i <= o; i++ {
-		spawn(fmt.Sprintf("node%d", i))
+	for _, id := range ids {
+		spawn(id)
 	}
 	return cmds
 }
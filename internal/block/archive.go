@@ -0,0 +1,361 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/mauzec/falcondb/internal/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Archive layout:
+//
+//	magic "FALCONDB-ARCHIVE" | uint16 version | uint8 flags
+//	gzip( record* ), record = type byte | uvarint len | JSON payload
+//	sha256 of everything above
+//
+// Records: 'G' genesis validators, 'V' ADS version (with ArchiveADS),
+// 'B' block, 'R' read/write log of the preceding block, 'E' end.
+const (
+	archiveMagic   = "FALCONDB-ARCHIVE"
+	archiveVersion = 1
+
+	// ArchiveADS marks archives that carry the ADS versions.
+	ArchiveADS = 1 << 0
+)
+
+type archiveVersionRec struct {
+	Key     string          `json:"key"`
+	Version storage.Version `json:"version"`
+}
+
+type archiveEnd struct {
+	Blocks   int64 `json:"blocks"`
+	Versions int64 `json:"versions"`
+}
+
+type archiveWriter struct {
+	zw  *gzip.Writer
+	buf []byte
+}
+
+func (aw *archiveWriter) record(typ byte, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	aw.buf = append(aw.buf[:0], typ)
+	aw.buf = binary.AppendUvarint(aw.buf, uint64(len(payload)))
+	if _, err := aw.zw.Write(aw.buf); err != nil {
+		return err
+	}
+	_, err = aw.zw.Write(payload)
+	return err
+}
+
+// ExportArchive streams the local chain, and with ArchiveADS the ADS
+// versions, into w.
+func ExportArchive(w io.Writer, flags byte) error {
+	genesis, err := GenesisValidators()
+	if err != nil {
+		return fmt.Errorf("genesis validators: %w", err)
+	}
+
+	sum := sha256.New()
+	out := io.MultiWriter(w, sum)
+	head := append([]byte(archiveMagic), 0, 0, flags)
+	binary.BigEndian.PutUint16(head[len(archiveMagic):], archiveVersion)
+	if _, err := out.Write(head); err != nil {
+		return err
+	}
+
+	aw := &archiveWriter{zw: gzip.NewWriter(out)}
+	if err := aw.record('G', genesis); err != nil {
+		return err
+	}
+
+	var end archiveEnd
+	if flags&ArchiveADS != 0 {
+		err := storage.EachVersion(func(key string, v storage.Version) error {
+			end.Versions++
+			return aw.record('V', archiveVersionRec{key, v})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	iter := blkDB.NewIterator(util.BytesPrefix([]byte("block:")), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var b Block
+		if err := json.Unmarshal(iter.Value(), &b); err != nil {
+			return err
+		}
+		if err := aw.record('B', b); err != nil {
+			return err
+		}
+		if raw, err := GetRWLog(b.Header.Height); err == nil {
+			if err := aw.record('R', json.RawMessage(raw)); err != nil {
+				return err
+			}
+		}
+		end.Blocks++
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := aw.record('E', end); err != nil {
+		return err
+	}
+	if err := aw.zw.Close(); err != nil {
+		return err
+	}
+
+	_, err = w.Write(sum.Sum(nil))
+	log.Printf("[archive] exported blocks=%d versions=%d", end.Blocks, end.Versions)
+	return err
+}
+
+// ImportArchive recreates the chain from an archive into the (empty) local
+// databases. The archive, which nothing signs, must start from genesis:
+// the genesis block and the configured genesis validators. Every block
+// must link to its parent and carry a commit certificate valid under rule.
+// Without ADS versions each block is replayed; with them the versions are
+// restored and every DataHash and RWHash is checked instead. The archive
+// of a state-synced node has no read/write logs below its base; there only
+// the certificates are checked, and the state at the base against its
+// DataHash.
+func ImportArchive(r io.ReadSeeker, genesis ValidatorSet, rule CommitRule) error {
+	if tip := Tip().Header.Height; tip > 1 {
+		return fmt.Errorf("import target is not empty (height %d)", tip)
+	}
+	if err := verifyArchiveSum(r); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	head := make([]byte, len(archiveMagic)+3)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+	if string(head[:len(archiveMagic)]) != archiveMagic {
+		return errors.New("not a falcondb archive")
+	}
+	if v := binary.BigEndian.Uint16(head[len(archiveMagic):]); v != archiveVersion {
+		return fmt.Errorf("unsupported archive version %d", v)
+	}
+	restore := head[len(head)-1]&ArchiveADS != 0
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	zr.Multistream(false)
+	br := bufio.NewReader(zr)
+
+	var (
+		end     archiveEnd
+		pending *Block
+		seen    archiveEnd
+		im      = archiveImport{restore: restore, rule: rule}
+	)
+	// finish commits the pending block once its rw log (if any) is known.
+	finish := func(rw []byte) error {
+		if pending == nil {
+			return nil
+		}
+		b := *pending
+		pending = nil
+		if err := im.block(b, rw); err != nil {
+			return fmt.Errorf("block %d: %w", b.Header.Height, err)
+		}
+		seen.Blocks++
+		return nil
+	}
+
+	for done := false; !done; {
+		typ, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("truncated archive: %w", err)
+		}
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return err
+		}
+
+		switch typ {
+		case 'G':
+			var vs ValidatorSet
+			if err := json.Unmarshal(payload, &vs); err != nil {
+				return err
+			}
+			if !bytes.Equal(vs.Hash(), genesis.Hash()) {
+				return errors.New("archive genesis validators differ from the configured ones")
+			}
+			SetGenesisValidators(vs)
+		case 'V':
+			var rec archiveVersionRec
+			if err := json.Unmarshal(payload, &rec); err != nil {
+				return err
+			}
+			store.Restore(rec.Key, rec.Version)
+			seen.Versions++
+		case 'B':
+			if err := finish(nil); err != nil {
+				return err
+			}
+			var b Block
+			if err := json.Unmarshal(payload, &b); err != nil {
+				return err
+			}
+			pending = &b
+		case 'R':
+			if err := finish(payload); err != nil {
+				return err
+			}
+		case 'E':
+			if err := finish(nil); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(payload, &end); err != nil {
+				return err
+			}
+			done = true
+		default:
+			return fmt.Errorf("unknown archive record %q", typ)
+		}
+	}
+	if end != seen {
+		return fmt.Errorf("archive counts mismatch: header %+v, read %+v", end, seen)
+	}
+	if err := im.checkBase(); err != nil {
+		return err
+	}
+	if err := rebuildReplays(); err != nil {
+		return err
+	}
+	log.Printf("[archive] imported blocks=%d versions=%d", seen.Blocks, seen.Versions)
+	return nil
+}
+
+func verifyArchiveSum(r io.ReadSeeker) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < int64(len(archiveMagic)+3+sha256.Size) {
+		return errors.New("archive too short")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sum := sha256.New()
+	if _, err := io.CopyN(sum, r, size-sha256.Size); err != nil {
+		return err
+	}
+	want := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, want); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum.Sum(nil), want) {
+		return errors.New("archive checksum mismatch")
+	}
+	return nil
+}
+
+// archiveImport checks and stores the blocks of an archive in order.
+type archiveImport struct {
+	restore bool
+	rule    CommitRule
+	prev    *Block
+	// base is the last block without a read/write log, whose state the
+	// restored ADS versions start from; logged is set past it.
+	base   *Block
+	logged bool
+}
+
+func (im *archiveImport) block(b Block, rw []byte) error {
+	prev := im.prev
+	im.prev = &b
+	if prev == nil {
+		if !bytes.Equal(hashHeader(b.Header), hashHeader(GenesisBlock().Header)) {
+			return errors.New("first block is not the genesis block")
+		}
+		im.base = &b
+		return nil
+	}
+	if b.Header.Height != prev.Header.Height+1 || !bytes.Equal(b.Header.PrevHash, hashHeader(prev.Header)) {
+		return errors.New("broken header link")
+	}
+	if !im.restore {
+		return CommitBlock(b, im.rule)
+	}
+
+	if err := VerifyBlock(b, ValidatorsAt(b.Header.Height), im.rule); err != nil {
+		return err
+	}
+	if err := validators.VerifyValSet(b.Header); err != nil {
+		return err
+	}
+	if rw == nil {
+		if im.logged {
+			return errors.New("missing rw log above the state base")
+		}
+		im.base = &b
+		if err := validators.Track(b); err != nil {
+			return err
+		}
+		return saveBlock(b, nil)
+	}
+	if !im.logged {
+		if err := im.checkBase(); err != nil {
+			return err
+		}
+		im.logged = true
+	}
+
+	if root := store.SumAt(b.Header.Height); root != hex.EncodeToString(b.Header.DataHash) {
+		return fmt.Errorf("ADS root mismatch: want %x, got %s", b.Header.DataHash, root)
+	}
+	var l RWLog
+	if err := json.Unmarshal(rw, &l); err != nil {
+		return fmt.Errorf("bad rw log: %w", err)
+	}
+	if sum := sha256.Sum256(rw); !bytes.Equal(sum[:], b.Header.RWHash) {
+		return errors.New("RW log mismatch")
+	}
+	if err := validators.Track(b); err != nil {
+		return err
+	}
+	return saveBlock(b, &l)
+}
+
+// checkBase checks the restored state at the base block and records the
+// base as a state sync would; a base at genesis needs neither.
+func (im *archiveImport) checkBase() error {
+	if !im.restore || im.logged || im.base == nil || im.base.Header.Height <= 1 {
+		return nil
+	}
+	h := im.base.Header
+	if root := store.SumAt(h.Height); root != hex.EncodeToString(h.DataHash) {
+		return fmt.Errorf("state root mismatch at base %d: want %x, got %s", h.Height, h.DataHash, root)
+	}
+	return blkDB.Put([]byte("meta:state-base"), []byte(strconv.FormatInt(h.Height, 10)), nil)
+}
@@ -8,27 +8,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
+	"strconv"
 	"sync"
 
 	"github.com/mauzec/falcondb/internal/storage"
 )
 
 type Operation struct {
+	Type  string `json:"type,omitempty"` // handler to run, put if empty
 	Key   string `json:"key"`
 	Value []byte `json:"value"`
+
+	Validator *ValidatorUpdate `json:"validator,omitempty"`
+	If        []Condition      `json:"if,omitempty"`
+	Nonce     string           `json:"nonce,omitempty"` // keeps tx ids of equal operations apart
+
+	Evidence []Evidence `json:"evidence,omitempty"` // equivocations the proposer saw, slashed with the block
 }
 
 type BlockHeader struct {
 	Height      int64    `json:"height"`
-	PrevHash    []byte   `json:"prev_hash"`    // hash(h{height-1})
-	ContentHash []byte   `json:"content_hash"` // (phi) hach(C)
-	DataHash    []byte   `json:"data_hash"`    // (delta) ADS-root
-	RWHash      []byte   `json:"rw_hash"`      // hash(RW log)
-	Initiator   []byte   `json:"initiator"`    // (e0) who proposed
-	Signature   []byte   `json:"signature"`    // (s0) initiatur's signature
-	Validators  []string `json:"validators"`   // {e1...ek} peer ids
-	Signatures  [][]byte `json:"signatures"`   // {s1...sk}
+	PrevHash    []byte   `json:"prev_hash"`             // hash(h{height-1})
+	ContentHash []byte   `json:"content_hash"`          // (phi) hach(C)
+	DataHash    []byte   `json:"data_hash"`             // (delta) ADS-root
+	RWHash      []byte   `json:"rw_hash"`               // hash(RW log)
+	Initiator   []byte   `json:"initiator"`             // (e0) who proposed
+	Signature   []byte   `json:"signature"`             // (s0) initiatur's signature
+	Validators  []string `json:"validators"`            // {e1...ek} peer ids
+	Signatures  [][]byte `json:"signatures"`            // {s1...sk}
+	ValSetHash  []byte   `json:"valset_hash,omitempty"` // hash of the active validator set
+	Rejected    bool     `json:"rejected,omitempty"`    // operation conditions failed, nothing written
 }
 
 type Block struct {
@@ -40,8 +49,23 @@ var (
 	blockchain   []Block
 	blockchainMu sync.RWMutex
 	store        = storage.NewADS()
+
+	// proposed holds blocks built by NewBlock whose state is already in
+	// the ADS but which are not committed yet. Several heights may be in
+	// flight, each built on the one below.
+	proposed   = map[int64]proposal{}
+	proposedMu sync.Mutex
+
+	commitCh   = make(chan struct{})
+	commitChMu sync.Mutex
 )
 
+type proposal struct {
+	blk  Block
+	hash []byte
+	rw   RWLog
+}
+
 func init() {
 	genesis := GenesisBlock()
 	blockchain = []Block{genesis}
@@ -50,25 +74,26 @@ func init() {
 func NewBlock(prev Block, op Operation, initiator []byte) (Block, error) {
 	log.Printf("[block] NewBlock: prevHeight=%d key=%s", prev.Header.Height, op.Key)
 
+	height := prev.Header.Height + 1
 	content, _ := json.Marshal(op)
 
 	phiSum := sha256.Sum256(content)
-	deltaHex, err := store.UpdS(op.Key, op.Value, prev.Header.Height+1)
+	deltaHex, rejected, rw, err := local().Execute(op, height)
 	if err != nil {
-		log.Printf("[block] UpdS error: %v", err)
+		log.Printf("[block] execute error: %v", err)
 		return Block{}, err
 	}
 	dataHash, _ := hex.DecodeString(deltaHex)
 
-	rwSum := sha256.Sum256(content)
-
 	hdr := BlockHeader{
-		Height:      prev.Header.Height + 1,
+		Height:      height,
 		PrevHash:    hashHeader(prev.Header),
 		ContentHash: phiSum[:],
 		DataHash:    dataHash,
-		RWHash:      rwSum[:],
+		RWHash:      rw.Hash(),
 		Initiator:   initiator,
+		ValSetHash:  validators.At(height).Hash(),
+		Rejected:    rejected,
 
 		// Signatures, Validators
 		// will add later with consensus
@@ -78,13 +103,54 @@ func NewBlock(prev Block, op Operation, initiator []byte) (Block, error) {
 	// hdr.Signature = SignMeta(hdr, s_k)
 
 	blk := Block{Header: hdr, Content: content}
-	if err := saveBlock(blk); err != nil {
-		return Block{}, err
-	}
-	log.Printf("[block] NewBlock created height=%d φ=%x δ=%x", blk.Header.Height, phiSum[:4], dataHash[:4])
+	proposedMu.Lock()
+	proposed[hdr.Height] = proposal{blk, hashHeader(hdr), rw}
+	proposedMu.Unlock()
+	log.Printf("[block] NewBlock created height=%d φ=%x δ=%.4x rejected=%v", blk.Header.Height, phiSum[:4], dataHash, rejected)
 	return blk, nil
 }
 
+// ProposalTip is the block a new proposal extends: the last of this
+// node's in-flight proposals chained on the committed tip, or the tip.
+func ProposalTip() Block {
+	tip := Tip()
+	proposedMu.Lock()
+	defer proposedMu.Unlock()
+	for {
+		p, ok := proposed[tip.Header.Height+1]
+		if !ok || !bytes.Equal(p.blk.Header.PrevHash, hashHeader(tip.Header)) {
+			return tip
+		}
+		tip = p.blk
+	}
+}
+
+// DropProposal abandons this node's proposals from height h up, e.g.
+// after a view change, and rolls their writes back out of the ADS. The
+// proposals above h were built on it and cannot survive it.
+func DropProposal(h int64) {
+	proposedMu.Lock()
+	defer proposedMu.Unlock()
+	dropProposal(h)
+}
+
+func dropProposal(h int64) {
+	low := int64(-1)
+	for ph := range proposed {
+		if ph >= h {
+			delete(proposed, ph)
+			if low < 0 || ph < low {
+				low = ph
+			}
+		}
+	}
+	if low < 0 {
+		return
+	}
+	local().Rollback(low)
+	log.Printf("[block] dropped proposals from height=%d", low)
+}
+
 // func GetBlockchain() []Block {
 // 	blockchainMu.RLock()
 // 	defer blockchainMu.RUnlock()
@@ -92,21 +158,18 @@ func NewBlock(prev Block, op Operation, initiator []byte) (Block, error) {
 // }
 
 func BlockHash(blk Block) string {
-	h := sha256.Sum256(jsonHeader(blk.Header))
-	return hex.EncodeToString(h[:])
+	return hex.EncodeToString(hashHeader(blk.Header))
 }
 
-func jsonHeader(h BlockHeader) []byte {
-	b, _ := json.Marshal(h)
-	return b
-}
+// hashHeader covers the signed part of the header only, so attaching a
+// commit certificate does not change the block identity.
 func hashHeader(h BlockHeader) []byte {
-	sum := sha256.Sum256(jsonHeader(h))
+	sum := sha256.Sum256(metaBytes(h))
 	return sum[:]
 }
 
-// sign(s_k(e_0), M)
-func SignMeta(h BlockHeader, sk ed25519.PrivateKey) []byte {
+// metaBytes is the signed part of the header: everything but the signatures.
+func metaBytes(h BlockHeader) []byte {
 	core := struct {
 		Height      int64  `json:"height"`
 		PrevHash    []byte `json:"prev_hash"`
@@ -114,52 +177,196 @@ func SignMeta(h BlockHeader, sk ed25519.PrivateKey) []byte {
 		DataHash    []byte `json:"data_hash"`
 		RWHash      []byte `json:"rw_hash"`
 		Initiator   []byte `json:"initiator"`
+		ValSetHash  []byte `json:"valset_hash,omitempty"`
+		Rejected    bool   `json:"rejected,omitempty"`
 	}{
-		h.Height, h.PrevHash, h.ContentHash, h.DataHash, h.RWHash, h.Initiator,
+		h.Height, h.PrevHash, h.ContentHash, h.DataHash, h.RWHash, h.Initiator, h.ValSetHash, h.Rejected,
 	}
 	b, _ := json.Marshal(core)
-	return ed25519.Sign(sk, b)
+	return b
+}
+
+// sign(s_k(e_0), M)
+func SignMeta(h BlockHeader, sk ed25519.PrivateKey) []byte {
+	return ed25519.Sign(sk, metaBytes(h))
 }
 func VerifySig(pk ed25519.PublicKey, h BlockHeader, sig []byte) bool {
-	core := struct {
-		Height      int64  `json:"height"`
-		PrevHash    []byte `json:"prev_hash"`
-		ContentHash []byte `json:"content_hash"`
-		DataHash    []byte `json:"data_hash"`
-		RWHash      []byte `json:"rw_hash"`
-		Initiator   []byte `json:"initiator"`
-	}{
-		h.Height, h.PrevHash, h.ContentHash, h.DataHash, h.RWHash, h.Initiator,
-	}
-	b, _ := json.Marshal(core)
-	return ed25519.Verify(pk, b, sig)
+	return ed25519.Verify(pk, metaBytes(h), sig)
 }
 
-func ApplyOperation(b Block) error {
+// commitBytes is what a commit vote signs: the height and hash of the
+// block under a domain of their own, so that no other signature over the
+// header, a proposal or a prepare, counts towards a commit certificate.
+func commitBytes(h BlockHeader) []byte {
+	b := strconv.AppendInt([]byte("falcondb/commit/"), h.Height, 10)
+	return append(append(b, '/'), hashHeader(h)...)
+}
+
+// SignCommit signs a commit vote for h.
+func SignCommit(h BlockHeader, sk ed25519.PrivateKey) []byte {
+	return ed25519.Sign(sk, commitBytes(h))
+}
+
+// VerifyCommitSig checks a commit vote for h.
+func VerifyCommitSig(pk ed25519.PublicKey, h BlockHeader, sig []byte) bool {
+	return ed25519.Verify(pk, commitBytes(h), sig)
+}
+
+// ApplyOperation executes the operation of b and returns its read/write
+// log, for the caller to store with the block.
+func ApplyOperation(b Block) (RWLog, error) {
 	log.Printf("[block] ApplyOperation height=%d", b.Header.Height)
+	rw, err := verifyExecution(b)
+	if err != nil {
+		return RWLog{}, err
+	}
+	validators.Track(b)
+	log.Printf("[block] ApplyOperation success new delta=%x", b.Header.DataHash)
+	return rw, nil
+}
+
+// verifyExecution executes the operation of b at its height and checks the
+// outcome against the header. A mismatch undoes the writes.
+func verifyExecution(b Block) (RWLog, error) {
 	var op Operation
 	if err := json.Unmarshal(b.Content, &op); err != nil {
 		log.Printf("[block] unmarshal op error: %v", err)
-		return err
+		return RWLog{}, err
+	}
+	if err := validators.VerifyValSet(b.Header); err != nil {
+		log.Printf("[block] %v", err)
+		return RWLog{}, err
 	}
-	newDelta, err := store.UpdS(op.Key, op.Value, b.Header.Height)
+	newDelta, rejected, rw, err := local().Execute(op, b.Header.Height)
 	if err != nil {
-		log.Printf("[block] UpdS error: %v", err)
-		return err
+		log.Printf("[block] execute error: %v", err)
+		return RWLog{}, err
+	}
+	switch {
+	case !bytes.Equal(rw.Hash(), b.Header.RWHash):
+		err = fmt.Errorf("RW log mismatch at height %d", b.Header.Height)
+	case rejected != b.Header.Rejected:
+		err = fmt.Errorf("operation at height %d: rejected=%v, header says %v", b.Header.Height, rejected, b.Header.Rejected)
+	case newDelta != hex.EncodeToString(b.Header.DataHash):
+		err = fmt.Errorf("ADS root mismatch: want %x, got %s", b.Header.DataHash, newDelta)
 	}
-	if newDeltaStr := hex.EncodeToString(b.Header.DataHash); newDelta != newDeltaStr {
-		err := fmt.Errorf("ADS root mismatch: want %s, got %s", newDeltaStr, newDelta)
+	if err != nil {
 		log.Printf("[block] %v", err)
+		local().Rollback(b.Header.Height)
+		return RWLog{}, err
+	}
+	return rw, nil
+}
+
+// Speculate executes a block proposed by another node on top of this
+// node's in-flight proposals, so that it can build on the block before it
+// commits. A different block in flight at the same height is dropped with
+// everything above it.
+func Speculate(b Block) error {
+	proposedMu.Lock()
+	defer proposedMu.Unlock()
+	h := b.Header.Height
+	if p, ok := proposed[h]; ok && bytes.Equal(p.hash, hashHeader(b.Header)) {
+		return nil
+	}
+	dropProposal(h)
+
+	parent := Tip()
+	if p, ok := proposed[h-1]; ok {
+		parent = p.blk
+	}
+	if parent.Header.Height != h-1 || !bytes.Equal(b.Header.PrevHash, hashHeader(parent.Header)) {
+		return fmt.Errorf("block %d does not extend the in-flight chain", h)
+	}
+	rw, err := verifyExecution(b)
+	if err != nil {
+		return err
+	}
+	proposed[h] = proposal{b, hashHeader(b.Header), rw}
+	log.Printf("[block] speculated height=%d", h)
+	return nil
+}
+
+// CheckContent checks that b carries the content its header commits to.
+func CheckContent(b Block) error {
+	if sum := sha256.Sum256(b.Content); !bytes.Equal(sum[:], b.Header.ContentHash) {
+		return fmt.Errorf("block %d does not match its content hash", b.Header.Height)
+	}
+	return nil
+}
+
+// VerifyBlock checks a finalized block: its content and the commit
+// certificate of vals over its header, under rule. Every block a node
+// stores without having built it passes here.
+func VerifyBlock(b Block, vals ValidatorSet, rule CommitRule) error {
+	if err := CheckContent(b); err != nil {
+		return err
+	}
+	return VerifyCommit(b.Header, vals, rule)
+}
+
+// CommitBlock stores a finalized block carrying a commit certificate valid
+// under rule. The proposer already applied the operation in NewBlock;
+// everyone else applies it here. Blocks at or below the local tip are
+// ignored.
+func CommitBlock(b Block, rule CommitRule) error {
+	if err := VerifyBlock(b, ValidatorsAt(b.Header.Height), rule); err != nil {
+		return err
+	}
+
+	blockchainMu.Lock()
+	defer blockchainMu.Unlock()
+	tip := Tip().Header
+	if b.Header.Height <= tip.Height {
+		return nil
+	}
+	if b.Header.Height != tip.Height+1 || !bytes.Equal(b.Header.PrevHash, hashHeader(tip)) {
+		return fmt.Errorf("block %d does not extend tip %d", b.Header.Height, tip.Height)
+	}
+
+	proposedMu.Lock()
+	p, own := proposed[b.Header.Height]
+	if !own || !bytes.Equal(p.hash, hashHeader(b.Header)) {
+		dropProposal(b.Header.Height)
+		own = false
+	}
+	delete(proposed, b.Header.Height)
+	proposedMu.Unlock()
+
+	rw := p.rw
+	if own {
+		validators.Track(b)
+	} else {
+		var err error
+		if rw, err = ApplyOperation(b); err != nil {
+			return err
+		}
+	}
+	log.Printf("[block] CommitBlock height=%d signers=%v", b.Header.Height, b.Header.Validators)
+	if err := saveBlock(b, &rw); err != nil {
 		return err
 	}
-	log.Printf("[block] ApplyOperation success new delta=%s", newDelta)
+	replays.Prune(b.Header.Height)
+	notifyCommit()
 	return nil
 }
 
+// Committed returns a channel that is closed at the next commit.
+func Committed() <-chan struct{} {
+	commitChMu.Lock()
+	defer commitChMu.Unlock()
+	return commitCh
+}
+
+func notifyCommit() {
+	commitChMu.Lock()
+	close(commitCh)
+	commitCh = make(chan struct{})
+	commitChMu.Unlock()
+}
+
 func GetADSRoot() string {
-	chain := GetBlockchain()
-	h := chain[len(chain)-1].Header.Height
-	return store.SumAt(h)
+	return store.SumAt(Tip().Header.Height)
 }
 
 func GetADSRootAt(h int64) string {
@@ -197,7 +404,7 @@ func ReplaceChain(newChain []Block) (bool, error) {
 	}
 	blockchain = newChain
 	for _, b := range newChain {
-		if err := saveBlock(b); err != nil {
+		if err := saveBlock(b, nil); err != nil {
 			return false, err
 		}
 	}
@@ -222,29 +429,6 @@ func GenesisBlock() Block {
 	}
 }
 
-func SyncChainFromPeer(url string) error {
-	resp, err := http.Get(url + "/chain")
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	var peerChain []Block
-	if err := json.NewDecoder(resp.Body).Decode(&peerChain); err != nil {
-		return err
-	}
-
-	local := GetBlockchain()
-	for i := len(local); i < len(peerChain); i++ {
-		if err := ApplyOperation(peerChain[i]); err != nil {
-			return fmt.Errorf("sync apply op: %w", err)
-		}
-	}
-
-	_, err = ReplaceChain(peerChain)
-	return err
-}
-
 func HashHeader(h BlockHeader) []byte {
 	return hashHeader(h)
 }
@@ -0,0 +1,89 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// Change is a key a committed block wrote, with the ADS proof of the new
+// value against the header's DataHash. The ADS only proves presence, so a
+// deleted key carries the block's RW log instead, which the header's
+// RWHash commits to.
+type Change struct {
+	Height  int64               `json:"height"`
+	Key     string              `json:"key"`
+	Value   []byte              `json:"value,omitempty"`
+	Deleted bool                `json:"deleted,omitempty"`
+	Proof   []storage.ProofNode `json:"proof,omitempty"`
+	RWLog   *RWLog              `json:"rw_log,omitempty"`
+}
+
+// ChangesAt lists the keys block h wrote that match selects, in the order
+// they were first written, each once with its value after the block.
+func ChangesAt(h int64, match func(key string) bool) ([]Change, error) {
+	// a state sync must not swap the store between the log and the proofs
+	blockchainMu.RLock()
+	defer blockchainMu.RUnlock()
+	raw, err := GetRWLog(h)
+	if err != nil {
+		return nil, err
+	}
+	var l RWLog
+	if err := json.Unmarshal(raw, &l); err != nil {
+		return nil, err
+	}
+	var out []Change
+	seen := map[string]bool{}
+	for _, w := range l.Writes {
+		if seen[w.Key] || !match(w.Key) {
+			continue
+		}
+		seen[w.Key] = true
+		c := Change{Height: h, Key: w.Key}
+		if l.deletes(w.Key) {
+			c.Deleted, c.RWLog = true, &l
+		} else if c.Value, c.Proof, err = store.Qry(w.Key, h); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// deletes reports whether the last write of key in l deletes it.
+func (l RWLog) deletes(key string) bool {
+	del := false
+	for _, w := range l.Writes {
+		if w.Key == key {
+			del = w.New == nil
+		}
+	}
+	return del
+}
+
+// Verify checks the proof of c against the header of its height.
+func (c Change) Verify(h BlockHeader) error {
+	if c.Height != h.Height {
+		return fmt.Errorf("change at height %d, header %d", c.Height, h.Height)
+	}
+	if c.Deleted {
+		switch {
+		case c.RWLog == nil:
+			return errors.New("deletion without RW log")
+		case c.RWLog.Height != h.Height || !bytes.Equal(c.RWLog.Hash(), h.RWHash):
+			return errors.New("RW log does not match the header")
+		case !c.RWLog.deletes(c.Key):
+			return fmt.Errorf("block %d does not delete %s", h.Height, c.Key)
+		}
+		return nil
+	}
+	if !storage.VerifyProof(hex.EncodeToString(h.DataHash), c.Key, c.Value, c.Proof) {
+		return errors.New("ADS proof verification failed")
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package block
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// A change fails to verify against its header once tampered with, or once
+// a write is passed off as a deletion.
+func TestTamperedChange(t *testing.T) {
+	m := Machine{storage.NewMemADS(), NewValidatorHistory(ValidatorSet{}), NewReplayIndex()}
+	if _, err := m.ADS.UpdS("z", []byte("0"), 1); err != nil {
+		t.Fatal(err)
+	}
+	header := func(op Operation, h int64) (BlockHeader, RWLog) {
+		root, rejected, rw, err := m.Execute(op, h)
+		if err != nil || rejected {
+			t.Fatalf("execute %s at %d: rejected=%v %v", op.kind(), h, rejected, err)
+		}
+		data, _ := hex.DecodeString(root)
+		return BlockHeader{Height: h, DataHash: data, RWHash: rw.Hash()}, rw
+	}
+	h2, rw2 := header(Operation{Key: "a", Value: []byte("1")}, 2)
+	h3, rw3 := header(Operation{Type: OpDelete, Key: "a"}, 3)
+	val, proof, err := m.ADS.Qry("a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := Change{Height: 2, Key: "a", Value: val, Proof: proof}
+	del := Change{Height: 3, Key: "a", Deleted: true, RWLog: &rw3}
+	if err := put.Verify(h2); err != nil {
+		t.Fatalf("honest write: %v", err)
+	}
+	if err := del.Verify(h3); err != nil {
+		t.Fatalf("honest deletion: %v", err)
+	}
+
+	for name, c := range map[string]struct {
+		change Change
+		header BlockHeader
+	}{
+		"value": {func(c Change) Change { c.Value = []byte("2"); return c }(put), h2},
+		"key":   {func(c Change) Change { c.Key = "b"; return c }(put), h2},
+		"proof": {func(c Change) Change {
+			c.Proof = append([]storage.ProofNode(nil), c.Proof...)
+			c.Proof[0].Hash = make([]byte, len(c.Proof[0].Hash))
+			return c
+		}(put), h2},
+		"height":          {put, h3},
+		"deleted, no log": {func(c Change) Change { c.Deleted = true; return c }(put), h2},
+		"deleted by put":  {func(c Change) Change { c.Deleted, c.RWLog = true, &rw2; return c }(put), h2},
+		"other log":       {func(c Change) Change { c.RWLog = &rw2; return c }(del), h3},
+		"other key":       {func(c Change) Change { c.Key = "b"; return c }(del), h3},
+		"log edited": {func(c Change) Change {
+			l := rw3
+			l.Writes = append([]WriteEntry{{Key: "b"}}, l.Writes...)
+			c.Key, c.RWLog = "b", &l
+			return c
+		}(del), h3},
+	} {
+		if err := c.change.Verify(c.header); err == nil {
+			t.Errorf("%s: tampered change verifies", name)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package block
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// Condition guards an operation on the current version (VF) of a key:
+//   - Exists: the key must have an active version, whichever
+//   - Version > 0: the active version must start at that height
+//   - Version == 0 or Absent: the key must have no active version
+//     (put-if-absent), as VersionOf reports for it
+//
+// All conditions of an operation must hold against the state before its
+// block, otherwise the block commits the operation as rejected.
+type Condition struct {
+	Key     string `json:"key"`
+	Absent  bool   `json:"absent,omitempty"`
+	Exists  bool   `json:"exists,omitempty"`
+	Version int64  `json:"version,omitempty"`
+}
+
+func (c Condition) holds(ads *storage.ADS, height int64) bool {
+	v, ok := ads.Get(c.Key, height)
+	switch {
+	case c.Exists:
+		return ok
+	case c.Absent, c.Version == 0:
+		return !ok
+	default:
+		return ok && v.VF == c.Version
+	}
+}
+
+// accepted evaluates the conditions of op for the block at height and logs
+// the guarded keys as reads.
+func (op Operation) accepted(ads *storage.ADS, height int64, rw *RWLog) bool {
+	ok := true
+	for _, c := range op.If {
+		rw.read(ads, c.Key, height-1)
+		if !c.holds(ads, height-1) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// ParseCondition parses "key:version", "key:absent" or "key:exists".
+func ParseCondition(s string) (Condition, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return Condition{}, fmt.Errorf("bad condition %q", s)
+	}
+	c := Condition{Key: s[:i]}
+	switch s[i+1:] {
+	case "absent":
+		c.Absent = true
+		return c, nil
+	case "exists":
+		c.Exists = true
+		return c, nil
+	}
+	v, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil || v < 0 {
+		return Condition{}, fmt.Errorf("bad condition version %q", s[i+1:])
+	}
+	c.Version = v
+	return c, nil
+}
+
+// VersionOf returns the version (VF) of key active at height, 0 if none.
+func VersionOf(key string, height int64) int64 {
+	return versionOf(store, key, height)
+}
+
+func versionOf(ads *storage.ADS, key string, height int64) int64 {
+	v, ok := ads.Get(key, height)
+	if !ok {
+		return 0
+	}
+	return v.VF
+}
@@ -0,0 +1,117 @@
+package block
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// SignedMsg is the signed part of a consensus message: Sig is the
+// sender's ed25519 signature over Kind, From, Height, View and Digest.
+type SignedMsg struct {
+	Kind   string `json:"kind"`
+	From   string `json:"from"`
+	Height int64  `json:"height"`
+	View   int64  `json:"view"`
+	Digest []byte `json:"digest"`
+	Sig    []byte `json:"sig"`
+}
+
+// SignedBytes is what Sig signs.
+func (m SignedMsg) SignedBytes() []byte {
+	b, _ := json.Marshal(struct {
+		Kind   string `json:"kind"`
+		From   string `json:"from"`
+		Height int64  `json:"height"`
+		View   int64  `json:"view"`
+		Digest []byte `json:"digest"`
+	}{m.Kind, m.From, m.Height, m.View, m.Digest})
+	return b
+}
+
+// voteClasses groups the message kinds in which a correct validator signs
+// a single digest per height and view: every PBFT phase of a view is
+// about the one pre-prepared block, and a HotStuff leader votes for its
+// own proposal.
+var voteClasses = map[string]string{
+	"preprepare":  "pbft",
+	"prepare":     "pbft",
+	"commit":      "pbft",
+	"hs-proposal": "hotstuff",
+	"hs-vote":     "hotstuff",
+}
+
+// VoteClass returns the class of a message kind, if messages of that kind
+// can equivocate.
+func VoteClass(kind string) (string, bool) {
+	c, ok := voteClasses[kind]
+	return c, ok
+}
+
+// Evidence proves that a validator equivocated: A and B are two messages
+// of one vote class it signed for the same height and view, about
+// different digests.
+type Evidence struct {
+	A SignedMsg `json:"a"`
+	B SignedMsg `json:"b"`
+}
+
+// Offender is the validator the evidence is against.
+func (e Evidence) Offender() string { return e.A.From }
+
+// Verify checks the evidence against the validator set of its height.
+func (e Evidence) Verify(vals ValidatorSet) error {
+	a, b := e.A, e.B
+	ca, okA := VoteClass(a.Kind)
+	cb, okB := VoteClass(b.Kind)
+	switch {
+	case !okA || !okB || ca != cb:
+		return fmt.Errorf("evidence: %s and %s messages do not conflict", a.Kind, b.Kind)
+	case a.From != b.From || a.Height != b.Height || a.View != b.View:
+		return fmt.Errorf("evidence: messages of different senders or rounds")
+	case bytes.Equal(a.Digest, b.Digest):
+		return fmt.Errorf("evidence: both messages sign the same digest")
+	}
+	pk, ok := vals[a.From]
+	if !ok {
+		return fmt.Errorf("evidence: %s is not a validator at height %d", a.From, a.Height)
+	}
+	if !ed25519.Verify(pk, a.SignedBytes(), a.Sig) || !ed25519.Verify(pk, b.SignedBytes(), b.Sig) {
+		return fmt.Errorf("evidence: bad signature of %s", a.From)
+	}
+	return nil
+}
+
+// SlashedKey is the reserved ADS key recording the height at which
+// validator id was slashed.
+func SlashedKey(id string) string {
+	return "__slashed__/" + id
+}
+
+// applyEvidence records the offenders of the evidence an operation
+// carries. Invalid evidence rejects the operation; evidence against an
+// offender slashed before is skipped.
+func applyEvidence(st *State, evs []Evidence) error {
+	for _, ev := range evs {
+		if err := ev.Verify(st.m.Validators.At(ev.A.Height)); err != nil {
+			return err
+		}
+		if _, done := st.Get(SlashedKey(ev.Offender())); done {
+			continue
+		}
+		st.Put(SlashedKey(ev.Offender()), []byte(strconv.FormatInt(st.Height(), 10)))
+	}
+	return nil
+}
+
+// EvidenceOf returns the evidence b applied: none when its operation was
+// rejected.
+func EvidenceOf(b Block) []Evidence {
+	var op Operation
+	if b.Header.Rejected || json.Unmarshal(b.Content, &op) != nil {
+		return nil
+	}
+	return op.Evidence
+}
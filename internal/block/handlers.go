@@ -0,0 +1,274 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+const (
+	OpPut       = "put"
+	OpDelete    = "delete"
+	OpIncr      = "incr"
+	OpAppend    = "append"
+	OpValidator = "validator"
+	// OpNoop writes nothing; consensus engines propose it to make progress
+	// when no client operation is pending.
+	OpNoop = "noop"
+)
+
+// reservedPrefixes are the key prefixes the chain keeps for itself: the
+// validator keys, the slashed validators and the used validator update
+// nonces. Client operations cannot write below them.
+var reservedPrefixes = []string{"__validator__/", "__slashed__/", "__reconfig__/"}
+
+// ReservedKey reports whether key belongs to the chain itself.
+func ReservedKey(key string) bool {
+	for _, p := range reservedPrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler executes one operation type. It must be deterministic: read and
+// write only through st and depend on nothing but op and st, since every
+// replica re-executes it. An error rejects the operation.
+type Handler func(st *State, op Operation) error
+
+var (
+	handlers   = map[string]Handler{}
+	handlersMu sync.RWMutex
+)
+
+func init() {
+	RegisterHandler(OpPut, putHandler)
+	RegisterHandler(OpDelete, deleteHandler)
+	RegisterHandler(OpIncr, incrHandler)
+	RegisterHandler(OpAppend, appendHandler)
+	RegisterHandler(OpValidator, validatorHandler)
+	RegisterHandler(OpNoop, noopHandler)
+}
+
+// RegisterHandler makes an operation type available. Every node of a
+// cluster must register the same handlers before it starts.
+func RegisterHandler(typ string, h Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	if _, dup := handlers[typ]; dup {
+		panic("block: RegisterHandler called twice for " + typ)
+	}
+	handlers[typ] = h
+}
+
+func handlerFor(typ string) (Handler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	h, ok := handlers[typ]
+	return h, ok
+}
+
+// kind is the operation type, defaulting to a put.
+func (op Operation) kind() string {
+	switch {
+	case op.Type != "":
+		return op.Type
+	case op.Validator != nil:
+		return OpValidator
+	default:
+		return OpPut
+	}
+}
+
+// State is the view of the ADS a handler runs against: the state before
+// the block plus the handler's own writes. Reads and writes are logged.
+type State struct {
+	m      Machine
+	height int64
+	rw     *RWLog
+	read   map[string]bool
+	writes []storage.Write
+	index  map[string]int
+}
+
+func newState(m Machine, height int64, rw *RWLog) *State {
+	return &State{m: m, height: height, rw: rw, read: map[string]bool{}, index: map[string]int{}}
+}
+
+// Height is the height of the block being executed.
+func (st *State) Height() int64 { return st.height }
+
+func (st *State) Get(key string) ([]byte, bool) {
+	if i, ok := st.index[key]; ok {
+		w := st.writes[i]
+		return w.Value, !w.Delete
+	}
+	if !st.read[key] {
+		st.read[key] = true
+		st.rw.read(st.m.ADS, key, st.height-1)
+	}
+	v, ok := st.m.ADS.Get(key, st.height-1)
+	return v.Value, ok
+}
+
+func (st *State) Put(key string, value []byte) {
+	st.set(storage.Write{Key: key, Value: value})
+}
+
+func (st *State) Delete(key string) {
+	st.set(storage.Write{Key: key, Delete: true})
+}
+
+func (st *State) set(w storage.Write) {
+	if i, ok := st.index[w.Key]; ok {
+		st.writes[i] = w
+		return
+	}
+	st.index[w.Key] = len(st.writes)
+	st.writes = append(st.writes, w)
+}
+
+func putHandler(st *State, op Operation) error {
+	st.Put(op.Key, op.Value)
+	return nil
+}
+
+func deleteHandler(st *State, op Operation) error {
+	if _, ok := st.Get(op.Key); !ok {
+		return fmt.Errorf("key %s not found", op.Key)
+	}
+	st.Delete(op.Key)
+	return nil
+}
+
+// incrHandler adds the decimal Value (1 if empty) to a decimal counter.
+func incrHandler(st *State, op Operation) error {
+	delta := int64(1)
+	if len(op.Value) > 0 {
+		d, err := strconv.ParseInt(string(op.Value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad increment %q", op.Value)
+		}
+		delta = d
+	}
+	var cur int64
+	if raw, ok := st.Get(op.Key); ok {
+		c, err := strconv.ParseInt(string(raw), 10, 64)
+		if err != nil {
+			return fmt.Errorf("key %s is not a counter", op.Key)
+		}
+		cur = c
+	}
+	next := cur + delta
+	if (delta > 0 && next < cur) || (delta < 0 && next > cur) {
+		return fmt.Errorf("counter %s overflows", op.Key)
+	}
+	st.Put(op.Key, []byte(strconv.FormatInt(next, 10)))
+	return nil
+}
+
+// appendHandler appends Value to a list stored as a JSON array of strings.
+func appendHandler(st *State, op Operation) error {
+	var list []string
+	if raw, ok := st.Get(op.Key); ok {
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return fmt.Errorf("key %s is not a list", op.Key)
+		}
+	}
+	list = append(list, string(op.Value))
+	raw, _ := json.Marshal(list)
+	st.Put(op.Key, raw)
+	return nil
+}
+
+func validatorHandler(st *State, op Operation) error {
+	u := op.Validator
+	if u == nil {
+		return fmt.Errorf("validator operation without update")
+	}
+	if err := st.m.Validators.Check(st.Height(), *u); err != nil {
+		return err
+	}
+	if _, used := st.Get(reconfigKey(u.Nonce)); used {
+		return fmt.Errorf("validator update %s applied already", u.Nonce)
+	}
+	st.Put(reconfigKey(u.Nonce), []byte(strconv.FormatInt(st.Height(), 10)))
+	if u.Action == ValidatorRemove {
+		st.Delete(ValidatorKey(u.ID))
+	} else {
+		st.Put(ValidatorKey(u.ID), u.PK)
+	}
+	return nil
+}
+
+func noopHandler(st *State, op Operation) error {
+	return nil
+}
+
+// Machine is what operations execute against: an ADS, the validator
+// history that validator updates and evidence are checked with, and the
+// request ids applied lately. A node executes on its own store, validators
+// and replays; the simulator gives each of its validators a machine of its
+// own.
+type Machine struct {
+	ADS        *storage.ADS
+	Validators *ValidatorHistory
+	Replays    *ReplayIndex
+}
+
+// local is the machine of this node.
+func local() Machine {
+	return Machine{store, validators, replays}
+}
+
+// Rollback undoes the blocks executed at or above height.
+func (m Machine) Rollback(height int64) {
+	m.ADS.Rollback(height)
+	m.Replays.Rollback(height)
+}
+
+// Execute runs op as the operation of the block at height and returns the
+// new ADS root and the read/write log. An operation whose conditions fail
+// or whose handler errors is rejected and writes nothing.
+func (m Machine) Execute(op Operation, height int64) (string, bool, RWLog, error) {
+	rw := RWLog{Height: height}
+	h, ok := handlerFor(op.kind())
+	if !ok {
+		return "", false, rw, fmt.Errorf("unknown operation type %q", op.kind())
+	}
+	if op.kind() != OpValidator && ReservedKey(op.Key) {
+		log.Printf("[block] %s operation rejected at height=%d: key %s is reserved", op.kind(), height, op.Key)
+		return m.ADS.SumAt(height), true, rw, nil
+	}
+	if !op.accepted(m.ADS, height, &rw) {
+		return m.ADS.SumAt(height), true, rw, nil
+	}
+	tracked := op.Nonce != "" && op.kind() != OpNoop
+	if tracked && m.Replays.Applied(op.Nonce, height) {
+		log.Printf("[block] %s operation rejected at height=%d: request %s applied already", op.kind(), height, op.Nonce)
+		return m.ADS.SumAt(height), true, rw, nil
+	}
+	st := newState(m, height, &rw)
+	if err := applyEvidence(st, op.Evidence); err != nil {
+		log.Printf("[block] %s operation rejected at height=%d: %v", op.kind(), height, err)
+		return m.ADS.SumAt(height), true, rw, nil
+	}
+	if err := h(st, op); err != nil {
+		log.Printf("[block] %s operation rejected at height=%d: %v", op.kind(), height, err)
+		return m.ADS.SumAt(height), true, rw, nil
+	}
+	for _, w := range st.writes {
+		rw.write(m.ADS, w.Key, w.Value, height)
+	}
+	delta, err := m.ADS.UpdM(st.writes, height)
+	if err == nil && tracked {
+		m.Replays.add(op.Nonce, height)
+	}
+	return delta, false, rw, err
+}
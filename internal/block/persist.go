@@ -1,30 +1,44 @@
 package block
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
+	"strconv"
 
+	"github.com/mauzec/falcondb/internal/storage"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// KeyChange is one block that wrote a key.
+type KeyChange struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
 var blkDB *leveldb.DB
 var BlkPath string
 
-func init() {
-	if os.Getenv("MODE") == "client" {
-		log.Printf("[block-persist] skip LevelDB open (client mode)")
-		return
+// Open puts the chain in the LevelDB at blkPath and the state in the one
+// at adsPath, seeding both on first use. Until then, and in processes that
+// never call it such as clients, nothing is stored.
+func Open(blkPath, adsPath string) error {
+	if err := storage.Open(adsPath); err != nil {
+		return err
 	}
+	store = storage.NewADS()
+	proposedMu.Lock()
+	proposed = map[int64]proposal{}
+	proposedMu.Unlock()
 
-	path := os.Getenv("BLK_PATH")
-	log.Printf("[block-persist] Opening blockchain DB at %s", path)
+	log.Printf("[block-persist] Opening blockchain DB at %s", blkPath)
 	var err error
-	blkDB, err = leveldb.OpenFile(path, nil)
+	blkDB, err = leveldb.OpenFile(blkPath, nil)
 	if err != nil {
-		log.Fatalf("[block-persist] cannot open blockchain.db: %v", err)
+		return fmt.Errorf("cannot open blockchain.db: %w", err)
 	}
 	log.Printf("[block-persist] Blockchain DB opened")
 
@@ -35,22 +49,177 @@ func init() {
 		raw, _ := json.Marshal(gen)
 		log.Printf("[block-persist] Seeding genesis block height=%d", gen.Header.Height)
 		if err := blkDB.Put([]byte(key), raw, nil); err != nil {
-			log.Fatalf("[block-persist] cannot seed genesis: %v", err)
+			iter.Release()
+			return fmt.Errorf("cannot seed genesis: %w", err)
 		}
 		log.Printf("[block-persist] Genesis seeded")
 	}
 	iter.Release()
+
+	if ok, _ := blkDB.Has([]byte("meta:kidx"), nil); !ok {
+		if err := rebuildKeyIndex(); err != nil {
+			return fmt.Errorf("cannot build key index: %w", err)
+		}
+	}
+
+	chain := GetBlockchain()
+	if err := checkFormat(chain); err != nil {
+		return err
+	}
+
+	// a proposal built by NewBlock but never committed left its writes
+	// in the ADS; the block itself is replayed from the consensus WAL
+	store.Rollback(chain[len(chain)-1].Header.Height + 1)
+	return rebuildReplays()
+}
+
+// Close closes the databases Open opened.
+func Close() error {
+	if blkDB == nil {
+		return nil
+	}
+	err := blkDB.Close()
+	blkDB = nil
+	if cerr := storage.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// checkFormat refuses a chain stored by a release that hashed the whole
+// header, signatures included, into PrevHash. Such a chain cannot be
+// carried over: relinking its blocks would void the signatures over them.
+func checkFormat(chain []Block) error {
+	for i := 1; i < len(chain); i++ {
+		prev, b := chain[i-1].Header, chain[i].Header
+		if b.Height != prev.Height+1 || bytes.Equal(b.PrevHash, hashHeader(prev)) {
+			continue
+		}
+		full, _ := json.Marshal(prev)
+		if legacy := sha256.Sum256(full); bytes.Equal(b.PrevHash, legacy[:]) {
+			return fmt.Errorf("block %d was stored by an older release, which hashed whole headers; "+
+				"start from empty BLK_PATH and ADS_PATH and sync from a peer", b.Height)
+		}
+		return fmt.Errorf("stored block %d does not extend block %d; was BLK_PATH written by another release?", b.Height, prev.Height)
+	}
+	return nil
 }
 
-func saveBlock(b Block) error {
+// keyIndexKey is "kidx:{key}\x00{height}"; the separator keeps "a" from
+// matching the entries of "ab".
+func keyIndexKey(key string, height int64) []byte {
+	return []byte(fmt.Sprintf("kidx:%s\x00%020d", key, height))
+}
+
+// rebuildKeyIndex fills the key change index from stored read/write logs,
+// for databases written before the index existed.
+func rebuildKeyIndex() error {
+	hashes := make(map[int64]string)
+	for _, b := range GetBlockchain() {
+		hashes[b.Header.Height] = BlockHash(b)
+	}
+
+	batch := new(leveldb.Batch)
+	iter := blkDB.NewIterator(util.BytesPrefix([]byte("rw:")), nil)
+	for iter.Next() {
+		var l RWLog
+		if err := json.Unmarshal(iter.Value(), &l); err != nil {
+			continue
+		}
+		for _, w := range l.Writes {
+			batch.Put(keyIndexKey(w.Key, l.Height), []byte(hashes[l.Height]))
+		}
+	}
+	iter.Release()
+	batch.Put([]byte("meta:kidx"), []byte("1"))
+	log.Printf("[block-persist] Key index rebuilt entries=%d", batch.Len()-1)
+	return blkDB.Write(batch, nil)
+}
+
+// KeyHistory lists the blocks that changed key, in height order.
+func KeyHistory(key string) ([]KeyChange, error) {
+	prefix := []byte(fmt.Sprintf("kidx:%s\x00", key))
+	iter := blkDB.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	var out []KeyChange
+	for iter.Next() {
+		h, err := strconv.ParseInt(string(iter.Key()[len(prefix):]), 10, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, KeyChange{Height: h, Hash: string(iter.Value())})
+	}
+	return out, iter.Error()
+}
+
+// saveBlock stores b together with its read/write log, if any, in one
+// batch: a crash leaves neither the log nor the key index of a block that
+// was never stored.
+func saveBlock(b Block, rw *RWLog) error {
 	log.Printf("[persist] saveBlock height=%d", b.Header.Height)
-	key := fmt.Sprintf("block:%020d", b.Header.Height)
+	batch := new(leveldb.Batch)
+	if err := putBlock(batch, b); err != nil {
+		log.Printf("[persist] marshal error: %v", err)
+		return err
+	}
+	if rw != nil {
+		putRWLog(batch, b, *rw)
+	}
+	return blkDB.Write(batch, nil)
+}
+
+// putBlock adds the writes that store b to batch: the block itself and
+// the index of its transaction.
+func putBlock(batch *leveldb.Batch, b Block) error {
 	raw, err := json.Marshal(b)
 	if err != nil {
-		log.Printf("[persist] marshal error: %v", err)
 		return err
 	}
-	return blkDB.Put([]byte(key), raw, nil)
+	batch.Put([]byte(fmt.Sprintf("block:%020d", b.Header.Height)), raw)
+	// a replayed operation is the same tx, rejected; the receipt stays with
+	// the block that applied it
+	if _, ok := TxHeight(TxID(b.Content)); !ok {
+		batch.Put([]byte("tx:"+TxID(b.Content)), []byte(strconv.FormatInt(b.Header.Height, 10)))
+	}
+	// the request id a client got back before the tx id existed
+	var op Operation
+	if json.Unmarshal(b.Content, &op) == nil && op.Nonce != "" {
+		if _, ok := TxOfNonce(op.Nonce); !ok {
+			batch.Put([]byte("nonce:"+op.Nonce), []byte(TxID(b.Content)))
+		}
+	}
+	return nil
+}
+
+// TxOfNonce returns the committed transaction of a request id.
+func TxOfNonce(nonce string) (string, bool) {
+	raw, err := blkDB.Get([]byte("nonce:"+nonce), nil)
+	if err != nil {
+		return "", false
+	}
+	return string(raw), true
+}
+
+// TxHeight returns the height of the committed block carrying tx.
+func TxHeight(tx string) (int64, bool) {
+	raw, err := blkDB.Get([]byte("tx:"+tx), nil)
+	if err != nil {
+		return 0, false
+	}
+	h, err := strconv.ParseInt(string(raw), 10, 64)
+	return h, err == nil
+}
+
+// GetBlock returns the committed block at height h.
+func GetBlock(h int64) (Block, error) {
+	var b Block
+	raw, err := blkDB.Get([]byte(fmt.Sprintf("block:%020d", h)), nil)
+	if err != nil {
+		return b, err
+	}
+	err = json.Unmarshal(raw, &b)
+	return b, err
 }
 
 func GetBlockchain() []Block {
@@ -70,3 +239,33 @@ func GetBlockchain() []Block {
 	// log.Printf("[persist] Loaded chain length=%d", len(chain))
 	return chain
 }
+
+// Tip returns the highest committed block, reading that block alone.
+func Tip() Block {
+	iter := blkDB.NewIterator(util.BytesPrefix([]byte("block:")), nil)
+	defer iter.Release()
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		var b Block
+		if err := json.Unmarshal(iter.Value(), &b); err != nil {
+			log.Printf("[persist] skip invalid block: %v", err)
+			continue
+		}
+		return b
+	}
+	return GenesisBlock()
+}
+
+// putRWLog adds the read/write log of b to batch, and b to the change
+// index of every key it wrote.
+func putRWLog(batch *leveldb.Batch, b Block, l RWLog) {
+	batch.Put([]byte(fmt.Sprintf("rw:%020d", l.Height)), l.bytes())
+	for _, w := range l.Writes {
+		batch.Put(keyIndexKey(w.Key, l.Height), []byte(BlockHash(b)))
+	}
+}
+
+// GetRWLog returns the stored read/write log of height h as served to
+// auditors; its sha256 is the header's RWHash.
+func GetRWLog(h int64) ([]byte, error) {
+	return blkDB.Get([]byte(fmt.Sprintf("rw:%020d", h)), nil)
+}
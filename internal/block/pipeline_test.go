@@ -0,0 +1,122 @@
+package block
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// openTemp opens package block on fresh databases with vals as genesis
+// validators.
+func openTemp(t *testing.T, vals ValidatorSet) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := Open(filepath.Join(dir, "bc.db"), filepath.Join(dir, "ads.db")); err != nil {
+		t.Fatal(err)
+	}
+	SetGenesisValidators(vals)
+	t.Cleanup(func() {
+		Close()
+		SetGenesisValidators(nil)
+	})
+}
+
+// testValidators returns four validators and their keys.
+func testValidators() (ValidatorSet, map[string]ed25519.PrivateKey) {
+	vals, keys := ValidatorSet{}, map[string]ed25519.PrivateKey{}
+	for i := 1; i <= 4; i++ {
+		id := fmt.Sprintf("validator%d", i)
+		pk, sk, _ := ed25519.GenerateKey(nil)
+		vals[id], keys[id] = pk, sk
+	}
+	return vals, keys
+}
+
+// peerBlock is the block another validator, executing on m, builds with op
+// on top of prev, certified by all of keys.
+func peerBlock(t *testing.T, m Machine, prev Block, op Operation, keys map[string]ed25519.PrivateKey) Block {
+	t.Helper()
+	h := prev.Header.Height + 1
+	content, _ := json.Marshal(op)
+	root, rejected, rw, err := m.Execute(op, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	data, _ := hex.DecodeString(root)
+	hdr := BlockHeader{
+		Height:      h,
+		PrevHash:    hashHeader(prev.Header),
+		ContentHash: sum[:],
+		DataHash:    data,
+		RWHash:      rw.Hash(),
+		ValSetHash:  m.Validators.At(h).Hash(),
+		Rejected:    rejected,
+	}
+	var ids []string
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		hdr.Validators = append(hdr.Validators, id)
+		hdr.Signatures = append(hdr.Signatures, SignCommit(hdr, keys[id]))
+	}
+	return Block{Header: hdr, Content: content}
+}
+
+// When a peer's block wins a height this node has proposals in flight at,
+// the proposals from that height up are dropped and their writes and
+// request ids rolled back, leaving the state of the winner alone.
+func TestPipelineRollback(t *testing.T) {
+	vals, keys := testValidators()
+	openTemp(t, vals)
+	genesis := Tip()
+
+	own2, err := NewBlock(genesis, Operation{Key: "a", Value: []byte("own"), Nonce: "n1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBlock(own2, Operation{Key: "b", Value: []byte("own")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tip := ProposalTip().Header.Height; tip != 3 {
+		t.Fatalf("proposal tip %d, want 3", tip)
+	}
+
+	peer := Machine{storage.NewMemADS(), NewValidatorHistory(vals), NewReplayIndex()}
+	win := peerBlock(t, peer, genesis, Operation{Key: "a", Value: []byte("peer")}, keys)
+	if err := Speculate(win); err != nil {
+		t.Fatal(err)
+	}
+	if tip := ProposalTip(); !bytes.Equal(hashHeader(tip.Header), hashHeader(win.Header)) {
+		t.Fatalf("proposal tip at height %d is not the winner", tip.Header.Height)
+	}
+	if VersionOf("b", 3) != 0 {
+		t.Fatal("write of the dropped block 3 survived speculation")
+	}
+	if replays.Applied("n1", 3) {
+		t.Fatal("request id of the dropped block 2 survived speculation")
+	}
+	if err := CommitBlock(win, Quorum); err != nil {
+		t.Fatal(err)
+	}
+
+	if root := GetADSRoot(); root != hex.EncodeToString(win.Header.DataHash) {
+		t.Fatalf("ADS root %s, winner commits to %x", root, win.Header.DataHash)
+	}
+	if v, _, err := QueryADS("a", 2); err != nil || string(v) != "peer" {
+		t.Fatalf("a = %q (%v), want the winner's", v, err)
+	}
+	if VersionOf("b", 3) != 0 || replays.Applied("n1", 3) {
+		t.Fatal("dropped blocks came back with the commit")
+	}
+}
@@ -0,0 +1,102 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// TxID identifies a submitted operation: hex sha256 of its encoding, which
+// is also the ContentHash of the block that carries it.
+func TxID(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Receipt proves that a transaction was finalized and what it wrote.
+type Receipt struct {
+	Tx     string      `json:"tx"`
+	Height int64       `json:"height"`
+	Header BlockHeader `json:"header"` // carries the commit certificate
+
+	// Operation is the raw operation. Its sha256 equals both Tx and
+	// Header.ContentHash, which proves inclusion in the block.
+	Operation []byte `json:"operation"`
+	Rejected  bool   `json:"rejected"`
+
+	// ADS proof of the written key against Header.DataHash; empty when the
+	// operation was rejected or only deleted keys.
+	Key   string              `json:"key,omitempty"`
+	Value []byte              `json:"value,omitempty"`
+	Proof []storage.ProofNode `json:"proof,omitempty"`
+}
+
+// GetReceipt builds the receipt of a committed transaction.
+func GetReceipt(tx string) (Receipt, error) {
+	h, ok := TxHeight(tx)
+	if !ok {
+		return Receipt{}, errors.New("tx not committed")
+	}
+	b, err := GetBlock(h)
+	if err != nil {
+		return Receipt{}, err
+	}
+	r := Receipt{Tx: tx, Height: h, Header: b.Header, Operation: b.Content, Rejected: b.Header.Rejected}
+	if r.Rejected {
+		return r, nil
+	}
+
+	raw, err := GetRWLog(h)
+	if err != nil {
+		return r, nil
+	}
+	var l RWLog
+	json.Unmarshal(raw, &l)
+	for _, w := range l.Writes {
+		if w.New == nil {
+			continue
+		}
+		val, proof, err := store.Qry(w.Key, h)
+		if err != nil {
+			return Receipt{}, err
+		}
+		r.Key, r.Value, r.Proof = w.Key, val, proof
+		break
+	}
+	return r, nil
+}
+
+// VerifyReceipt checks a receipt against the validator set of its height:
+// commit certificate under rule, inclusion of the operation and the ADS
+// proof.
+func VerifyReceipt(r Receipt, vals ValidatorSet, rule CommitRule) error {
+	if r.Header.Height != r.Height {
+		return fmt.Errorf("receipt height %d, header %d", r.Height, r.Header.Height)
+	}
+	if err := VerifyCommit(r.Header, vals, rule); err != nil {
+		return err
+	}
+	if TxID(r.Operation) != r.Tx || !bytes.Equal(r.Header.ContentHash, mustDecodeHex(r.Tx)) {
+		return errors.New("operation not included in block")
+	}
+	if r.Rejected != r.Header.Rejected {
+		return errors.New("rejected flag does not match header")
+	}
+	if r.Key == "" {
+		return nil
+	}
+	if !storage.VerifyProof(hex.EncodeToString(r.Header.DataHash), r.Key, r.Value, r.Proof) {
+		return errors.New("ADS proof verification failed")
+	}
+	return nil
+}
+
+func mustDecodeHex(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
@@ -0,0 +1,73 @@
+package block
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// testReceipt is the receipt of a put of a=1 at height 2, certified by
+// three of four validators.
+func testReceipt(t *testing.T) (Receipt, ValidatorSet) {
+	t.Helper()
+	ads := storage.NewMemADS()
+	for k, v := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if _, err := ads.UpdS(k, []byte(v), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, _ := hex.DecodeString(ads.SumAt(2))
+	op := []byte(`{"key":"a","value":"MQ=="}`)
+	sum := sha256.Sum256(op)
+	hdr := BlockHeader{Height: 2, PrevHash: hashHeader(GenesisBlock().Header), ContentHash: sum[:], DataHash: root}
+
+	vals := ValidatorSet{}
+	for i := 1; i <= 4; i++ {
+		id := fmt.Sprintf("validator%d", i)
+		pk, sk, _ := ed25519.GenerateKey(nil)
+		vals[id] = pk
+		if i <= 3 {
+			hdr.Validators = append(hdr.Validators, id)
+			hdr.Signatures = append(hdr.Signatures, SignCommit(hdr, sk))
+		}
+	}
+	val, proof, err := ads.Qry("a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Receipt{Tx: TxID(op), Height: 2, Header: hdr, Operation: op, Key: "a", Value: val, Proof: proof}
+	if err := VerifyReceipt(r, vals, Quorum); err != nil {
+		t.Fatalf("honest receipt: %v", err)
+	}
+	return r, vals
+}
+
+// A receipt fails to verify once any part of it is tampered with.
+func TestTamperedReceipt(t *testing.T) {
+	for name, tamper := range map[string]func(r *Receipt){
+		"value": func(r *Receipt) { r.Value = []byte("2") },
+		"key":   func(r *Receipt) { r.Key = "b" },
+		"proof": func(r *Receipt) {
+			r.Proof = append([]storage.ProofNode(nil), r.Proof...)
+			r.Proof[0].Hash = make([]byte, len(r.Proof[0].Hash))
+		},
+		"root":      func(r *Receipt) { r.Header.DataHash = make([]byte, len(r.Header.DataHash)) },
+		"operation": func(r *Receipt) { r.Operation = []byte(`{"key":"a","value":"Mg=="}`) },
+		"tx":        func(r *Receipt) { r.Tx = TxID([]byte("other")) },
+		"rejected":  func(r *Receipt) { r.Rejected = true },
+		"height":    func(r *Receipt) { r.Height = 3 },
+		"certificate": func(r *Receipt) {
+			r.Header.Validators, r.Header.Signatures = r.Header.Validators[:2], r.Header.Signatures[:2]
+		},
+	} {
+		r, vals := testReceipt(t)
+		tamper(&r)
+		if err := VerifyReceipt(r, vals, Quorum); err == nil {
+			t.Errorf("receipt with tampered %s verifies", name)
+		}
+	}
+}
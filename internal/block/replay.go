@@ -0,0 +1,92 @@
+package block
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// ReplayWindow is how many blocks back execute looks for a request id
+// applied before. It outlasts by far the time a write waits in a mempool
+// and may be forwarded again, the only way one id reaches two blocks.
+const ReplayWindow = 4096
+
+// ReplayIndex holds the request ids of the operations applied by the last
+// ReplayWindow blocks, committed or in flight, for execute to refuse a
+// replay by. It lives outside the ADS and is rebuilt from the blocks, so
+// every node that holds the chain, state-synced ones too, decides alike.
+type ReplayIndex struct {
+	mu sync.Mutex
+	at map[string]int64 // request id -> height it was applied at
+}
+
+func NewReplayIndex() *ReplayIndex {
+	return &ReplayIndex{at: map[string]int64{}}
+}
+
+// Applied reports whether id was applied in one of the ReplayWindow blocks
+// below height.
+func (ri *ReplayIndex) Applied(id string, height int64) bool {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	h, ok := ri.at[id]
+	return ok && h < height && h >= height-ReplayWindow
+}
+
+func (ri *ReplayIndex) add(id string, height int64) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.at[id] = height
+}
+
+// Track records the request id b applied, if any.
+func (ri *ReplayIndex) Track(b Block) {
+	var op Operation
+	if b.Header.Rejected || json.Unmarshal(b.Content, &op) != nil {
+		return
+	}
+	if op.Nonce != "" && op.kind() != OpNoop {
+		ri.add(op.Nonce, b.Header.Height)
+	}
+}
+
+// Rollback forgets the ids applied at or above height.
+func (ri *ReplayIndex) Rollback(height int64) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	for id, h := range ri.at {
+		if h >= height {
+			delete(ri.at, id)
+		}
+	}
+}
+
+// Prune forgets the ids no block above the committed tip can replay.
+func (ri *ReplayIndex) Prune(tip int64) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	for id, h := range ri.at {
+		if h <= tip-ReplayWindow {
+			delete(ri.at, id)
+		}
+	}
+}
+
+var replays = NewReplayIndex()
+
+// rebuildReplays indexes the request ids of the last ReplayWindow stored
+// blocks.
+func rebuildReplays() error {
+	ri := NewReplayIndex()
+	tip := Tip().Header.Height
+	for h := max(2, tip-ReplayWindow+1); h <= tip; h++ {
+		b, err := GetBlock(h)
+		if err != nil {
+			return err
+		}
+		ri.Track(b)
+	}
+	replays.mu.Lock()
+	replays.at = ri.at
+	replays.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,32 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// A request id applied once is refused again within the replay window,
+// applies again once the block that applied it is rolled back, and leaves
+// nothing in the ADS.
+func TestReplayRefused(t *testing.T) {
+	m := Machine{storage.NewMemADS(), NewValidatorHistory(nil), NewReplayIndex()}
+	op := Operation{Key: "a", Value: []byte("1"), Nonce: "n1"}
+	if _, rejected, _, err := m.Execute(op, 2); err != nil || rejected {
+		t.Fatalf("first copy: rejected=%v err=%v", rejected, err)
+	}
+	if _, rejected, _, err := m.Execute(op, 3); err != nil || !rejected {
+		t.Fatalf("replay: rejected=%v err=%v", rejected, err)
+	}
+	if !m.Replays.Applied("n1", 2+ReplayWindow) || m.Replays.Applied("n1", 3+ReplayWindow) {
+		t.Fatal("replay window is not ReplayWindow blocks")
+	}
+	if _, ok := m.ADS.Data["a"]; !ok || len(m.ADS.Data) != 1 {
+		t.Fatalf("ADS holds %v, want only a", m.ADS.Data)
+	}
+
+	m.Rollback(2)
+	if _, rejected, _, err := m.Execute(op, 2); err != nil || rejected {
+		t.Fatalf("after rollback: rejected=%v err=%v", rejected, err)
+	}
+}
@@ -0,0 +1,49 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// ReadEntry is a key read while executing a block, with the version (VF)
+// seen; 0 means the key had no active version.
+type ReadEntry struct {
+	Key     string `json:"key"`
+	Version int64  `json:"version"`
+}
+
+// WriteEntry is a key written by a block with its value before and after.
+type WriteEntry struct {
+	Key string `json:"key"`
+	Old []byte `json:"old"`
+	New []byte `json:"new"`
+}
+
+// RWLog is the read/write set of one block; the header's RWHash commits to it.
+type RWLog struct {
+	Height int64        `json:"height"`
+	Reads  []ReadEntry  `json:"reads"`
+	Writes []WriteEntry `json:"writes"`
+}
+
+func (l RWLog) bytes() []byte {
+	b, _ := json.Marshal(l)
+	return b
+}
+
+// Hash is sha256 over the JSON encoding served at /block/{h}/rwset.
+func (l RWLog) Hash() []byte {
+	sum := sha256.Sum256(l.bytes())
+	return sum[:]
+}
+
+func (l *RWLog) read(ads *storage.ADS, key string, height int64) {
+	l.Reads = append(l.Reads, ReadEntry{key, versionOf(ads, key, height)})
+}
+
+func (l *RWLog) write(ads *storage.ADS, key string, value []byte, height int64) {
+	old, _ := ads.Get(key, height-1)
+	l.Writes = append(l.Writes, WriteEntry{key, old.Value, value})
+}
@@ -0,0 +1,131 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/mauzec/falcondb/internal/storage"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// StateEntry is one key of the state at a height: the version of the key
+// active there, open-ended as a state-synced node restores it.
+type StateEntry struct {
+	Key     string          `json:"key"`
+	Version storage.Version `json:"version"`
+}
+
+// StateBase is the lowest height the ADS has the state of: 1, or the
+// height a state-synced node installed its state at.
+func StateBase() int64 {
+	raw, err := blkDB.Get([]byte("meta:state-base"), nil)
+	if err != nil {
+		return 1
+	}
+	h, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return 1
+	}
+	return h
+}
+
+// StateAt lists the state at committed height h in key order.
+func StateAt(h int64) ([]StateEntry, error) {
+	if base := StateBase(); h < base {
+		return nil, fmt.Errorf("no state below height %d", base)
+	}
+	if tip := Tip().Header.Height; h > tip {
+		return nil, fmt.Errorf("height %d is above the tip %d", h, tip)
+	}
+	var out []StateEntry
+	err := storage.EachVersion(func(key string, v storage.Version) error {
+		if v.VF <= h && h < v.VT {
+			v.VT = storage.InfVT
+			out = append(out, StateEntry{Key: key, Version: v})
+		}
+		return nil
+	})
+	// stored versions are ordered by "key:height", not by key
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, err
+}
+
+// InstallState makes blocks, from genesis up to some height H, the local
+// chain and state the ADS at H, without executing any block. The local
+// chain must be empty. Every block must link to its parent and carry a
+// commit certificate valid under rule, and state must hash to the DataHash
+// of H. Below H there are no read/write logs and no ADS history.
+func InstallState(blocks []Block, state []StateEntry, rule CommitRule) error {
+	blockchainMu.Lock()
+	defer blockchainMu.Unlock()
+	if tip := Tip().Header.Height; tip > 1 {
+		return fmt.Errorf("state sync target is not empty (height %d)", tip)
+	}
+	if store.Len() > 0 {
+		return errors.New("state sync target ADS is not empty")
+	}
+	if len(blocks) < 2 || !bytes.Equal(hashHeader(blocks[0].Header), hashHeader(GenesisBlock().Header)) {
+		return errors.New("state sync chain does not start at genesis")
+	}
+
+	vh := NewValidatorHistory(ValidatorsAt(1))
+	for i := 1; i < len(blocks); i++ {
+		b, prev := blocks[i], blocks[i-1]
+		if b.Header.Height != prev.Header.Height+1 || !bytes.Equal(b.Header.PrevHash, hashHeader(prev.Header)) {
+			return fmt.Errorf("block %d: broken header link", b.Header.Height)
+		}
+		if err := VerifyBlock(b, vh.At(b.Header.Height), rule); err != nil {
+			return fmt.Errorf("block %d: %w", b.Header.Height, err)
+		}
+		if err := vh.VerifyValSet(b.Header); err != nil {
+			return err
+		}
+		if err := vh.Track(b); err != nil {
+			return fmt.Errorf("block %d: %w", b.Header.Height, err)
+		}
+	}
+
+	top := blocks[len(blocks)-1].Header
+	recs := make([]storage.Record, len(state))
+	for i, e := range state {
+		if i > 0 && e.Key <= state[i-1].Key {
+			return fmt.Errorf("state key %q out of order", e.Key)
+		}
+		if e.Version.VF > top.Height || e.Version.VT != storage.InfVT {
+			return fmt.Errorf("state key %q is not active at height %d", e.Key, top.Height)
+		}
+		recs[i] = storage.Record{Key: e.Key, Value: e.Version.Value}
+	}
+	if root := storage.Root(recs); root != hex.EncodeToString(top.DataHash) {
+		return fmt.Errorf("state root mismatch at height %d: want %x, got %s", top.Height, top.DataHash, root)
+	}
+
+	// the ADS first: until the blocks are written a restart rolls it back
+	for _, e := range state {
+		store.Restore(e.Key, e.Version)
+	}
+	batch := new(leveldb.Batch)
+	// from the top, so that the tx index of a replayed operation ends up
+	// at the block that applied it
+	for i := len(blocks) - 1; i >= 1; i-- {
+		if err := putBlock(batch, blocks[i]); err != nil {
+			return err
+		}
+	}
+	batch.Put([]byte("meta:state-base"), []byte(strconv.FormatInt(top.Height, 10)))
+	if err := blkDB.Write(batch, nil); err != nil {
+		return err
+	}
+	validators.replace(vh)
+	if err := rebuildReplays(); err != nil {
+		return err
+	}
+	log.Printf("[block] installed state at height=%d keys=%d", top.Height, len(state))
+	notifyCommit()
+	return nil
+}
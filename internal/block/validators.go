@@ -0,0 +1,358 @@
+package block
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// ValidatorSet maps validator ids to their ed25519 public keys.
+type ValidatorSet map[string]ed25519.PublicKey
+
+const (
+	ValidatorAdd    = "add"
+	ValidatorRemove = "remove"
+	ValidatorRotate = "rotate"
+)
+
+// ValidatorUpdate is a special operation that adds, removes or re-keys a
+// validator. It takes effect at the first epoch boundary after the block
+// that carries it, and only with the approval of a quorum of the validators
+// active at that block. Nonce makes each approved update usable once.
+type ValidatorUpdate struct {
+	Action string            `json:"action"`
+	ID     string            `json:"id"`
+	PK     ed25519.PublicKey `json:"pk,omitempty"`
+	Nonce  string            `json:"nonce"`
+
+	Approvals map[string][]byte `json:"approvals,omitempty"` // validator id -> signature over SignedBytes
+}
+
+// SignedBytes is what a validator signs to approve u.
+func (u ValidatorUpdate) SignedBytes() []byte {
+	b, _ := json.Marshal(struct {
+		Action string `json:"action"`
+		ID     string `json:"id"`
+		PK     []byte `json:"pk,omitempty"`
+		Nonce  string `json:"nonce"`
+	}{u.Action, u.ID, u.PK, u.Nonce})
+	return append([]byte("falcondb/validator-update/"), b...)
+}
+
+// Approve adds the approval of validator id, whose key is sk.
+func (u *ValidatorUpdate) Approve(id string, sk ed25519.PrivateKey) {
+	if u.Approvals == nil {
+		u.Approvals = map[string][]byte{}
+	}
+	u.Approvals[id] = ed25519.Sign(sk, u.SignedBytes())
+}
+
+// CheckApprovals reports whether a quorum of vals approved u.
+func (u ValidatorUpdate) CheckApprovals(vals ValidatorSet) error {
+	if u.Nonce == "" {
+		return fmt.Errorf("validator update without nonce")
+	}
+	msg := u.SignedBytes()
+	valid := 0
+	for id, sig := range u.Approvals {
+		if pk, ok := vals[id]; ok && ed25519.Verify(pk, msg, sig) {
+			valid++
+		}
+	}
+	if q := Quorum(len(vals)); valid < q {
+		return fmt.Errorf("validator update approved by %d of %d validators", valid, q)
+	}
+	return nil
+}
+
+// EpochLength is the number of heights between validator set changes.
+var EpochLength int64 = 10
+
+// NextEpoch returns the first height of the epoch after the one containing h.
+func NextEpoch(h int64) int64 {
+	return (h/EpochLength + 1) * EpochLength
+}
+
+// ValidatorKey is the reserved ADS key holding the public key of validator id.
+func ValidatorKey(id string) string {
+	return "__validator__/" + id
+}
+
+// reconfigKey is the reserved ADS key marking the nonce of an applied
+// validator update as used.
+func reconfigKey(nonce string) string {
+	return "__reconfig__/" + nonce
+}
+
+func (vs ValidatorSet) Has(id string) bool {
+	_, ok := vs[id]
+	return ok
+}
+
+// IDs returns validator ids in sorted order, the order used for primaries.
+func (vs ValidatorSet) IDs() []string {
+	ids := make([]string, 0, len(vs))
+	for id := range vs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Hash commits to the set: sha256 over the sorted (id, pk) list.
+func (vs ValidatorSet) Hash() []byte {
+	type entry struct {
+		ID string `json:"id"`
+		PK []byte `json:"pk"`
+	}
+	list := make([]entry, 0, len(vs))
+	for _, id := range vs.IDs() {
+		list = append(list, entry{id, vs[id]})
+	}
+	b, _ := json.Marshal(list)
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func (vs ValidatorSet) clone() ValidatorSet {
+	out := make(ValidatorSet, len(vs))
+	for id, pk := range vs {
+		out[id] = pk
+	}
+	return out
+}
+
+func (vs ValidatorSet) apply(u ValidatorUpdate) (ValidatorSet, error) {
+	if u.ID == "" {
+		return nil, fmt.Errorf("validator update: empty id")
+	}
+	out := vs.clone()
+	switch u.Action {
+	case ValidatorAdd:
+		if vs.Has(u.ID) {
+			return nil, fmt.Errorf("validator %s already in set", u.ID)
+		}
+		if len(u.PK) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("validator %s: bad public key", u.ID)
+		}
+		out[u.ID] = u.PK
+	case ValidatorRotate:
+		if !vs.Has(u.ID) {
+			return nil, fmt.Errorf("validator %s not in set", u.ID)
+		}
+		if len(u.PK) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("validator %s: bad public key", u.ID)
+		}
+		out[u.ID] = u.PK
+	case ValidatorRemove:
+		if !vs.Has(u.ID) {
+			return nil, fmt.Errorf("validator %s not in set", u.ID)
+		}
+		if len(vs) == 1 {
+			return nil, fmt.Errorf("cannot remove last validator %s", u.ID)
+		}
+		delete(out, u.ID)
+	default:
+		return nil, fmt.Errorf("unknown validator action %q", u.Action)
+	}
+	return out, nil
+}
+
+type heightUpdate struct {
+	height int64
+	upd    ValidatorUpdate
+}
+
+// ValidatorHistory derives the active validator set at any height from the
+// genesis set and the validator updates seen in blocks.
+type ValidatorHistory struct {
+	mu      sync.RWMutex
+	genesis ValidatorSet
+	updates []heightUpdate // ordered by height
+}
+
+func NewValidatorHistory(genesis ValidatorSet) *ValidatorHistory {
+	return &ValidatorHistory{genesis: genesis.clone()}
+}
+
+// At returns the validator set that must sign the block at height h.
+func (vh *ValidatorHistory) At(h int64) ValidatorSet {
+	vh.mu.RLock()
+	defer vh.mu.RUnlock()
+	return vh.at(h, h)
+}
+
+// at applies updates recorded below `below` whose epoch starts at or before h.
+func (vh *ValidatorHistory) at(h, below int64) ValidatorSet {
+	set := vh.genesis.clone()
+	for _, hu := range vh.updates {
+		if hu.height >= below || NextEpoch(hu.height) > h {
+			continue
+		}
+		if next, err := set.apply(hu.upd); err == nil {
+			set = next
+		}
+	}
+	return set
+}
+
+// Check reports whether u is valid when carried by the block at height h:
+// approved by the validators active at h and applicable to the set it
+// changes.
+func (vh *ValidatorHistory) Check(h int64, u ValidatorUpdate) error {
+	vh.mu.RLock()
+	defer vh.mu.RUnlock()
+	if err := u.CheckApprovals(vh.at(h, h)); err != nil {
+		return err
+	}
+	_, err := vh.at(NextEpoch(h), h).apply(u)
+	return err
+}
+
+// Track records the validator update carried by b, if any.
+func (vh *ValidatorHistory) Track(b Block) error {
+	var op Operation
+	if err := json.Unmarshal(b.Content, &op); err != nil || op.Validator == nil || b.Header.Rejected {
+		return nil
+	}
+	if err := vh.Check(b.Header.Height, *op.Validator); err != nil {
+		return err
+	}
+
+	vh.mu.Lock()
+	defer vh.mu.Unlock()
+	hu := heightUpdate{b.Header.Height, *op.Validator}
+	i := sort.Search(len(vh.updates), func(i int) bool { return vh.updates[i].height >= hu.height })
+	if i < len(vh.updates) && vh.updates[i].height == hu.height {
+		vh.updates[i] = hu
+		return nil
+	}
+	vh.updates = append(vh.updates, heightUpdate{})
+	copy(vh.updates[i+1:], vh.updates[i:])
+	vh.updates[i] = hu
+	log.Printf("[block] validator %s %s at height=%d, active from %d",
+		hu.upd.Action, hu.upd.ID, hu.height, NextEpoch(hu.height))
+	return nil
+}
+
+// VerifyValSet checks that h commits to the set active at its height.
+func (vh *ValidatorHistory) VerifyValSet(h BlockHeader) error {
+	if h.Height <= 1 {
+		return nil
+	}
+	if want := vh.At(h.Height).Hash(); !bytes.Equal(h.ValSetHash, want) {
+		return fmt.Errorf("validator set hash mismatch at height %d", h.Height)
+	}
+	return nil
+}
+
+// validators is the validator history of this node's chain. The variable
+// is never assigned again: a new history replaces its content, under its
+// own lock, so that it is safe to read at any time.
+var validators = NewValidatorHistory(nil)
+
+// replace makes vh a copy of other.
+func (vh *ValidatorHistory) replace(other *ValidatorHistory) {
+	other.mu.RLock()
+	genesis, updates := other.genesis, append([]heightUpdate(nil), other.updates...)
+	other.mu.RUnlock()
+	vh.mu.Lock()
+	defer vh.mu.Unlock()
+	vh.genesis, vh.updates = genesis, updates
+}
+
+// SetGenesisValidators installs the genesis validator set and replays the
+// validator updates of the persisted chain on top of it.
+func SetGenesisValidators(vs ValidatorSet) {
+	vh := NewValidatorHistory(vs)
+	if blkDB != nil {
+		raw, _ := json.Marshal(vs)
+		if err := blkDB.Put([]byte("meta:genesis-validators"), raw, nil); err != nil {
+			log.Printf("[block] cannot store genesis validators: %v", err)
+		}
+		for _, b := range GetBlockchain() {
+			if err := vh.Track(b); err != nil {
+				log.Printf("[block] skip validator update at height=%d: %v", b.Header.Height, err)
+			}
+		}
+	}
+	validators.replace(vh)
+}
+
+// GenesisValidators returns the genesis set stored by SetGenesisValidators.
+func GenesisValidators() (ValidatorSet, error) {
+	raw, err := blkDB.Get([]byte("meta:genesis-validators"), nil)
+	if err != nil {
+		return nil, err
+	}
+	var vs ValidatorSet
+	err = json.Unmarshal(raw, &vs)
+	return vs, err
+}
+
+// ValidatorsAt returns the validator set active at height h.
+func ValidatorsAt(h int64) ValidatorSet {
+	return validators.At(h)
+}
+
+// Quorum is the number of votes needed out of n validators: ⌈(n+f+1)/2⌉
+// with f = (n-1)/3, so that any two quorums share f+1 validators (e.g.
+// both of two). That is 2f+1 when n is 3f+1.
+func Quorum(n int) int {
+	f := (n - 1) / 3
+	return (n + f + 2) / 2
+}
+
+// Majority is the number of votes a crash-fault engine needs out of n
+// validators: more than half, so that any two majorities share one.
+func Majority(n int) int {
+	return n/2 + 1
+}
+
+// CommitRule is the number of commit signatures a certificate needs out of
+// n validators. It is a property of the chain: Quorum for the Byzantine
+// fault tolerant engines, Majority for a crash-fault one, whose validators
+// are trusted not to sign two blocks at one height. The nodes and the
+// clients verifying their blocks must use the same rule.
+type CommitRule func(n int) int
+
+// VerifyCommit checks the commit certificate of h: distinct validators of
+// vals with valid commit votes for the header, as many as rule asks. The
+// genesis block has no certificate and must be GenesisBlock itself.
+func VerifyCommit(h BlockHeader, vals ValidatorSet, rule CommitRule) error {
+	switch {
+	case h.Height < 1:
+		return fmt.Errorf("bad block height %d", h.Height)
+	case h.Height == 1:
+		if !bytes.Equal(hashHeader(h), hashHeader(GenesisBlock().Header)) {
+			return fmt.Errorf("block 1 is not the genesis block")
+		}
+		return nil
+	}
+	if len(h.Validators) != len(h.Signatures) {
+		return fmt.Errorf("validator/signature count mismatch")
+	}
+	seen := make(map[string]bool, len(h.Validators))
+	for i, id := range h.Validators {
+		pk, ok := vals[id]
+		if !ok {
+			return fmt.Errorf("unknown validator %s", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("duplicate signature from %s", id)
+		}
+		seen[id] = true
+		if !VerifyCommitSig(pk, h, h.Signatures[i]) {
+			return fmt.Errorf("invalid signature from %s", id)
+		}
+	}
+	if q := rule(len(vals)); len(seen) < q {
+		return fmt.Errorf("commit certificate at height %d has %d of %d signatures", h.Height, len(seen), q)
+	}
+	return nil
+}
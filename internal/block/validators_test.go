@@ -0,0 +1,27 @@
+package block
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+// The validators of the chain may be read while a new genesis set or a
+// state sync installs them; run with -race.
+func TestValidatorsReadWhileInstalled(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(nil)
+	defer SetGenesisValidators(nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ValidatorsAt(int64(i))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		SetGenesisValidators(ValidatorSet{"validator1": pk})
+	}
+	<-done
+	if !ValidatorsAt(2).Has("validator1") {
+		t.Fatal("genesis set not installed")
+	}
+}
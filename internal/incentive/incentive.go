@@ -16,6 +16,7 @@ type Contract struct {
 	deposit map[string]int
 	balance map[string]int
 	frozen  map[string]bool
+	slashed map[string]bool // frozen for good
 }
 
 func NewContract(svcFee, authFee int) *Contract {
@@ -25,6 +26,7 @@ func NewContract(svcFee, authFee int) *Contract {
 		deposit: make(map[string]int),
 		balance: make(map[string]int),
 		frozen:  make(map[string]bool),
+		slashed: make(map[string]bool),
 	}
 }
 
@@ -76,7 +78,7 @@ func (c *Contract) MountHTTP(mux *http.ServeMux) {
 			c.deposit[req.Server] = 0
 			c.balance[req.Server] = 0
 		}
-		c.frozen[req.Server] = false
+		c.frozen[req.Server] = c.slashed[req.Server]
 
 		w.WriteHeader(200)
 	})
@@ -97,6 +99,23 @@ func (c *Contract) MountHTTP(mux *http.ServeMux) {
 	})
 }
 
+// Slash forfeits the deposit and balance of a validator proven to have
+// equivocated and freezes its account for good. It returns the amount
+// forfeited, 0 when the validator was slashed before.
+func (c *Contract) Slash(nodeID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.slashed[nodeID] {
+		return 0
+	}
+	amt := c.deposit[nodeID] + c.balance[nodeID]
+	c.deposit[nodeID], c.balance[nodeID] = 0, 0
+	c.frozen[nodeID] = true
+	c.slashed[nodeID] = true
+	log.Printf("[incentive] Slash node=%s forfeit=%d", nodeID, amt)
+	return amt
+}
+
 func (c *Contract) PayService(nodeID string) error {
 	log.Printf("[incentive] PayService node=%s", nodeID)
 
@@ -1,15 +1,22 @@
 package light
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/mauzec/falcondb/internal/block"
+	"github.com/mauzec/falcondb/internal/storage"
 )
 
 type LightClient struct {
@@ -18,13 +25,19 @@ type LightClient struct {
 	ADSRoot string
 	Server  string
 
-	PeerPK map[string]ed25519.PublicKey
+	// Validators tracks the validator set by height, starting from the
+	// genesis set reported by the server.
+	Validators *block.ValidatorHistory
+
+	// Commits is what a commit certificate of the chain needs. The client
+	// decides it, not the server: a lying server would lower the bar.
+	Commits block.CommitRule
 }
 
-func NewLightClient(serverURL string) (*LightClient, error) {
-	lc := &LightClient{Server: serverURL}
+func NewLightClient(serverURL string, commits block.CommitRule) (*LightClient, error) {
+	lc := &LightClient{Server: serverURL, Commits: commits}
 
-	resp, err := http.Get(serverURL + "/validators")
+	resp, err := http.Get(serverURL + "/validators?height=1")
 	if err != nil {
 		return nil, fmt.Errorf("fetch validators: %w", err)
 	}
@@ -33,14 +46,15 @@ func NewLightClient(serverURL string) (*LightClient, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&pkHex); err != nil {
 		return nil, fmt.Errorf("decode validators: %w", err)
 	}
-	lc.PeerPK = make(map[string]ed25519.PublicKey, len(pkHex))
+	genesis := make(block.ValidatorSet, len(pkHex))
 	for id, h := range pkHex {
 		b, err := hex.DecodeString(h)
 		if err != nil {
 			return nil, fmt.Errorf("bad pubkey hex for %s: %w", id, err)
 		}
-		lc.PeerPK[id] = ed25519.PublicKey(b)
+		genesis[id] = ed25519.PublicKey(b)
 	}
+	lc.Validators = block.NewValidatorHistory(genesis)
 
 	resp, err = http.Get(serverURL + "/chain")
 	if err != nil {
@@ -53,7 +67,7 @@ func NewLightClient(serverURL string) (*LightClient, error) {
 		return nil, err
 	}
 	for _, blk := range chain {
-		if err := lc.processHeader(blk.Header); err != nil {
+		if err := lc.processBlock(blk); err != nil {
 			return nil, fmt.Errorf("invalid chain: %w", err)
 		}
 	}
@@ -74,24 +88,29 @@ func (lc *LightClient) processHeader(h block.BlockHeader) error {
 		}
 	}
 
-	if len(h.Validators) != len(h.Signatures) {
-		return fmt.Errorf("validator/signature count mismatch")
+	if err := lc.Validators.VerifyValSet(h); err != nil {
+		return err
 	}
-	for i, sig := range h.Signatures {
-		vid := h.Validators[i]
-		pk, ok := lc.PeerPK[vid]
-		if !ok {
-			return fmt.Errorf("unknown validator %s", vid)
-		}
-		if !block.VerifySig(pk, h, sig) {
-			return fmt.Errorf("invalid signature from %s", vid)
-		}
+	if err := block.VerifyCommit(h, lc.Validators.At(h.Height), lc.Commits); err != nil {
+		return fmt.Errorf("height %d not final: %w", h.Height, err)
 	}
 
 	lc.Headers = append(lc.Headers, h)
 	return nil
 }
 
+// processBlock verifies the header and follows validator set changes
+// carried in the block content.
+func (lc *LightClient) processBlock(blk block.Block) error {
+	if sum := sha256.Sum256(blk.Content); !bytes.Equal(sum[:], blk.Header.ContentHash) {
+		return fmt.Errorf("content hash mismatch at height %d", blk.Header.Height)
+	}
+	if err := lc.processHeader(blk.Header); err != nil {
+		return err
+	}
+	return lc.Validators.Track(blk)
+}
+
 func (lc *LightClient) SyncOne() error {
 	nextH := lc.Headers[len(lc.Headers)-1].Height + 1
 	resp, err := http.Get(fmt.Sprintf("%s/chain", lc.Server))
@@ -106,7 +125,7 @@ func (lc *LightClient) SyncOne() error {
 	if len(chain) < int(nextH) {
 		return nil
 	}
-	return lc.processHeader(chain[nextH-1].Header)
+	return lc.processBlock(chain[nextH-1])
 }
 
 func (lc *LightClient) Query(key string) ([]byte, error) {
@@ -122,9 +141,9 @@ func (lc *LightClient) Query(key string) ([]byte, error) {
 		return nil, fmt.Errorf("server error: %s", string(body))
 	}
 	var out struct {
-		Value []byte   `json:"value"`
-		Proof [][]byte `json:"proof"`
-		Root  string   `json:"root"`
+		Value []byte              `json:"value"`
+		Proof []storage.ProofNode `json:"proof"`
+		Root  string              `json:"root"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
 		return nil, err
@@ -132,8 +151,100 @@ func (lc *LightClient) Query(key string) ([]byte, error) {
 	if out.Root != lc.ADSRoot {
 		return nil, fmt.Errorf("root mismatch: local=%s got=%s", lc.ADSRoot, out.Root)
 	}
-	if !block.VerifyQry(out.Root, key, out.Value, out.Proof) {
+	if !storage.VerifyProof(out.Root, key, out.Value, out.Proof) {
 		return nil, fmt.Errorf("proof verification failed")
 	}
 	return out.Value, nil
 }
+
+// Subscription selects what Follow reports: every verified header, and
+// the changes of the given keys and of the keys under the given prefixes.
+type Subscription struct {
+	Keys     []string
+	Prefixes []string
+
+	OnHeader func(block.BlockHeader)
+	OnChange func(block.Change)
+}
+
+// Follow subscribes to the server's committed blocks from the one after
+// the last verified header, verifies each as it arrives and each change
+// against the header of its height, and reports them to sub. It returns
+// when ctx is done or the stream fails; calling it again resumes.
+func (lc *LightClient) Follow(ctx context.Context, sub Subscription) error {
+	q := url.Values{}
+	q.Set("from", strconv.FormatInt(lc.Headers[len(lc.Headers)-1].Height+1, 10))
+	for _, k := range sub.Keys {
+		q.Add("key", k)
+	}
+	for _, p := range sub.Prefixes {
+		q.Add("prefix", p)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lc.Server+"/subscribe?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server error: %s", string(body))
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 64<<20)
+	var event string
+	var data []byte
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if err := lc.onEvent(event, data, sub); err != nil {
+				return err
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(line[len("data:"):], " ")...)
+		}
+	}
+	if err := sc.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (lc *LightClient) onEvent(event string, data []byte, sub Subscription) error {
+	switch event {
+	case "block":
+		var blk block.Block
+		if err := json.Unmarshal(data, &blk); err != nil {
+			return err
+		}
+		if err := lc.processBlock(blk); err != nil {
+			return fmt.Errorf("invalid block: %w", err)
+		}
+		lc.ADSRoot = fmt.Sprintf("%x", blk.Header.DataHash)
+		if sub.OnHeader != nil {
+			sub.OnHeader(blk.Header)
+		}
+	case "change":
+		var c block.Change
+		if err := json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+		tip := lc.Headers[len(lc.Headers)-1]
+		if err := c.Verify(tip); err != nil {
+			return fmt.Errorf("change of %s at height %d: %w", c.Key, c.Height, err)
+		}
+		if sub.OnChange != nil {
+			sub.OnChange(c)
+		}
+	}
+	return nil
+}
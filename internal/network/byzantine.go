@@ -0,0 +1,261 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/mauzec/falcondb/internal/block"
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// Fault is a set of Byzantine behaviours a node shows on purpose, so that
+// the claims about what f faulty validators cannot break are tested
+// against validators that actually misbehave.
+type Fault uint
+
+const (
+	// FaultEquivocate proposes a second block at every height and sends
+	// it instead of the first to every other validator.
+	FaultEquivocate Fault = 1 << iota
+	// FaultForgeVotes sends, along with each vote, copies claiming to come
+	// from the other validators, signed with this node's key.
+	FaultForgeVotes
+	// FaultDuplicateVotes sends every vote twice.
+	FaultDuplicateVotes
+	// FaultWithholdCommits never sends a commit vote: PBFT commits and
+	// HotStuff votes are dropped.
+	FaultWithholdCommits
+	// FaultLieQuery answers /query with a wrong value and a bad proof.
+	FaultLieQuery
+	// FaultForkChain serves a forged fork of the chain to syncing peers,
+	// one block longer than the real one.
+	FaultForkChain
+)
+
+var faultNames = []struct {
+	name string
+	f    Fault
+}{
+	{"equivocate", FaultEquivocate},
+	{"forge-votes", FaultForgeVotes},
+	{"duplicate-votes", FaultDuplicateVotes},
+	{"withhold-commits", FaultWithholdCommits},
+	{"lie-query", FaultLieQuery},
+	{"fork-chain", FaultForkChain},
+}
+
+// FaultAll is every behaviour at once.
+const FaultAll = FaultEquivocate | FaultForgeVotes | FaultDuplicateVotes |
+	FaultWithholdCommits | FaultLieQuery | FaultForkChain
+
+// ParseFaults reads a comma-separated list of fault names, or "all".
+func ParseFaults(s string) (Fault, error) {
+	var fs Fault
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			fs |= FaultAll
+			continue
+		}
+		found := false
+		for _, fn := range faultNames {
+			if fn.name == name {
+				fs |= fn.f
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown fault %q", name)
+		}
+	}
+	return fs, nil
+}
+
+func (fs Fault) String() string {
+	var names []string
+	for _, fn := range faultNames {
+		if fs&fn.f != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// twinOf builds the block a node with FaultEquivocate sends instead of the
+// one for op: the same operation with another nonce on top of prev. It
+// is dropped from the ledger again so that the honest proposal is the one
+// this node executes.
+func (n *Node) twinOf(prev block.Block, op block.Operation) (block.Block, bool) {
+	if n.Faults&FaultEquivocate == 0 {
+		return block.Block{}, false
+	}
+	op.Nonce = "" // a fresh one, or the twin would be the same block
+	twin, err := n.signedBlock(prev, op)
+	n.Ledger.DropProposal(prev.Header.Height + 1)
+	if err != nil {
+		return block.Block{}, false
+	}
+	return twin, true
+}
+
+// keepTwin remembers the twin of blk until its proposal goes out.
+func (n *Node) keepTwin(blk, twin block.Block) {
+	tip := n.Ledger.Tip().Header.Height
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.twins == nil {
+		n.twins = map[string]block.Block{}
+	}
+	for k, b := range n.twins {
+		if b.Header.Height <= tip {
+			delete(n.twins, k)
+		}
+	}
+	n.twins[hex.EncodeToString(block.HashHeader(blk.Header))] = twin
+}
+
+// misbehave turns one outgoing consensus message into what a node with
+// n.Faults sends instead: nothing, the message, or several messages.
+func (n *Node) misbehave(to, kind string, body []byte) [][]byte {
+	fs := n.Faults
+	switch {
+	case fs == 0:
+		return [][]byte{body}
+	case kind == kindPrePrepare || kind == kindHSProposal:
+		if fs&FaultEquivocate != 0 {
+			body = n.equivocate(to, kind, body)
+		}
+		return [][]byte{body}
+	case kind == kindPrepare || kind == kindCommit || kind == kindHSVote:
+		if fs&FaultWithholdCommits != 0 && kind != kindPrepare {
+			return nil
+		}
+		out := [][]byte{body}
+		if fs&FaultDuplicateVotes != 0 {
+			out = append(out, body)
+		}
+		if fs&FaultForgeVotes != 0 {
+			out = append(out, n.forgeVotes(to, kind, body)...)
+		}
+		return out
+	}
+	return [][]byte{body}
+}
+
+// equivocate swaps the proposed block of a proposal for its twin, re-signed,
+// when `to` sits at an odd position of the validator set, so the
+// validators split between the two blocks.
+func (n *Node) equivocate(to, kind string, body []byte) []byte {
+	var msg struct {
+		msgAuth
+		Block block.Block `json:"block"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return body
+	}
+	n.mu.Lock()
+	twin, ok := n.twins[hex.EncodeToString(block.HashHeader(msg.Block.Header))]
+	n.mu.Unlock()
+	if !ok {
+		return body
+	}
+	odd := false
+	for i, id := range n.Ledger.ValidatorsAt(msg.Height).IDs() {
+		if id == to {
+			odd = i%2 == 1
+		}
+	}
+	if !odd {
+		return body
+	}
+
+	var fields map[string]json.RawMessage
+	json.Unmarshal(body, &fields)
+	a, _ := json.Marshal(n.auth(kind, msg.Height, msg.View, block.HashHeader(twin.Header)))
+	json.Unmarshal(a, &fields)
+	fields["block"], _ = json.Marshal(twin)
+	out, _ := json.Marshal(fields)
+	log.Printf("[node %s] byzantine: equivocating %s height=%d view=%d to %s", n.ID, kind, msg.Height, msg.View, to)
+	return out
+}
+
+// forgeVotes copies a vote once for every other validator, claiming it
+// as the sender. Neither the message nor the vote signature verifies
+// under the claimed sender's key.
+func (n *Node) forgeVotes(to, kind string, body []byte) [][]byte {
+	var vote struct {
+		msgAuth
+		Sig []byte `json:"sig"`
+	}
+	if err := json.Unmarshal(body, &vote); err != nil {
+		return nil
+	}
+	var out [][]byte
+	for _, id := range n.Ledger.ValidatorsAt(vote.Height).IDs() {
+		if id == n.ID || id == to {
+			continue
+		}
+		vote.From = id
+		vote.MsgSig = ed25519.Sign(n.SK, authBytes(kind, vote.msgAuth))
+		b, _ := json.Marshal(vote)
+		out = append(out, b)
+	}
+	return out
+}
+
+// lie corrupts a /query answer: the value gains a byte and the first
+// proof node a flipped bit, while the root stays the real one.
+func lie(val []byte, proof []storage.ProofNode) ([]byte, []storage.ProofNode) {
+	val = append(append([]byte(nil), val...), '!')
+	proof = append([]storage.ProofNode(nil), proof...)
+	if len(proof) > 0 {
+		h := append([]byte(nil), proof[0].Hash...)
+		if len(h) > 0 {
+			h[0] ^= 1
+		}
+		proof[0].Hash = h
+	}
+	return val, proof
+}
+
+// ServedChain is the chain n hands to syncing peers: chain itself, or with
+// FaultForkChain a fork of it above genesis, re-signed by n and one block
+// longer, whose commit certificates no longer match the headers.
+func (n *Node) ServedChain(chain []block.Block) []block.Block {
+	if n.Faults&FaultForkChain == 0 || len(chain) == 0 {
+		return chain
+	}
+	fork := []block.Block{chain[0]}
+	for i := 1; i <= len(chain); i++ {
+		src := chain[len(chain)-1]
+		if i < len(chain) {
+			src = chain[i]
+		}
+		var op block.Operation
+		json.Unmarshal(src.Content, &op)
+		op.Value = []byte(fmt.Sprintf("forged by %s", n.ID))
+		content, _ := json.Marshal(op)
+		sum := sha256.Sum256(content)
+
+		b := src
+		b.Content = content
+		b.Header.Height = fork[i-1].Header.Height + 1
+		b.Header.PrevHash = block.HashHeader(fork[i-1].Header)
+		b.Header.ContentHash = sum[:]
+		b.Header.Initiator = n.PK
+		b.Header.Signature = block.SignMeta(b.Header, n.SK)
+		fork = append(fork, b)
+	}
+	return fork
+}
@@ -0,0 +1,77 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/block"
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// A /query answer FaultLieQuery corrupts fails verification against the
+// real root, as does its value or its proof alone.
+func TestLieQueryFailsProof(t *testing.T) {
+	ads := storage.NewMemADS()
+	for i, k := range []string{"a", "b", "foo", "z"} {
+		if _, err := ads.UpdS(k, []byte{byte('0' + i)}, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := ads.SumAt(1)
+	val, proof, err := ads.Qry("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !storage.VerifyProof(root, "foo", val, proof) {
+		t.Fatal("honest answer does not verify")
+	}
+	lv, lp := lie(val, proof)
+	for name, c := range map[string]struct {
+		val   []byte
+		proof []storage.ProofNode
+	}{
+		"lie":        {lv, lp},
+		"lied value": {lv, proof},
+		"lied proof": {val, lp},
+	} {
+		if storage.VerifyProof(root, "foo", c.val, c.proof) {
+			t.Errorf("%s verifies", name)
+		}
+	}
+	if string(val) != "2" {
+		t.Errorf("lie changed the honest answer to %q", val)
+	}
+}
+
+// A pre-prepare whose initiator is not an ed25519 key is refused, not a
+// panic that takes the node down.
+func TestPrePrepareShortInitiator(t *testing.T) {
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	vals := block.ValidatorSet{
+		"validator1": sk1.Public().(ed25519.PublicKey),
+		"validator2": sk2.Public().(ed25519.PublicKey),
+	}
+	n := NewNode("validator2", 0, map[string]string{}, nil)
+	n.SK, n.PK = sk2, vals["validator2"]
+	n.Ledger = staticLedger{vals: vals}
+
+	primary := &Node{ID: "validator1", SK: sk1}
+	content := []byte(`{"key":"a","value":"MQ=="}`)
+	sum := sha256.Sum256(content)
+	blk := block.Block{Content: content, Header: block.BlockHeader{
+		Height:      2,
+		PrevHash:    block.HashHeader(block.GenesisBlock().Header),
+		ContentHash: sum[:],
+		Initiator:   []byte{1},
+	}}
+	blk.Header.Signature = block.SignMeta(blk.Header, sk1)
+	digest := block.HashHeader(blk.Header)
+	body, _ := json.Marshal(prePrepareMsg{primary.auth(kindPrePrepare, 2, 0, digest), blk})
+
+	if err := n.Engine().OnMessage(kindPrePrepare, body); err == nil {
+		t.Fatal("pre-prepare with a 1-byte initiator accepted")
+	}
+}
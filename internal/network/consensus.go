@@ -0,0 +1,244 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// Consensus is a consensus engine. The node hands it client operations
+// and peer messages; the engine reports every block it decides, with its
+// commit certificate attached, through Node.deliver, which commits final
+// blocks in height order.
+type Consensus interface {
+	// Leader is the validator that proposes the next block. When that is
+	// another node the engine starts watching it, so that a leader which
+	// ignores a client write is replaced.
+	Leader() string
+	// Propose builds a block for op and starts consensus on it. It fails
+	// with a statusError when this node cannot propose right now.
+	Propose(op block.Operation) (block.Block, error)
+	// OnMessage handles a message of kind received from a peer.
+	OnMessage(kind string, body []byte) error
+	// OnTimeout is called when the round timer of height and view fires.
+	OnTimeout(height, view int64)
+}
+
+// EngineFactory builds a consensus engine for n.
+type EngineFactory func(n *Node) Consensus
+
+var (
+	engines   = map[string]EngineFactory{}
+	enginesMu sync.Mutex
+)
+
+func init() {
+	RegisterEngine("pbft", newPBFT)
+	RegisterEngine("hotstuff", newHotStuff)
+	RegisterEngine("raft", newRaft)
+}
+
+// RegisterEngine makes a consensus engine selectable by name.
+func RegisterEngine(name string, f EngineFactory) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	if _, dup := engines[name]; dup {
+		panic("network: engine " + name + " registered twice")
+	}
+	engines[name] = f
+}
+
+// UseConsensus selects the engine of this node. Every validator of a
+// cluster must run the same one. With raft, commit certificates need only
+// a majority of the validators, see CommitRule.
+func (n *Node) UseConsensus(name string) error {
+	enginesMu.Lock()
+	f, ok := engines[name]
+	enginesMu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown consensus engine %q", name)
+	}
+	n.engine = f(n)
+	n.engineName = name
+	n.commits = block.Quorum
+	if name == "raft" {
+		n.commits = block.Majority
+	}
+	log.Printf("[node %s] consensus engine %s", n.ID, name)
+	return nil
+}
+
+// CommitRule is what the commit certificates of this node's chain need,
+// as its engine decides.
+func (n *Node) CommitRule() block.CommitRule {
+	return n.commits
+}
+
+// Recover restores the engine state persisted at path, for engines that
+// keep a write-ahead log.
+func (n *Node) Recover(path string) error {
+	if r, ok := n.engine.(interface{ recoverWAL(string) error }); ok {
+		return r.recoverWAL(path)
+	}
+	return nil
+}
+
+// statusError carries the HTTP status a refused request is answered with.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+func reject(code int, format string, args ...interface{}) error {
+	return &statusError{code, fmt.Sprintf(format, args...)}
+}
+
+func errorStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	return http.StatusBadRequest
+}
+
+// msgStats counts consensus messages by kind, to compare engines.
+type msgStats struct {
+	mu   sync.Mutex
+	sent map[string]int64
+	recv map[string]int64
+}
+
+func (s *msgStats) add(m *map[string]int64, kind string, k int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if *m == nil {
+		*m = map[string]int64{}
+	}
+	(*m)[kind] += k
+}
+
+// handleConsensus routes POST /consensus/{kind} to the engine.
+func (n *Node) handleConsensus(w http.ResponseWriter, r *http.Request) {
+	kind := strings.TrimPrefix(r.URL.Path, "/consensus/")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := n.Receive(kind, body); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// handleStats serves GET /consensus/stats: the engine and the number of
+// consensus messages sent and received by kind.
+func (n *Node) handleStats(w http.ResponseWriter, r *http.Request) {
+	n.stats.mu.Lock()
+	defer n.stats.mu.Unlock()
+	var sent int64
+	kinds := make([]string, 0, len(n.stats.sent))
+	for k, c := range n.stats.sent {
+		sent += c
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"engine": n.engineName,
+		"height": n.nextHeight() - 1,
+		"sent":   n.stats.sent,
+		"recv":   n.stats.recv,
+		"total":  sent,
+		"kinds":  kinds,
+	})
+}
+
+// send sends v to the consensus endpoint of kind at peer id.
+func (n *Node) send(id, kind string, v interface{}) {
+	if _, ok := n.addrOf(id); !ok || id == n.ID {
+		return
+	}
+	buf, _ := json.Marshal(v)
+	for _, b := range n.misbehave(id, kind, buf) {
+		n.stats.add(&n.stats.sent, kind, 1)
+		n.Transport.Send(id, kind, b)
+	}
+}
+
+// multicast sends v to every validator of height but this node that is
+// in the peer table.
+func (n *Node) multicast(height int64, kind string, v interface{}) {
+	for _, id := range n.Ledger.ValidatorsAt(height).IDs() {
+		n.send(id, kind, v)
+	}
+}
+
+// parentHash returns the hash of the block at h-1 once it is final:
+// committed locally or decided and waiting for its turn to commit.
+func (n *Node) parentHash(h int64) ([]byte, bool) {
+	if h-1 < n.nextHeight() {
+		b, err := n.Ledger.GetBlock(h - 1)
+		if err != nil {
+			return nil, false
+		}
+		return block.HashHeader(b.Header), true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b, ok := n.final[h-1]
+	if !ok {
+		return nil, false
+	}
+	return block.HashHeader(b.Header), true
+}
+
+// deliver is the output of the engines: it records a decided block and
+// commits every final block that extends the local tip, in height order.
+func (n *Node) deliver(blk block.Block) {
+	n.mu.Lock()
+	n.final[blk.Header.Height] = blk
+	n.mu.Unlock()
+
+	n.commitMu.Lock()
+	defer n.commitMu.Unlock()
+	for {
+		h := n.nextHeight()
+		n.mu.Lock()
+		for fh := range n.final {
+			if fh < h {
+				delete(n.final, fh)
+			}
+		}
+		b, ok := n.final[h]
+		delete(n.final, h)
+		n.mu.Unlock()
+		if !ok {
+			n.settle()
+			return
+		}
+
+		if err := n.Ledger.CommitBlock(b, n.commits); err != nil {
+			log.Printf("[node %s] commit h=%d failed: %v", n.ID, h, err)
+			return
+		}
+
+		bts, _ := json.Marshal(b)
+		n.mu.Lock()
+		n.seen[block.BlockHash(b)] = true
+		n.mu.Unlock()
+		n.gossip(kindBlock, bts)
+		log.Printf("[node %s] gossip h=%d", n.ID, h)
+	}
+}
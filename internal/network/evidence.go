@@ -0,0 +1,211 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// kindEvidence gossips a block.Evidence through the peers.
+const kindEvidence = "evidence"
+
+// evidenceWindow is how many heights below the committed tip signed
+// messages are kept to be checked for equivocation.
+const evidenceWindow = 16
+
+// statement names what a validator may sign only once: one digest per
+// vote class, height and view.
+type statement struct {
+	class  string
+	from   string
+	height int64
+	view   int64
+}
+
+// evidencePool collects the signed messages of the other validators,
+// the equivocations found among them until a committed block slashes the
+// offender, and the validators slashed so far.
+type evidencePool struct {
+	mu       sync.Mutex
+	signed   map[statement]block.SignedMsg
+	pending  map[string]block.Evidence // by offender
+	slashed  map[string]bool
+	settled  int64      // last height whose evidence was applied
+	settleMu sync.Mutex // orders settle
+}
+
+// witness records a message whose signature checked. A second message of
+// the sender for the same statement with another digest is evidence.
+func (n *Node) witness(m block.SignedMsg) {
+	class, ok := block.VoteClass(m.Kind)
+	if !ok || m.From == n.ID {
+		return
+	}
+	st := statement{class, m.From, m.Height, m.View}
+	tip := n.nextHeight() - 1
+
+	ep := &n.evidence
+	ep.mu.Lock()
+	if ep.signed == nil {
+		ep.signed = map[statement]block.SignedMsg{}
+	}
+	for s := range ep.signed {
+		if s.height < tip-evidenceWindow {
+			delete(ep.signed, s)
+		}
+	}
+	prev, seen := ep.signed[st]
+	if !seen {
+		ep.signed[st] = m
+	}
+	ep.mu.Unlock()
+
+	if seen && !bytes.Equal(prev.Digest, m.Digest) {
+		n.addEvidence(block.Evidence{A: prev, B: m})
+	}
+}
+
+// addEvidence verifies ev and, when it is news, keeps it for the next
+// block this node proposes and gossips it on.
+func (n *Node) addEvidence(ev block.Evidence) error {
+	if err := ev.Verify(n.Ledger.ValidatorsAt(ev.A.Height)); err != nil {
+		return err
+	}
+	id := ev.Offender()
+	ep := &n.evidence
+	ep.mu.Lock()
+	if ep.pending == nil {
+		ep.pending = map[string]block.Evidence{}
+	}
+	_, known := ep.pending[id]
+	if known || ep.slashed[id] {
+		ep.mu.Unlock()
+		return nil
+	}
+	ep.pending[id] = ev
+	ep.mu.Unlock()
+
+	log.Printf("[node %s] equivocation by %s at height=%d view=%d: %s and %s",
+		n.ID, id, ev.A.Height, ev.A.View, ev.A.Kind, ev.B.Kind)
+	buf, _ := json.Marshal(ev)
+	n.gossip(kindEvidence, buf)
+	return nil
+}
+
+func (n *Node) onEvidence(body []byte) error {
+	var ev block.Evidence
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return fmt.Errorf("bad evidence: %w", err)
+	}
+	if err := n.addEvidence(ev); err != nil {
+		return reject(http.StatusBadRequest, "%v", err)
+	}
+	return nil
+}
+
+// pendingEvidence lists the evidence waiting for a block, by offender.
+func (n *Node) pendingEvidence() []block.Evidence {
+	ep := &n.evidence
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ids := make([]string, 0, len(ep.pending))
+	for id := range ep.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	evs := make([]block.Evidence, 0, len(ids))
+	for _, id := range ids {
+		evs = append(evs, ep.pending[id])
+	}
+	return evs
+}
+
+// withEvidence adds the pending evidence to the evidence an operation
+// brought along, keeping what verifies and one per offender.
+func (n *Node) withEvidence(evs []block.Evidence) []block.Evidence {
+	var out []block.Evidence
+	seen := map[string]bool{}
+	for _, list := range [][]block.Evidence{evs, n.pendingEvidence()} {
+		for _, ev := range list {
+			if seen[ev.Offender()] || ev.Verify(n.Ledger.ValidatorsAt(ev.A.Height)) != nil {
+				continue
+			}
+			seen[ev.Offender()] = true
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// settle slashes the offenders of the evidence in the blocks committed
+// since the last call: their deposit is forfeited to the contract and
+// their account frozen. The writes the blocks carry leave the mempool.
+func (n *Node) settle() {
+	ep := &n.evidence
+	ep.settleMu.Lock()
+	defer ep.settleMu.Unlock()
+	defer n.wakeMempool()
+	tip := n.nextHeight() - 1
+	for ; ep.settled < tip; ep.settled++ {
+		b, err := n.Ledger.GetBlock(ep.settled + 1)
+		if err != nil {
+			return
+		}
+		n.txCommitted(b)
+		for _, ev := range block.EvidenceOf(b) {
+			if ev.Verify(n.Ledger.ValidatorsAt(ev.A.Height)) != nil {
+				continue
+			}
+			n.slash(ev.Offender(), b.Header.Height)
+		}
+	}
+}
+
+func (n *Node) slash(id string, height int64) {
+	ep := &n.evidence
+	ep.mu.Lock()
+	if ep.slashed == nil {
+		ep.slashed = map[string]bool{}
+	}
+	done := ep.slashed[id]
+	ep.slashed[id] = true
+	delete(ep.pending, id)
+	ep.mu.Unlock()
+	if done {
+		return
+	}
+	forfeit := 0
+	if n.ctr != nil {
+		forfeit = n.ctr.Slash(id)
+	}
+	log.Printf("[node %s] slashed %s at height=%d, forfeit=%d", n.ID, id, height, forfeit)
+}
+
+// Slashed lists the validators slashed on the committed chain.
+func (n *Node) Slashed() []string {
+	ep := &n.evidence
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ids := make([]string, 0, len(ep.slashed))
+	for id := range ep.slashed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// handleEvidence serves GET /evidence: the equivocations waiting for a
+// block and the validators slashed so far.
+func (n *Node) handleEvidence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pending": n.pendingEvidence(),
+		"slashed": n.Slashed(),
+	})
+}
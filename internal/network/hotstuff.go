@@ -0,0 +1,774 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+const (
+	kindHSProposal = "hs-proposal"
+	kindHSVote     = "hs-vote"
+	kindHSNewView  = "hs-newview"
+)
+
+// qc is a quorum certificate on Header. Header carries the votes in the
+// commit certificate format, so the QC on a block is what it commits
+// with; ViewSigs are the voters' message signatures, which bind View.
+// The QC of view 0 is the committed tip a node starts from.
+type qc struct {
+	View     int64             `json:"view"`
+	Header   block.BlockHeader `json:"header"`
+	ViewSigs [][]byte          `json:"view_sigs,omitempty"`
+}
+
+func (q qc) hash() []byte { return block.HashHeader(q.Header) }
+
+func (q qc) verify(n *Node) error {
+	if err := block.VerifyCommit(q.Header, n.Ledger.ValidatorsAt(q.Header.Height), block.Quorum); err != nil {
+		return err
+	}
+	if q.View == 0 {
+		return nil
+	}
+	if len(q.ViewSigs) != len(q.Header.Validators) {
+		return fmt.Errorf("qc: %d view signatures for %d votes", len(q.ViewSigs), len(q.Header.Validators))
+	}
+	for i, id := range q.Header.Validators {
+		a := msgAuth{From: id, Height: q.Header.Height, View: q.View, Digest: q.hash(), MsgSig: q.ViewSigs[i]}
+		if err := n.verifyAuth(kindHSVote, a); err != nil {
+			return fmt.Errorf("qc: %v", err)
+		}
+	}
+	return nil
+}
+
+// hsProposal is the block of View, extending the block Justify certifies.
+type hsProposal struct {
+	msgAuth
+	Block   block.Block `json:"block"`
+	Justify qc          `json:"justify"`
+}
+
+// hsVote goes to the leader of the next view only; Sig is over the header.
+type hsVote struct {
+	msgAuth
+	Sig []byte `json:"sig"`
+}
+
+// hsNewView tells every validator that its sender gave up on the view
+// before View, with the highest QC the sender knows, the uncommitted chain up to
+// the block of that QC, for a leader that missed some of it, and its last
+// vote, which the QC of the view before may have been lost without. A
+// quorum of them for a view is its timeout certificate.
+type hsNewView struct {
+	msgAuth
+	HighQC qc        `json:"high_qc"`
+	Chain  []hsEntry `json:"chain,omitempty"`
+	Vote   *hsVote   `json:"vote,omitempty"`
+}
+
+// hsEntry is an uncommitted block as a new view carries it and the state
+// file keeps it: the view it was proposed in and the QC it extends.
+type hsEntry struct {
+	Block   block.Block `json:"block"`
+	View    int64       `json:"view"`
+	Justify qc          `json:"justify"`
+}
+
+// hsState is what a node persists before it votes or proposes: the safety
+// rules depend on lastVoted and locked, proposedIn keeps a leader to one
+// proposal per view, and highQC and the uncommitted blocks let it lead
+// again after a restart.
+type hsState struct {
+	View       int64     `json:"view"`
+	LastVoted  int64     `json:"last_voted"`
+	ProposedIn int64     `json:"proposed_in"`
+	Locked     qc        `json:"locked"`
+	HighQC     qc        `json:"high_qc"`
+	Blocks     []hsEntry `json:"blocks,omitempty"`
+}
+
+type hsBlock struct {
+	blk     block.Block
+	view    int64
+	justify qc
+}
+
+// hotstuff is the chained HotStuff engine: one leader per view, rotating
+// over the validators, proposes a block extending the highest QC; votes
+// and timeouts go to the next leader only, so a view costs O(n) messages.
+// A block commits once it heads a three-chain of consecutive views. When
+// no client operation arrives, leaders propose noop blocks until every
+// client block is committed. Every view has a timer; a node that times out
+// tells every validator, so that views resynchronize after losses.
+type hotstuff struct {
+	*Node
+
+	mu         sync.Mutex
+	path       string // persisted state, empty until recoverWAL
+	view       int64  // current view
+	lastVoted  int64
+	lastVote   *hsVote
+	locked     qc
+	highQC     qc
+	blocks     map[string]*hsBlock // uncommitted blocks by header hash
+	qcs        map[string]qc       // certificates of those blocks
+	byView     map[int64][]byte    // proposal hash of each view
+	votes      map[int64]map[string]hsVote
+	newViews   map[int64]map[string]qc
+	timedOut   map[string]int64 // highest view each validator asked for
+	ready      int64            // view this node may propose in
+	proposedIn int64
+	fails      int // timeouts since the last new QC, for the backoff
+	timer      Timer
+}
+
+func newHotStuff(n *Node) Consensus {
+	tip := qc{Header: n.Ledger.Tip().Header}
+	hs := &hotstuff{
+		Node:     n,
+		view:     1,
+		locked:   tip,
+		highQC:   tip,
+		blocks:   map[string]*hsBlock{},
+		qcs:      map[string]qc{},
+		byView:   map[int64][]byte{},
+		votes:    map[int64]map[string]hsVote{},
+		newViews: map[int64]map[string]qc{},
+		timedOut: map[string]int64{},
+	}
+	if hs.leaderOf(tip.Header.Height+1, 1) == n.ID {
+		hs.ready = 1
+	}
+	hs.arm()
+	return hs
+}
+
+func (hs *hotstuff) leaderOf(height, view int64) string {
+	ids := hs.Ledger.ValidatorsAt(height).IDs()
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[view%int64(len(ids))]
+}
+
+func (hs *hotstuff) OnMessage(kind string, body []byte) error {
+	switch kind {
+	case kindHSProposal:
+		return hs.onProposal(body)
+	case kindHSVote:
+		return hs.onVote(body)
+	case kindHSNewView:
+		return hs.onNewView(body)
+	}
+	return reject(http.StatusNotFound, "hotstuff: unknown message %q", kind)
+}
+
+// Leader is the leader of the current view. The view timer runs anyway,
+// so a leader that ignores the write is replaced.
+func (hs *hotstuff) Leader() string {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.leaderOf(hs.highQC.Header.Height+1, hs.view)
+}
+
+func (hs *hotstuff) Propose(op block.Operation) (block.Block, error) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.ready != hs.view || hs.proposedIn >= hs.view {
+		return block.Block{}, reject(http.StatusServiceUnavailable, "leader not ready in view %d", hs.view)
+	}
+	// a reconfiguration must commit, three blocks later, before the epoch
+	// it changes starts
+	h := hs.highQC.Header.Height + 1
+	if (op.Validator != nil || op.Type == block.OpValidator) && block.NextEpoch(h)-h < 4 {
+		return block.Block{}, reject(http.StatusServiceUnavailable, "too close to epoch %d", block.NextEpoch(h))
+	}
+	return hs.propose(op)
+}
+
+// propose builds op on top of the highest QC and sends it to every
+// validator. hs.mu must be held.
+func (hs *hotstuff) propose(op block.Operation) (block.Block, error) {
+	prev, err := hs.extendTo(hs.highQC)
+	if err != nil {
+		return block.Block{}, reject(http.StatusServiceUnavailable, "%v", err)
+	}
+	blk, err := hs.newProposal(prev, op)
+	if err != nil {
+		return block.Block{}, err
+	}
+	hs.proposedIn = hs.view
+	hs.save()
+	msg := hsProposal{hs.auth(kindHSProposal, blk.Header.Height, hs.view, block.HashHeader(blk.Header)), blk, hs.highQC}
+	log.Printf("[node %s] hotstuff propose height=%d view=%d type=%s", hs.ID, blk.Header.Height, hs.view, op.Type)
+	hs.multicast(blk.Header.Height, kindHSProposal, msg)
+	hs.processProposal(msg)
+	return blk, nil
+}
+
+// extendTo executes the uncommitted chain up to the block q certifies, so
+// that a new block can be built on it. hs.mu must be held.
+func (hs *hotstuff) extendTo(q qc) (block.Block, error) {
+	tip := hs.Ledger.Tip()
+	var path []block.Block
+	for hash := q.hash(); ; {
+		if bytes.Equal(hash, block.HashHeader(tip.Header)) {
+			break
+		}
+		b, ok := hs.blocks[hex.EncodeToString(hash)]
+		if !ok || b.blk.Header.Height <= tip.Header.Height {
+			return block.Block{}, fmt.Errorf("high QC at height %d does not extend the tip", q.Header.Height)
+		}
+		path = append(path, b.blk)
+		hash = b.blk.Header.PrevHash
+	}
+	prev := tip
+	for i := len(path) - 1; i >= 0; i-- {
+		if err := hs.Ledger.Speculate(path[i]); err != nil {
+			return block.Block{}, err
+		}
+		prev = path[i]
+	}
+	hs.Ledger.DropProposal(prev.Header.Height + 1)
+	return prev, nil
+}
+
+func (hs *hotstuff) onProposal(body []byte) error {
+	var msg hsProposal
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return fmt.Errorf("bad proposal: %w", err)
+	}
+	if err := hs.verifyAuth(kindHSProposal, msg.msgAuth); err != nil {
+		return reject(http.StatusUnauthorized, "%v", err)
+	}
+	if msg.From != hs.leaderOf(msg.Height, msg.View) {
+		return reject(http.StatusForbidden, "proposal from non-leader")
+	}
+	if err := checkProposal(msg.Block, msg.Height, msg.Digest); err != nil {
+		return err
+	}
+	j := msg.Justify
+	if j.Header.Height != msg.Height-1 || !bytes.Equal(j.hash(), msg.Block.Header.PrevHash) || j.View >= msg.View {
+		return fmt.Errorf("justify does not certify the parent")
+	}
+	if err := j.verify(hs.Node); err != nil {
+		return err
+	}
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.processProposal(msg)
+	return nil
+}
+
+// processProposal records a proposal, updates the locks and commits, and
+// votes for it when it is safe. hs.mu must be held.
+func (hs *hotstuff) processProposal(msg hsProposal) {
+	key := hex.EncodeToString(msg.Digest)
+	if _, seen := hs.blocks[key]; seen || msg.Height < hs.nextHeight() {
+		return
+	}
+	hs.blocks[key] = &hsBlock{msg.Block, msg.View, msg.Justify}
+	hs.byView[msg.View] = msg.Digest
+	hs.qcs[hex.EncodeToString(msg.Justify.hash())] = msg.Justify
+	hs.update(msg.Justify)
+	hs.tryQC(msg.View)
+
+	if msg.View > hs.view {
+		hs.enter(msg.View)
+	}
+	if msg.View < hs.view || msg.View <= hs.lastVoted || !hs.safe(msg) {
+		return
+	}
+	hs.lastVoted = msg.View
+	vote := hsVote{hs.auth(kindHSVote, msg.Height, msg.View, msg.Digest), block.SignCommit(msg.Block.Header, hs.SK)}
+	hs.lastVote = &vote
+	hs.save()
+	if next := hs.leaderOf(msg.Height+1, msg.View+1); next == hs.ID {
+		hs.addVote(vote)
+	} else {
+		hs.send(next, kindHSVote, vote)
+	}
+	// the node stays in the view until its QC, a later proposal or the
+	// timeout certificate: should the votes split, the next leader then
+	// starts from that certificate rather than losing its view too
+}
+
+// safe is the voting rule: the block extends the locked block, or its
+// justification is newer than the lock. hs.mu must be held.
+func (hs *hotstuff) safe(msg hsProposal) bool {
+	return msg.Justify.View > hs.locked.View || hs.extends(msg.Block.Header, hs.locked)
+}
+
+func (hs *hotstuff) extends(hdr block.BlockHeader, anc qc) bool {
+	for hdr.Height > anc.Header.Height {
+		if b, ok := hs.blocks[hex.EncodeToString(hdr.PrevHash)]; ok {
+			hdr = b.blk.Header
+			continue
+		}
+		b, err := hs.Ledger.GetBlock(hdr.Height - 1)
+		if err != nil || !bytes.Equal(block.HashHeader(b.Header), hdr.PrevHash) {
+			return false
+		}
+		hdr = b.Header
+	}
+	return bytes.Equal(block.HashHeader(hdr), anc.hash())
+}
+
+// update applies the chained HotStuff rules to the QC a proposal carries:
+// it may raise the high QC, lock the block two below (a two-chain) and
+// commit the block three below (a three-chain of consecutive views).
+// hs.mu must be held.
+func (hs *hotstuff) update(q qc) {
+	if q.View > hs.highQC.View {
+		hs.highQC = q
+		hs.fails = 0
+	}
+	b2, ok := hs.blocks[hex.EncodeToString(q.hash())]
+	if !ok {
+		return
+	}
+	if b2.justify.View > hs.locked.View {
+		hs.locked = b2.justify
+	}
+	b1, ok := hs.blocks[hex.EncodeToString(b2.justify.hash())]
+	if !ok {
+		return
+	}
+	if b2.view == b1.view+1 && b1.view == b1.justify.View+1 {
+		hs.commit(b1.justify)
+	}
+}
+
+// commit delivers the block q certifies and its uncommitted ancestors,
+// each with its certificate. hs.mu must be held.
+func (hs *hotstuff) commit(q qc) {
+	tip := hs.nextHeight() - 1
+	var path []block.Block
+	for hash := q.hash(); ; {
+		b, ok := hs.blocks[hex.EncodeToString(hash)]
+		if !ok || b.blk.Header.Height <= tip {
+			break
+		}
+		cert, ok := hs.qcs[hex.EncodeToString(hash)]
+		if !ok {
+			return
+		}
+		blk := b.blk
+		blk.Header.Validators, blk.Header.Signatures = cert.Header.Validators, cert.Header.Signatures
+		path = append(path, blk)
+		hash = b.blk.Header.PrevHash
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		log.Printf("[node %s] hotstuff commit height=%d", hs.ID, path[i].Header.Height)
+		hs.deliver(path[i])
+	}
+	if len(path) > 0 {
+		hs.prune()
+	}
+}
+
+// prune forgets blocks, votes and view changes below the committed tip.
+// hs.mu must be held.
+func (hs *hotstuff) prune() {
+	tip := hs.nextHeight() - 1
+	for key, b := range hs.blocks {
+		if b.blk.Header.Height <= tip {
+			delete(hs.blocks, key)
+			delete(hs.qcs, key)
+		}
+	}
+	for v := range hs.byView {
+		if v < hs.locked.View {
+			delete(hs.byView, v)
+		}
+	}
+	for v := range hs.votes {
+		if v < hs.locked.View {
+			delete(hs.votes, v)
+		}
+	}
+}
+
+// pendingFrom reports whether the chain ending in hash holds an
+// uncommitted client block, which more views must commit.
+func (hs *hotstuff) pendingFrom(hash []byte) bool {
+	next := hs.nextHeight()
+	for {
+		b, ok := hs.blocks[hex.EncodeToString(hash)]
+		if !ok || b.blk.Header.Height < next {
+			return false
+		}
+		var op block.Operation
+		if json.Unmarshal(b.blk.Content, &op) == nil && op.Type != block.OpNoop {
+			return true
+		}
+		hash = b.blk.Header.PrevHash
+	}
+}
+
+func (hs *hotstuff) onVote(body []byte) error {
+	var v hsVote
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("bad vote: %w", err)
+	}
+	if err := hs.verifyAuth(kindHSVote, v.msgAuth); err != nil {
+		return reject(http.StatusUnauthorized, "%v", err)
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.addVote(v)
+	return nil
+}
+
+// addVote records a vote for the proposal of v.View and forms its QC once
+// a quorum voted. hs.mu must be held.
+func (hs *hotstuff) addVote(v hsVote) {
+	if v.View < hs.locked.View {
+		return
+	}
+	if hs.votes[v.View] == nil {
+		hs.votes[v.View] = map[string]hsVote{}
+	}
+	if _, dup := hs.votes[v.View][v.From]; dup {
+		return
+	}
+	hs.votes[v.View][v.From] = v
+	hs.tryQC(v.View)
+}
+
+// tryQC forms the QC of view once its proposal is known and a quorum of
+// valid votes for it arrived; this node then leads the next view.
+// hs.mu must be held.
+func (hs *hotstuff) tryQC(view int64) {
+	hash, ok := hs.byView[view]
+	if !ok || hs.highQC.View >= view {
+		return
+	}
+	b, ok := hs.blocks[hex.EncodeToString(hash)]
+	if !ok {
+		return
+	}
+	hdr := b.blk.Header
+	vals := hs.Ledger.ValidatorsAt(hdr.Height)
+	var ids []string
+	for id, v := range hs.votes[view] {
+		if pk, ok := vals[id]; ok && bytes.Equal(v.Digest, hash) && block.VerifyCommitSig(pk, hdr, v.Sig) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) < block.Quorum(len(vals)) {
+		return
+	}
+	sort.Strings(ids)
+	q := qc{View: view, Header: hdr}
+	for _, id := range ids {
+		v := hs.votes[view][id]
+		q.Header.Validators = append(q.Header.Validators, id)
+		q.Header.Signatures = append(q.Header.Signatures, v.Sig)
+		q.ViewSigs = append(q.ViewSigs, v.MsgSig)
+	}
+	q.Header.Validators, q.Header.Signatures = q.Header.Validators[:len(ids):len(ids)], q.Header.Signatures[:len(ids):len(ids)]
+	hs.qcs[hex.EncodeToString(hash)] = q
+	hs.update(q)
+	log.Printf("[node %s] hotstuff qc height=%d view=%d votes=%d", hs.ID, hdr.Height, view, len(ids))
+
+	if hs.view <= view {
+		hs.enter(view + 1)
+	}
+	if hs.leaderOf(hdr.Height+1, view+1) == hs.ID && hs.view == view+1 {
+		hs.ready = view + 1
+		hs.proposeIfPending()
+	}
+}
+
+// proposeIfPending keeps the chain moving while client blocks wait for
+// their three-chain: with the oldest queued write, so that a leader which
+// is always in this hurry still takes client writes, or with a noop block.
+// hs.mu must be held.
+func (hs *hotstuff) proposeIfPending() {
+	if hs.proposedIn >= hs.view || !hs.pendingFrom(hs.highQC.hash()) {
+		return
+	}
+	op := block.Operation{Type: block.OpNoop}
+	e := hs.nextTx()
+	if e != nil && e.op.Validator == nil && e.op.Type != block.OpValidator {
+		op = e.op
+	} else {
+		e = nil // a reconfiguration waits for Propose and its epoch check
+	}
+	blk, err := hs.propose(op)
+	if err != nil {
+		log.Printf("[node %s] hotstuff propose: %v", hs.ID, err)
+		return
+	}
+	if e != nil {
+		hs.proposedTx(e, blk.Header.Height)
+	}
+}
+
+// enter moves to view v and starts its timer. hs.mu must be held.
+func (hs *hotstuff) enter(v int64) {
+	hs.view = v
+	for w := range hs.newViews {
+		if w < v {
+			delete(hs.newViews, w)
+		}
+	}
+	hs.arm()
+}
+
+// arm starts the timer of the current view with exponential backoff.
+// hs.mu must be held.
+func (hs *hotstuff) arm() {
+	if hs.timer != nil {
+		hs.timer.Stop()
+	}
+	shift := hs.fails
+	if shift > maxBackoff {
+		shift = maxBackoff
+	}
+	h, v := hs.highQC.Header.Height+1, hs.view
+	hs.timer = hs.Clock.AfterFunc(viewTimeout<<uint(shift), func() { hs.OnTimeout(h, v) })
+}
+
+// OnTimeout gives up on view. The node stays in it, telling the others
+// again at every expiry, until a QC or the timeout certificate of a later
+// view moves it on, so that a node cut off alone does not run ahead. A view
+// that saw no proposal while nothing waited to commit was idle and does
+// not count towards the backoff.
+func (hs *hotstuff) OnTimeout(height, view int64) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.view != view {
+		return
+	}
+	log.Printf("[node %s] hotstuff timeout height=%d view=%d", hs.ID, height, view)
+	if _, proposed := hs.byView[view]; proposed || hs.pendingFrom(hs.highQC.hash()) {
+		hs.fails++
+	}
+	hs.giveUp(view)
+}
+
+// giveUp moves to view if behind, restarts its timer and tells every
+// validator that this node wants the next view, with its high QC, the
+// chain up to it and its last vote. hs.mu must be held.
+func (hs *hotstuff) giveUp(view int64) {
+	if hs.view < view {
+		hs.enter(view)
+	} else {
+		hs.arm()
+	}
+	height := hs.highQC.Header.Height + 1
+	nv := hsNewView{hs.auth(kindHSNewView, height, view+1, nil), hs.highQC, hs.chainTo(hs.highQC), hs.lastVote}
+	hs.multicast(height, kindHSNewView, nv)
+	hs.addNewView(nv)
+}
+
+// chainTo lists the uncommitted blocks up to the block q certifies, lowest
+// first. hs.mu must be held.
+func (hs *hotstuff) chainTo(q qc) []hsEntry {
+	var chain []hsEntry
+	next := hs.nextHeight()
+	for hash := q.hash(); ; {
+		b, ok := hs.blocks[hex.EncodeToString(hash)]
+		if !ok || b.blk.Header.Height < next {
+			break
+		}
+		chain = append(chain, hsEntry{b.blk, b.view, b.justify})
+		hash = b.blk.Header.PrevHash
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+func (hs *hotstuff) onNewView(body []byte) error {
+	var nv hsNewView
+	if err := json.Unmarshal(body, &nv); err != nil {
+		return fmt.Errorf("bad new view: %w", err)
+	}
+	if err := hs.verifyAuth(kindHSNewView, nv.msgAuth); err != nil {
+		return reject(http.StatusUnauthorized, "%v", err)
+	}
+	if err := nv.HighQC.verify(hs.Node); err != nil {
+		return err
+	}
+	if err := verifyChain(hs.Node, nv.Chain, nv.HighQC); err != nil {
+		return err
+	}
+	if nv.Vote != nil {
+		if nv.Vote.From != nv.From {
+			return reject(http.StatusForbidden, "new view carries a vote of %s", nv.Vote.From)
+		}
+		if err := hs.verifyAuth(kindHSVote, nv.Vote.msgAuth); err != nil {
+			return reject(http.StatusUnauthorized, "%v", err)
+		}
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.addNewView(nv)
+	return nil
+}
+
+// verifyChain checks that chain links up to the block high certifies and
+// that each block is the one its successor's QC, or high, certifies in the
+// view the block was proposed in.
+func verifyChain(n *Node, chain []hsEntry, high qc) error {
+	for i, e := range chain {
+		hdr := e.Block.Header
+		if err := checkProposal(e.Block, hdr.Height, block.HashHeader(hdr)); err != nil {
+			return fmt.Errorf("new view chain: %v", err)
+		}
+		if !bytes.Equal(e.Justify.hash(), hdr.PrevHash) || e.Justify.View >= e.View {
+			return fmt.Errorf("new view chain: block %d does not extend its justify", hdr.Height)
+		}
+		cert := high
+		if i+1 < len(chain) {
+			cert = chain[i+1].Justify
+		}
+		if !bytes.Equal(cert.hash(), block.HashHeader(hdr)) || cert.View != e.View {
+			return fmt.Errorf("new view chain: block %d is not certified", hdr.Height)
+		}
+		if err := e.Justify.verify(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addNewView records that nv.From gave up on the view before nv.View, and
+// takes in its high QC and the chain up to it. A node that sees f+1
+// validators give up on later views than its own gives up as well, since
+// one of them is honest; a quorum for a view is its timeout certificate,
+// which moves every node there and lets its leader propose on the highest
+// QC among them. hs.mu must be held.
+func (hs *hotstuff) addNewView(nv hsNewView) {
+	next := hs.nextHeight()
+	for _, e := range nv.Chain {
+		key := hex.EncodeToString(block.HashHeader(e.Block.Header))
+		if _, ok := hs.blocks[key]; ok || e.Block.Header.Height < next {
+			continue
+		}
+		hs.blocks[key] = &hsBlock{e.Block, e.View, e.Justify}
+		hs.qcs[hex.EncodeToString(e.Justify.hash())] = e.Justify
+		if _, ok := hs.byView[e.View]; !ok {
+			hs.byView[e.View] = block.HashHeader(e.Block.Header)
+		}
+	}
+	if nv.HighQC.View > 0 {
+		hs.qcs[hex.EncodeToString(nv.HighQC.hash())] = nv.HighQC
+	}
+	hs.update(nv.HighQC)
+	if nv.Vote != nil {
+		hs.addVote(*nv.Vote)
+	}
+	if nv.View > hs.timedOut[nv.From] {
+		hs.timedOut[nv.From] = nv.View
+	}
+	if nv.View >= hs.view {
+		if hs.newViews[nv.View] == nil {
+			hs.newViews[nv.View] = map[string]qc{}
+		}
+		hs.newViews[nv.View][nv.From] = nv.HighQC
+	}
+	hs.save()
+
+	vals := hs.Ledger.ValidatorsAt(nv.Height)
+	f := len(vals) - block.Quorum(len(vals))
+	var ahead []int64
+	for _, v := range hs.timedOut {
+		if v > hs.view+1 {
+			ahead = append(ahead, v)
+		}
+	}
+	if len(ahead) > f {
+		sort.Slice(ahead, func(i, j int) bool { return ahead[i] > ahead[j] })
+		log.Printf("[node %s] hotstuff joins view %d", hs.ID, ahead[f]-1)
+		hs.giveUp(ahead[f] - 1)
+	}
+
+	if nv.View < hs.view || len(hs.newViews[nv.View]) != block.Quorum(len(vals)) {
+		return
+	}
+	// the view starts with its certificate, also for the nodes that timed
+	// out into it early, so that the leader's proposal finds them there
+	hs.enter(nv.View)
+	if hs.leaderOf(nv.Height, nv.View) == hs.ID && hs.ready < nv.View {
+		hs.ready = nv.View
+		log.Printf("[node %s] hotstuff leads view %d", hs.ID, nv.View)
+		hs.proposeIfPending()
+	}
+}
+
+// save persists the state the voting rules depend on before this node
+// votes or proposes. hs.mu must be held.
+func (hs *hotstuff) save() {
+	if hs.path == "" {
+		return
+	}
+	st := hsState{View: hs.view, LastVoted: hs.lastVoted, ProposedIn: hs.proposedIn, Locked: hs.locked, HighQC: hs.highQC}
+	for _, b := range hs.blocks {
+		st.Blocks = append(st.Blocks, hsEntry{b.blk, b.view, b.justify})
+	}
+	sort.Slice(st.Blocks, func(i, j int) bool { return st.Blocks[i].View < st.Blocks[j].View })
+	raw, _ := json.Marshal(st)
+	if err := writeFileSync(hs.path, raw); err != nil {
+		log.Fatalf("[node %s] hotstuff state: %v", hs.ID, err)
+	}
+}
+
+// recoverWAL loads the state persisted at path, so that the node neither
+// votes nor proposes twice in a view, nor votes against its lock, after a
+// restart.
+func (hs *hotstuff) recoverWAL(path string) error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	raw, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var st hsState
+		if err := json.Unmarshal(raw, &st); err != nil {
+			return fmt.Errorf("hotstuff state %s: %w", path, err)
+		}
+		next := hs.nextHeight()
+		for _, e := range st.Blocks {
+			if e.Block.Header.Height >= next {
+				hs.blocks[hex.EncodeToString(block.HashHeader(e.Block.Header))] = &hsBlock{e.Block, e.View, e.Justify}
+				hs.qcs[hex.EncodeToString(e.Justify.hash())] = e.Justify
+				hs.byView[e.View] = block.HashHeader(e.Block.Header)
+			}
+		}
+		hs.view = max(hs.view, st.View)
+		hs.lastVoted = st.LastVoted
+		hs.proposedIn = st.ProposedIn
+		if st.Locked.View > hs.locked.View {
+			hs.locked = st.Locked
+		}
+		// the high QC is only of use while this node can build on it
+		tip := block.HashHeader(hs.Ledger.Tip().Header)
+		if _, ok := hs.blocks[hex.EncodeToString(st.HighQC.hash())]; ok || bytes.Equal(st.HighQC.hash(), tip) {
+			hs.qcs[hex.EncodeToString(st.HighQC.hash())] = st.HighQC
+			hs.update(st.HighQC)
+		}
+	}
+	hs.path = path
+	hs.save()
+	hs.enter(hs.view)
+	log.Printf("[node %s] hotstuff state view=%d voted=%d proposed=%d locked=%d high=%d blocks=%d",
+		hs.ID, hs.view, hs.lastVoted, hs.proposedIn, hs.locked.View, hs.highQC.View, len(hs.blocks))
+	return nil
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// A leader that restarts after proposing in a view remembers it, and a
+// certificate for that view does not make it propose a second block.
+func TestHotStuffRestartProposesOnce(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	vals := block.ValidatorSet{"validator1": sk.Public().(ed25519.PublicKey)}
+	path := filepath.Join(t.TempDir(), "hotstuff.json")
+	start := func() *hotstuff {
+		n := NewNode("validator1", 0, map[string]string{}, nil)
+		n.SK, n.PK = sk, vals["validator1"]
+		n.Ledger = staticLedger{vals: vals}
+		if err := n.UseConsensus("hotstuff"); err != nil {
+			t.Fatal(err)
+		}
+		return n.Engine().(*hotstuff)
+	}
+
+	hs := start()
+	hs.mu.Lock()
+	hs.path, hs.view, hs.proposedIn = path, 5, 5
+	hs.save()
+	hs.mu.Unlock()
+
+	hs = start()
+	if err := hs.Node.Recover(path); err != nil {
+		t.Fatal(err)
+	}
+	hs.mu.Lock()
+	hs.ready = hs.view
+	hs.mu.Unlock()
+	if hs.proposedIn != 5 {
+		t.Fatalf("restarted leader proposed in view %d, want 5", hs.proposedIn)
+	}
+	if _, err := hs.Propose(block.Operation{Key: "a", Value: []byte("1")}); err == nil {
+		t.Fatal("restarted leader proposed twice in view 5")
+	}
+}
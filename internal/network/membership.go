@@ -0,0 +1,325 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	kindPing = "ping"
+	kindPong = "pong"
+)
+
+// Membership tuning. A peer gains a point for every signed ping or pong
+// it answers and loses two for every round it stays silent. Only peers in
+// good standing, a score of zero or more, are gossiped to and exchanged.
+// Peers that were not configured are evicted below evictScore, candidates
+// learned by peer exchange after candidateTries unanswered pings.
+var (
+	PingInterval   = 3 * time.Second
+	GossipFanout   = 3
+	maxScore       = 10
+	evictScore     = -6
+	candidateTries = 3
+	exchangeSize   = 16 // peers sent with each ping and pong
+)
+
+// PeerInfo identifies a node on the wire.
+type PeerInfo struct {
+	ID   string            `json:"id"`
+	Addr string            `json:"addr"`
+	PK   ed25519.PublicKey `json:"pk,omitempty"`
+}
+
+// Peer is an entry of the peer table.
+type Peer struct {
+	PeerInfo
+	Score    int       `json:"score"`
+	LastSeen time.Time `json:"last_seen"`
+	Tip      int64     `json:"tip"`    // committed height it last reported
+	Static   bool      `json:"static"` // configured, never evicted
+}
+
+// peerTable holds the peers a node talks to and the candidates peer
+// exchange suggested, which join the table once they answer a ping.
+type peerTable struct {
+	mu         sync.Mutex
+	peers      map[string]*Peer
+	candidates map[string]*candidate
+}
+
+type candidate struct {
+	PeerInfo
+	tries int
+}
+
+func newPeerTable(self string, addrs map[string]string) *peerTable {
+	pt := &peerTable{peers: map[string]*Peer{}, candidates: map[string]*candidate{}}
+	for id, addr := range addrs {
+		if id != self {
+			pt.peers[id] = &Peer{PeerInfo: PeerInfo{ID: id, Addr: addr}, Static: true}
+		}
+	}
+	return pt
+}
+
+// addrOf returns the address of a peer or candidate.
+func (n *Node) addrOf(id string) (string, bool) {
+	pt := n.peers
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if p, ok := pt.peers[id]; ok {
+		return p.Addr, true
+	}
+	if c, ok := pt.candidates[id]; ok {
+		return c.Addr, true
+	}
+	return "", false
+}
+
+// Peers returns the peer table sorted by id.
+func (n *Node) Peers() []Peer {
+	pt := n.peers
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	out := make([]Peer, 0, len(pt.peers))
+	for _, p := range pt.peers {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// self describes this node to its peers.
+func (n *Node) self() PeerInfo {
+	addr, ok := n.PeerAddrs[n.ID]
+	if !ok {
+		addr = fmt.Sprintf("127.0.0.1:%d", n.Port)
+	}
+	return PeerInfo{ID: n.ID, Addr: addr, PK: n.PK}
+}
+
+// gossip sends body to GossipFanout peers, drawn at random among those
+// in good standing. Receivers pass on what is new to them.
+func (n *Node) gossip(kind string, body []byte) {
+	var ids []string
+	for _, p := range n.Peers() {
+		if p.Score >= 0 {
+			ids = append(ids, p.ID)
+		}
+	}
+	for i := 0; i < len(ids) && i < GossipFanout; i++ {
+		j := i + int(n.rng.Int63n(int64(len(ids)-i)))
+		ids[i], ids[j] = ids[j], ids[i]
+		n.Transport.Send(ids[i], kind, body)
+	}
+}
+
+// peerSeen credits a peer that answered, or that a message reached.
+func (n *Node) peerSeen(id string) {
+	pt := n.peers
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if p, ok := pt.peers[id]; ok {
+		p.LastSeen = n.Clock.Now()
+		if p.Score < maxScore {
+			p.Score++
+		}
+	}
+}
+
+// peerFailed debits a peer a message could not be delivered to.
+func (n *Node) peerFailed(id string) {
+	pt := n.peers
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if p, ok := pt.peers[id]; ok {
+		p.Score -= 2
+	}
+}
+
+// pingMsg is a ping or pong: the sender and its committed height, signed,
+// and a sample of its peers for the receiver to try.
+type pingMsg struct {
+	From  PeerInfo   `json:"from"`
+	Tip   int64      `json:"tip"`
+	Peers []PeerInfo `json:"peers,omitempty"`
+	Sig   []byte     `json:"sig"`
+}
+
+func pingBytes(kind string, from PeerInfo, tip int64) []byte {
+	b, _ := json.Marshal(struct {
+		Kind string   `json:"kind"`
+		From PeerInfo `json:"from"`
+		Tip  int64    `json:"tip"`
+	}{kind, from, tip})
+	return b
+}
+
+func (n *Node) newPing(kind string) pingMsg {
+	me := n.self()
+	var sample []PeerInfo
+	for _, p := range n.Peers() {
+		if p.Score >= 0 && len(sample) < exchangeSize {
+			sample = append(sample, p.PeerInfo)
+		}
+	}
+	tip := n.nextHeight() - 1
+	return pingMsg{From: me, Tip: tip, Peers: sample, Sig: ed25519.Sign(n.SK, pingBytes(kind, me, tip))}
+}
+
+// onPing handles a ping or a pong. The sender joins the table when its
+// signature checks against its validator key, the key it joined with
+// before, or, for a node never seen, the key it sends.
+func (n *Node) onPing(kind string, body []byte) error {
+	var m pingMsg
+	if err := json.Unmarshal(body, &m); err != nil {
+		return fmt.Errorf("bad %s: %w", kind, err)
+	}
+	if m.From.ID == "" || m.From.ID == n.ID {
+		return nil
+	}
+	vk, isPeer := n.peerKey(m.From.ID, n.nextHeight())
+
+	pt := n.peers
+	pt.mu.Lock()
+	pk := m.From.PK
+	p, known := pt.peers[m.From.ID]
+	switch {
+	case isPeer:
+		pk = vk
+	case known && p.PK != nil:
+		pk = p.PK
+	}
+	if !bytes.Equal(pk, m.From.PK) || !ed25519.Verify(pk, pingBytes(kind, m.From, m.Tip), m.Sig) {
+		pt.mu.Unlock()
+		return reject(http.StatusUnauthorized, "bad %s signature from %s", kind, m.From.ID)
+	}
+	if !known {
+		p = &Peer{}
+		pt.peers[m.From.ID] = p
+		log.Printf("[node %s] new peer %s at %s", n.ID, m.From.ID, m.From.Addr)
+	}
+	p.PeerInfo, p.Tip = m.From, m.Tip
+	delete(pt.candidates, m.From.ID)
+	for _, c := range m.Peers {
+		if _, ok := pt.peers[c.ID]; ok || c.ID == n.ID || c.ID == "" {
+			continue
+		}
+		if _, ok := pt.candidates[c.ID]; !ok {
+			pt.candidates[c.ID] = &candidate{PeerInfo: c}
+		}
+	}
+	pt.mu.Unlock()
+
+	n.peerSeen(m.From.ID)
+	if m.Tip > n.nextHeight() {
+		n.wakeSync() // more than a block behind
+	}
+	if kind == kindPing {
+		buf, _ := json.Marshal(n.newPing(kindPong))
+		n.Transport.Send(m.From.ID, kindPong, buf)
+	}
+	return nil
+}
+
+// heartbeat pings every peer and candidate, scores down the peers that
+// stayed silent since the last round and evicts the ones that keep
+// failing.
+func (n *Node) heartbeat() {
+	now := n.Clock.Now()
+	pt := n.peers
+	pt.mu.Lock()
+	var ids []string
+	for id, p := range pt.peers {
+		if now.Sub(p.LastSeen) > 2*PingInterval {
+			p.Score -= 2
+		}
+		if p.Score < evictScore {
+			if p.Static {
+				p.Score = evictScore // so it recovers quickly once back
+			} else {
+				delete(pt.peers, id)
+				log.Printf("[node %s] evicted peer %s", n.ID, id)
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+	for id, c := range pt.candidates {
+		if c.tries >= candidateTries {
+			delete(pt.candidates, id)
+			continue
+		}
+		c.tries++
+		ids = append(ids, id)
+	}
+	pt.mu.Unlock()
+
+	sort.Strings(ids)
+	buf, _ := json.Marshal(n.newPing(kindPing))
+	for _, id := range ids {
+		n.Transport.Send(id, kindPing, buf)
+	}
+}
+
+// Join fetches the peer table of each seed, given by address, and makes
+// its peers and the seed itself candidates of this node's table.
+func (n *Node) Join(seeds []string) {
+	for _, addr := range seeds {
+		resp, err := n.rpc().Get(n.baseURL(addr) + "/peers")
+		if err != nil {
+			log.Printf("[node %s] seed %s: %v", n.ID, addr, err)
+			continue
+		}
+		var list struct {
+			Self  PeerInfo `json:"self"`
+			Peers []Peer   `json:"peers"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("[node %s] seed %s: %v", n.ID, addr, err)
+			continue
+		}
+		infos := []PeerInfo{list.Self}
+		for _, p := range list.Peers {
+			infos = append(infos, p.PeerInfo)
+		}
+		pt := n.peers
+		pt.mu.Lock()
+		for _, c := range infos {
+			if _, ok := pt.peers[c.ID]; !ok && c.ID != n.ID && c.ID != "" {
+				pt.candidates[c.ID] = &candidate{PeerInfo: c}
+			}
+		}
+		pt.mu.Unlock()
+		log.Printf("[node %s] joined through seed %s (%d peers)", n.ID, addr, len(infos))
+	}
+}
+
+// StartMembership pings the peers every PingInterval.
+func (n *Node) StartMembership() {
+	var tick func()
+	tick = func() {
+		n.heartbeat()
+		n.Clock.AfterFunc(PingInterval, tick)
+	}
+	n.Clock.AfterFunc(0, tick)
+}
+
+// handlePeers serves GET /peers: this node and its peer table.
+func (n *Node) handlePeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"self":  n.self(),
+		"peers": n.Peers(),
+	})
+}
@@ -0,0 +1,67 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// A pong is refused unless signed with the key its sender is bound to: its
+// validator key, the key it joined with, or for a newcomer the key it sends.
+// A refused sender does not enter the peer table.
+func TestPingBadSignature(t *testing.T) {
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	vals := block.ValidatorSet{
+		"validator1": sk1.Public().(ed25519.PublicKey),
+		"validator2": sk2.Public().(ed25519.PublicKey),
+	}
+	n := NewNode("validator1", 0, map[string]string{}, nil)
+	n.SK, n.PK = sk1, vals["validator1"]
+	n.Ledger = staticLedger{vals: vals}
+
+	pong := func(id string, sk ed25519.PrivateKey, tamper func(*pingMsg)) error {
+		m := pingMsg{From: PeerInfo{ID: id, Addr: "127.0.0.1:1", PK: sk.Public().(ed25519.PublicKey)}, Tip: 1}
+		m.Sig = ed25519.Sign(sk, pingBytes(kindPong, m.From, m.Tip))
+		if tamper != nil {
+			tamper(&m)
+		}
+		body, _ := json.Marshal(m)
+		return n.onPing(kindPong, body)
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	_, newcomer, _ := ed25519.GenerateKey(nil)
+	for name, err := range map[string]error{
+		"validator key": pong("validator2", other, nil),
+		"tampered tip":  pong("validator2", sk2, func(m *pingMsg) { m.Tip = 9 }),
+		"claimed key": pong("validator2", sk2, func(m *pingMsg) {
+			m.From.PK = other.Public().(ed25519.PublicKey)
+			m.Sig = ed25519.Sign(sk2, pingBytes(kindPong, m.From, m.Tip))
+		}),
+		"signed as ping": pong("validator2", sk2, func(m *pingMsg) { m.Sig = ed25519.Sign(sk2, pingBytes(kindPing, m.From, m.Tip)) }),
+	} {
+		if errorStatus(err) != http.StatusUnauthorized {
+			t.Errorf("%s: got %v, want a 401", name, err)
+		}
+	}
+	if len(n.Peers()) != 0 {
+		t.Fatalf("refused pongs added peers %v", n.Peers())
+	}
+
+	if err := pong("node9", newcomer, nil); err != nil {
+		t.Fatalf("newcomer: %v", err)
+	}
+	if err := pong("node9", other, nil); errorStatus(err) != http.StatusUnauthorized {
+		t.Fatalf("newcomer under a second key: got %v, want a 401", err)
+	}
+	if err := pong("validator2", sk2, nil); err != nil {
+		t.Fatalf("validator: %v", err)
+	}
+	peers := n.Peers()
+	if len(peers) != 2 || !peers[0].PK.Equal(newcomer.Public()) || !peers[1].PK.Equal(vals["validator2"]) {
+		t.Fatalf("peer table %+v", peers)
+	}
+}
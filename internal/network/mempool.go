@@ -0,0 +1,322 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// kindTx carries a client write to the validators, and from them on to
+// the primary.
+const kindTx = "tx"
+
+// Mempool tuning.
+var (
+	mempoolRetry = time.Second      // a write not committed is sent again after this
+	mempoolTTL   = 30 * time.Second // and dropped after this
+	mempoolMax   = 10000            // writes waiting at most
+)
+
+// pooledTx is a client write waiting for the block that carries it.
+type pooledTx struct {
+	op       block.Operation
+	added    time.Time
+	sent     time.Time // last forwarded
+	sentTo   string    // primary it was last forwarded to
+	proposed int64     // height this node proposed it at, as primary
+
+	done   chan struct{} // closed once committed
+	tx     string
+	height int64
+}
+
+// mempool holds the client writes a node accepted or was forwarded, by
+// request id, which is the nonce of their operation, until a committed
+// block carries them. settled remembers the ids of the writes committed
+// or refused lately, so that a late copy is not taken for a new write.
+type mempool struct {
+	mu      sync.Mutex
+	pending map[string]*pooledTx
+	settled map[string]time.Time
+	wake    chan struct{}
+}
+
+// StartMempool passes the queued writes on until the process exits: to
+// the validators from other nodes, to the primary from the validators, and
+// into blocks at the primary.
+func (n *Node) StartMempool() {
+	n.pool.wake = make(chan struct{}, 1)
+	go func() {
+		for range n.pool.wake {
+			n.pumpTx()
+		}
+	}()
+	n.tickMempool()
+}
+
+// Submit queues a client write under a fresh request id, as /addblock
+// does, and returns the id.
+func (n *Node) Submit(op block.Operation) (string, error) {
+	e, err := n.submitTx(op)
+	if err != nil {
+		return "", err
+	}
+	return e.op.Nonce, nil
+}
+
+// PumpMempool passes the queued writes on once. StartMempool does it on
+// every wake; a simulator without it calls it on its own clock.
+func (n *Node) PumpMempool() {
+	n.pumpTx()
+}
+
+// tickMempool wakes the mempool every mempoolRetry of the node's clock.
+func (n *Node) tickMempool() {
+	n.wakeMempool()
+	n.Clock.AfterFunc(mempoolRetry, n.tickMempool)
+}
+
+func (n *Node) wakeMempool() {
+	select {
+	case n.pool.wake <- struct{}{}:
+	default:
+	}
+}
+
+// submitTx queues a client write under a fresh request id.
+func (n *Node) submitTx(op block.Operation) (*pooledTx, error) {
+	id := make([]byte, 8)
+	n.rng.Read(id)
+	op.Nonce = hex.EncodeToString(id)
+	e, err := n.addTx(op)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, reject(http.StatusConflict, "request id %s taken", op.Nonce)
+	}
+	n.wakeMempool()
+	return e, nil
+}
+
+// addTx queues op unless its request id is queued or settled already,
+// in which case nil is returned.
+func (n *Node) addTx(op block.Operation) (*pooledTx, error) {
+	mp := &n.pool
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.pending == nil {
+		mp.pending = map[string]*pooledTx{}
+		mp.settled = map[string]time.Time{}
+	}
+	if _, ok := mp.pending[op.Nonce]; ok {
+		return nil, nil
+	}
+	if _, ok := mp.settled[op.Nonce]; ok {
+		return nil, nil
+	}
+	if len(mp.pending) >= mempoolMax {
+		return nil, reject(http.StatusServiceUnavailable, "mempool full")
+	}
+	e := &pooledTx{op: op, added: n.Clock.Now(), done: make(chan struct{})}
+	mp.pending[op.Nonce] = e
+	return e, nil
+}
+
+// onTx queues a write another node forwarded. Only validators take them.
+func (n *Node) onTx(body []byte) error {
+	var op block.Operation
+	if err := json.Unmarshal(body, &op); err != nil || op.Nonce == "" {
+		return reject(http.StatusBadRequest, "bad tx")
+	}
+	if !n.Ledger.ValidatorsAt(n.nextHeight()).Has(n.ID) {
+		return reject(http.StatusForbidden, "not a validator")
+	}
+	if _, err := n.addTx(op); err != nil {
+		return err
+	}
+	n.wakeMempool()
+	return nil
+}
+
+// pumpTx passes every queued write on. A node that is not a validator
+// sends it to the whole validator set, a validator to the primary of the
+// current view, again after mempoolRetry or when the primary changed;
+// the primary proposes it, once, until the block it proposed is lost.
+func (n *Node) pumpTx() {
+	now := n.Clock.Now()
+	mp := &n.pool
+	mp.mu.Lock()
+	var queue []*pooledTx
+	for id, e := range mp.pending {
+		if now.Sub(e.added) > mempoolTTL {
+			delete(mp.pending, id)
+			continue
+		}
+		queue = append(queue, e)
+	}
+	for id, t := range mp.settled {
+		if now.Sub(t) > mempoolTTL {
+			delete(mp.settled, id)
+		}
+	}
+	mp.mu.Unlock()
+	if len(queue) == 0 {
+		return
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i].before(queue[j]) })
+
+	validator := n.Ledger.ValidatorsAt(n.nextHeight()).Has(n.ID)
+	var leader string
+	if validator {
+		leader = n.engine.Leader()
+	}
+	for _, e := range queue {
+		mp.mu.Lock()
+		proposed, sent, sentTo := e.proposed, e.sent, e.sentTo
+		mp.mu.Unlock()
+		switch {
+		case leader == n.ID:
+			if proposed != 0 {
+				continue
+			}
+			blk, err := n.engine.Propose(e.op)
+			if err != nil {
+				if retryable(err) {
+					return
+				}
+				log.Printf("[node %s] mempool: dropped %s: %v", n.ID, e.op.Nonce, err)
+				n.settleTx(e.op.Nonce)
+				continue
+			}
+			n.proposedTx(e, blk.Header.Height)
+		case sentTo == leader && now.Sub(sent) < mempoolRetry:
+		case validator:
+			if leader == "" {
+				continue
+			}
+			n.send(leader, kindTx, e.op)
+			mp.mu.Lock()
+			e.sent, e.sentTo = now, leader
+			mp.mu.Unlock()
+		default:
+			n.multicast(n.nextHeight(), kindTx, e.op)
+			mp.mu.Lock()
+			e.sent = now
+			mp.mu.Unlock()
+		}
+	}
+}
+
+// before orders the queue: oldest first, then by request id.
+func (e *pooledTx) before(o *pooledTx) bool {
+	if !e.added.Equal(o.added) {
+		return e.added.Before(o.added)
+	}
+	return e.op.Nonce < o.op.Nonce
+}
+
+// nextTx returns the oldest queued write this node has not proposed, for
+// a leader that proposes a block anyway, or nil.
+func (n *Node) nextTx() *pooledTx {
+	mp := &n.pool
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	var next *pooledTx
+	for _, e := range mp.pending {
+		if e.proposed == 0 && (next == nil || e.before(next)) {
+			next = e
+		}
+	}
+	return next
+}
+
+// proposedTx records that this node proposed e at height.
+func (n *Node) proposedTx(e *pooledTx, height int64) {
+	n.pool.mu.Lock()
+	e.proposed = height
+	n.pool.mu.Unlock()
+	if n.ctr != nil {
+		n.ctr.PayService(n.ID) // service fee
+	}
+}
+
+// retryable reports whether a proposal failed only for now.
+func retryable(err error) bool {
+	switch errorStatus(err) {
+	case http.StatusServiceUnavailable, http.StatusMisdirectedRequest, http.StatusConflict:
+		return true
+	}
+	return false
+}
+
+// settleTx drops a write from the queue for good.
+func (n *Node) settleTx(id string) {
+	mp := &n.pool
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	delete(mp.pending, id)
+	if mp.settled != nil {
+		mp.settled[id] = n.Clock.Now()
+	}
+}
+
+// txCommitted takes the write b carries out of the queue and wakes who
+// waits for it. A write this node proposed at the height of b that b does
+// not carry lost its block and is proposed again.
+func (n *Node) txCommitted(b block.Block) {
+	var op block.Operation
+	if json.Unmarshal(b.Content, &op) != nil {
+		return
+	}
+	mp := &n.pool
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for id, e := range mp.pending {
+		if id == op.Nonce {
+			e.tx, e.height = block.TxID(b.Content), b.Header.Height
+			close(e.done)
+			delete(mp.pending, id)
+		} else if e.proposed == b.Header.Height {
+			e.proposed = 0
+		}
+	}
+	if op.Nonce != "" && mp.settled != nil {
+		mp.settled[op.Nonce] = n.Clock.Now()
+	}
+}
+
+// awaitTx answers a queued write once committed, as the primary would
+// have, or with 202 and its request id when it is not within receiptWait;
+// /receipt?nonce= follows it up.
+func (n *Node) awaitTx(w http.ResponseWriter, r *http.Request, e *pooledTx) {
+	expired := make(chan struct{})
+	t := n.Clock.AfterFunc(receiptWait, func() { close(expired) })
+	defer t.Stop()
+	select {
+	case <-e.done:
+		answerTx(w, r, e.tx, e.height)
+	case <-expired:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"nonce": e.op.Nonce})
+	case <-r.Context().Done():
+	}
+}
+
+// answerTx answers a write with its transaction id and height, or with
+// the receipt once the block is final when the request has wait=1.
+func answerTx(w http.ResponseWriter, r *http.Request, tx string, height int64) {
+	if r.URL.Query().Get("wait") != "" {
+		writeReceipt(w, receiptRef{"tx", tx}, receiptWait)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tx": tx, "height": height})
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+const (
+	kindPrePrepare = "preprepare"
+	kindPrepare    = "prepare"
+	kindCommit     = "commit"
+	kindViewChange = "viewchange"
+	kindNewView    = "newview"
+)
+
+// msgAuth is carried by every consensus message. MsgSig is the sender's
+// ed25519 signature over the message kind, From, Height, View and Digest,
+// the header hash the message is about.
+type msgAuth struct {
+	From   string `json:"from"`
+	Height int64  `json:"height"`
+	View   int64  `json:"view"`
+	Digest []byte `json:"digest"`
+	MsgSig []byte `json:"msg_sig"`
+}
+
+type prePrepareMsg struct {
+	msgAuth
+	Block block.Block `json:"block"`
+}
+
+// prepareMsg and commitMsg are votes; Sig is the vote itself, a signature
+// over the block header that ends up in the commit certificate.
+type prepareMsg struct {
+	msgAuth
+	Sig []byte `json:"sig"`
+}
+type commitMsg struct {
+	msgAuth
+	Sig []byte `json:"sig"`
+}
+
+// viewChangeMsg asks to move to View. Prepared is the sender's highest
+// prepared certificate; Digest commits to it.
+type viewChangeMsg struct {
+	msgAuth
+	Prepared *preparedCert `json:"prepared,omitempty"`
+}
+
+// newViewMsg starts View. ViewChanges is the quorum it is built from and
+// Block the re-proposal of the highest prepared certificate among them,
+// nil when none prepared; Digest is its header hash.
+type newViewMsg struct {
+	msgAuth
+	ViewChanges []viewChangeMsg `json:"view_changes"`
+	Block       *block.Block    `json:"block,omitempty"`
+}
+
+// signed is the part of a message the sender signs, as kind.
+func (a msgAuth) signed(kind string) block.SignedMsg {
+	return block.SignedMsg{Kind: kind, From: a.From, Height: a.Height, View: a.View, Digest: a.Digest, Sig: a.MsgSig}
+}
+
+func authBytes(kind string, a msgAuth) []byte {
+	return a.signed(kind).SignedBytes()
+}
+
+// auth builds and signs the common part of an outgoing message.
+func (n *Node) auth(kind string, height, view int64, digest []byte) msgAuth {
+	a := msgAuth{From: n.ID, Height: height, View: view, Digest: digest}
+	a.MsgSig = ed25519.Sign(n.SK, authBytes(kind, a))
+	return a
+}
+
+// peerKey is the key a peer signs with at height: its validator key when
+// it is in the set (keys rotate on-chain), PeerPK otherwise.
+func (n *Node) peerKey(id string, height int64) (ed25519.PublicKey, bool) {
+	if pk, ok := n.Ledger.ValidatorsAt(height)[id]; ok {
+		return pk, true
+	}
+	pk, ok := n.PeerPK[id]
+	return pk, ok
+}
+
+// verifyAuth checks the sender signature of an incoming message.
+func (n *Node) verifyAuth(kind string, a msgAuth) error {
+	pk, ok := n.peerKey(a.From, a.Height)
+	if !ok {
+		return fmt.Errorf("unknown sender %q", a.From)
+	}
+	if !ed25519.Verify(pk, authBytes(kind, a), a.MsgSig) {
+		return fmt.Errorf("bad %s signature from %s", kind, a.From)
+	}
+	n.witness(a.signed(kind))
+	return nil
+}
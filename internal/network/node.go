@@ -1,9 +1,9 @@
 package network
 
 import (
-	"bytes"
 	"crypto/ed25519"
-	"sort"
+	"crypto/tls"
+	"io"
 	"time"
 
 	"encoding/hex"
@@ -12,43 +12,15 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/mauzec/falcondb/internal/block"
 	"github.com/mauzec/falcondb/internal/incentive"
 )
 
-type prePrepareMsg struct {
-	Height int64             `json:"height"`
-	View   int64             `json:"view"`
-	Hdr    block.BlockHeader `json:"hdr"`
-}
-type prepareMsg struct {
-	Height int64  `json:"height"`
-	View   int64  `json:"view"`
-	Sig    []byte `json:"sig"`
-}
-type commitMsg struct {
-	Height int64  `json:"height"`
-	View   int64  `json:"view"`
-	Sig    []byte `json:"sig"`
-}
-
-var validatorSet = map[string]bool{"validator1": true, "validator2": true}
 var rpcClient = &http.Client{Timeout: 2 * time.Second}
 
-type ConsensusState struct {
-	mu          sync.Mutex
-	height      int64
-	view        int64
-	prePrep     *block.BlockHeader
-	prepares    map[string][]byte
-	commits     map[string][]byte
-	vcMsgs      map[string]int64
-	newViewMsgs map[string]block.BlockHeader
-	timer       *time.Timer
-}
-
 type Node struct {
 	ID        string
 	Port      int
@@ -60,7 +32,38 @@ type Node struct {
 	seen map[string]bool
 	mu   sync.Mutex
 
-	cons map[int64]*ConsensusState
+	// Transport, Clock and Ledger default to HTTP, wall time and the
+	// local chain; a simulation replaces them before choosing the engine.
+	Transport Transport
+	Clock     Clock
+	Ledger    Ledger
+	rng       *lockedRand
+
+	// Faults makes the node Byzantine on purpose, for adversarial tests.
+	Faults Fault
+	twins  map[string]block.Block // equivocating proposals by honest header hash
+
+	// StateSync lets a node with an empty chain install the state at its
+	// peers' tip instead of replaying every block.
+	StateSync bool
+
+	evidence evidencePool
+	peers    *peerTable // starts from PeerAddrs, grows by peer exchange
+	sync     syncer
+	pool     mempool             // client writes on their way to the primary
+	snap     snapshot            // last state snapshot served
+	ctr      *incentive.Contract // slashes offenders, nil until RegisterHandlers
+
+	tls       *tls.Config  // server side of mutual TLS, nil for plain HTTP
+	clientTLS *tls.Config  // client side of mutual TLS
+	client    *http.Client // node-to-node requests, rpcClient when nil
+
+	engine     Consensus
+	engineName string
+	commits    block.CommitRule // what a commit certificate needs, by engine
+	stats      msgStats
+	final      map[int64]block.Block // decided, waiting for the height below
+	commitMu   sync.Mutex            // orders commits of final blocks
 }
 
 func NewNode(id string, port int, peerAddrs map[string]string, peerPK map[string]ed25519.PublicKey) *Node {
@@ -68,7 +71,7 @@ func NewNode(id string, port int, peerAddrs map[string]string, peerPK map[string
 	// if err != nil {
 	// log.Fatalf("keygen failed: %v", err)
 	// }
-	return &Node{
+	n := &Node{
 		ID:        id,
 		Port:      port,
 		PeerAddrs: peerAddrs,
@@ -77,279 +80,68 @@ func NewNode(id string, port int, peerAddrs map[string]string, peerPK map[string
 		// SK:        sk,
 		seen: make(map[string]bool),
 
-		cons: make(map[int64]*ConsensusState),
-	}
-}
-
-func (n *Node) isPrimary(view int64) bool {
-	ids := make([]string, 0, len(validatorSet))
-	for id := range validatorSet {
-		ids = append(ids, id)
-	}
-	sort.Strings(ids)
-	return ids[view%int64(len(ids))] == n.ID
-}
-
-func (n *Node) broadcastPrePrepare(hdr block.BlockHeader) {
-	cs := n.getState(hdr.Height)
-	cs.mu.Lock()
-	cs.view = cs.view
-	cs.vcMsgs = make(map[string]int64)
-	cs.newViewMsgs = make(map[string]block.BlockHeader)
-	if cs.timer != nil {
-		cs.timer.Stop()
-	}
-	cs.timer = time.AfterFunc(2*time.Second, func() {
-		n.sendViewChange(hdr.Height)
-	})
-	cs.mu.Unlock()
-
-	log.Printf("[node %s] broadcastPrePrepare height=%d view=%d", n.ID, hdr.Height, cs.view)
-
-	msg := prePrepareMsg{hdr.Height, cs.view, hdr}
-	buf, _ := json.Marshal(msg)
-	for id, addr := range n.PeerAddrs {
-		if !validatorSet[id] {
-			continue
-		}
-		go func(addr string, hdrJSON []byte) {
-			rpcClient.Post(
-				"http://"+addr+"/consensus/preprepare",
-				"application/json",
-				bytes.NewReader(hdrJSON),
-			)
-		}(addr, buf)
-	}
-}
-
-func (n *Node) sendViewChange(height int64) {
-	cs := n.getState(height)
-	nextView := cs.view + 1
-	log.Printf("[node %s] sendViewChange height=%d view=%d", n.ID, height, nextView)
-
-	vc := struct{ Height, View int64 }{height, nextView}
-	buf, _ := json.Marshal(vc)
-	for id, addr := range n.PeerAddrs {
-		if validatorSet[id] {
-			go http.Post("http://"+addr+"/consensus/viewchange", "application/json", bytes.NewReader(buf))
-		}
-	}
-}
+		final: make(map[int64]block.Block),
+		peers: newPeerTable(id, peerAddrs),
 
-func (n *Node) handleViewChange(w http.ResponseWriter, r *http.Request) {
-	var vc struct{ Height, View int64 }
-	json.NewDecoder(r.Body).Decode(&vc)
-	log.Printf("[node %s] handleViewChange from=%s height=%d view=%d", n.ID, r.RemoteAddr, vc.Height, vc.View)
-
-	cs := n.getState(vc.Height)
-	cs.mu.Lock()
-	cs.vcMsgs[r.RemoteAddr] = vc.View
-	count := 0
-	for _, v := range cs.vcMsgs {
-		if v == vc.View {
-			count++
-		}
-	}
-	cs.mu.Unlock()
-
-	f := (len(validatorSet) - 1) / 3
-	if count >= f+1 && n.isPrimary(vc.View) {
-		nv := struct {
-			Height int64
-			View   int64
-			Hdr    block.BlockHeader
-		}{vc.Height, vc.View, *cs.prePrep}
-		buf, _ := json.Marshal(nv)
-		for id, addr := range n.PeerAddrs {
-			if validatorSet[id] {
-				go http.Post("http://"+addr+"/consensus/newview", "application/json", bytes.NewReader(buf))
-			}
-		}
-	}
-	w.WriteHeader(200)
-}
-
-// … обработчик new‐view
-func (n *Node) handleNewView(w http.ResponseWriter, r *http.Request) {
-	var nv struct {
-		Height int64
-		View   int64
-		Hdr    block.BlockHeader
-	}
-	json.NewDecoder(r.Body).Decode(&nv)
-
-	log.Printf("[node %s] handleNewView from=%s height=%d view=%d", n.ID, r.RemoteAddr, nv.Height, nv.View)
-
-	cs := n.getState(nv.Height)
-	cs.mu.Lock()
-	cs.newViewMsgs[r.RemoteAddr] = nv.Hdr
-	if len(cs.newViewMsgs) >= (len(validatorSet)-1)/3+1 {
-		go n.broadcastPrePrepare(nv.Hdr)
-	}
-	cs.mu.Unlock()
-	w.WriteHeader(200)
-}
-
-func (n *Node) handlePrePrepare(w http.ResponseWriter, r *http.Request) {
-	var msg prePrepareMsg
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-		http.Error(w, "bad preprepare", 400)
-		return
-	}
-
-	log.Printf("[node %s] handlePrePrepare height=%d view=%d", n.ID, msg.Height, msg.View)
-
-	cs := n.getState(msg.Height)
-	cs.mu.Lock()
-	if msg.View != cs.view {
-		cs.mu.Unlock()
-		return
+		Clock:  realClock{},
+		Ledger: chainLedger{},
 	}
-	if cs.timer != nil {
-		cs.timer.Stop()
-	}
-	cs.prePrep = &msg.Hdr
-	cs.mu.Unlock()
-
-	sig := block.SignMeta(msg.Hdr, n.SK)
-	p := prepareMsg{msg.Height, msg.View, sig}
-	buf, _ := json.Marshal(p)
-	for id, addr := range n.PeerAddrs {
-		if id == n.ID || !validatorSet[id] {
-			continue
-		}
-		go func(addr string, hdrJSON []byte) {
-			rpcClient.Post("http://"+addr+"/consensus/prepare", "application/json", bytes.NewReader(hdrJSON))
-		}(addr, buf)
-	}
-	w.WriteHeader(200)
+	n.Transport = newStreamTransport(n)
+	n.Seed(time.Now().UnixNano())
+	n.engine, n.engineName, n.commits = newPBFT(n), "pbft", block.Quorum
+	return n
 }
 
-func (n *Node) handlePrepare(w http.ResponseWriter, r *http.Request) {
-	var req prepareMsg
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "bad prepare", 400)
-		return
-	}
-
-	cs := n.getState(req.Height)
-	log.Printf("[node %s] handlePrepare height=%d view=%d prepares=%d", n.ID, req.Height, req.View, len(cs.prepares))
-
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	if req.View != cs.view {
-		return
-	}
-	cs.prepares[string(req.Sig)] = req.Sig
-	if len(cs.prepares) >= (len(validatorSet) * 2 / 3) {
-		if cs.commits == nil {
-			cs.commits = make(map[string][]byte)
-			sigC := block.SignMeta(*cs.prePrep, n.SK)
-			c := commitMsg{req.Height, req.View, sigC}
-			buf, _ := json.Marshal(c)
-			for id, addr := range n.PeerAddrs {
-				if id == n.ID || !validatorSet[id] {
-					continue
-				}
-				go func(addr string, hdrJSON []byte) {
-					rpcClient.Post("http://"+addr+"/consensus/commit", "application/json", bytes.NewReader(buf))
-				}(addr, buf)
-			}
-		}
-	}
-	w.WriteHeader(200)
-}
+func (n *Node) RegisterHandlers(mux *http.ServeMux, ctr *incentive.Contract) {
+	n.ctr = ctr
+	n.settle()
 
-func (n *Node) handleCommit(w http.ResponseWriter, r *http.Request) {
-	var req commitMsg
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "bad commit", 400)
-		return
-	}
+	// POST /consensus/{kind}: messages of the consensus engine
+	mux.HandleFunc("/consensus/", n.nodeOnly(n.handleConsensus))
+	mux.HandleFunc("/consensus/stats", n.handleStats)
 
-	cs := n.getState(req.Height)
-	log.Printf("[node %s] handleCommit height=%d view=%d commits=%d", n.ID, req.Height, req.View, len(cs.commits))
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	if req.View != cs.view {
-		return
-	}
-	cs.commits[string(req.Sig)] = req.Sig
-	if len(cs.commits) >= (len(validatorSet)*2/3) && cs.prePrep != nil {
-		chain := block.GetBlockchain()
-		blk := chain[cs.prePrep.Height-1]
-		block.ReplaceChain(append(chain, blk))
-		cs.prePrep = nil
-
-		bts, _ := json.Marshal(blk)
-		for _, addr := range n.PeerAddrs {
-			log.Printf("[node %s] broadcast h=%d → %s", n.ID, blk.Header.Height, addr)
-			go http.Post("http://"+addr+"/broadcast",
-				"application/json", bytes.NewReader(bts))
-		}
-	}
+	// GET /evidence: equivocations waiting for a block, slashed validators
+	mux.HandleFunc("/evidence", n.handleEvidence)
 
-	w.WriteHeader(200)
-}
+	// GET /headers and /blocks?from=H&count=N: committed headers and blocks for syncing peers
+	mux.HandleFunc("GET /headers", n.handleRange(syncHeaders))
+	mux.HandleFunc("GET /blocks", n.handleRange(syncBlocks))
 
-func (n *Node) getState(height int64) *ConsensusState {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	cs, ok := n.cons[height]
-	if !ok {
-		cs = &ConsensusState{height: height, prepares: map[string][]byte{}, commits: map[string][]byte{}}
-		n.cons[height] = cs
-	}
-	return cs
-}
+	// GET /snapshot?height=H and /snapshot/chunk?height=H&index=I: the state at H for state sync
+	mux.HandleFunc("GET /snapshot", n.handleSnapshot(syncManifest))
+	mux.HandleFunc("GET /snapshot/chunk", n.handleSnapshot(syncChunk))
 
-func (n *Node) RegisterHandlers(mux *http.ServeMux, ctr *incentive.Contract) {
+	// GET /stream: upgrades to the binary stream of a peer node
+	mux.HandleFunc("/stream", n.nodeOnly(n.handleStream))
 
-	mux.HandleFunc("/consensus/preprepare", n.handlePrePrepare)
-	mux.HandleFunc("/consensus/prepare", n.handlePrepare)
-	mux.HandleFunc("/consensus/commit", n.handleCommit)
-	mux.HandleFunc("/consensus/viewchange", n.handleViewChange)
-	mux.HandleFunc("/consensus/newview", n.handleNewView)
+	// GET /peers: this node and its peer table
+	mux.HandleFunc("/peers", n.handlePeers)
 
+	// GET /validators?height=H: active validator set at H (default: next height)
 	mux.HandleFunc("/validators", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[node %s] /validators from %s", n.ID, r.RemoteAddr)
 
-		m := make(map[string]string, len(n.PeerPK))
-		for id, pk := range n.PeerPK {
+		height := n.nextHeight()
+		if hq := r.URL.Query().Get("height"); hq != "" {
+			var err error
+			height, err = strconv.ParseInt(hq, 10, 64)
+			if err != nil {
+				http.Error(w, "bad height", 400)
+				return
+			}
+		}
+		vals := n.Ledger.ValidatorsAt(height)
+		m := make(map[string]string, len(vals))
+		for id, pk := range vals {
 			m[id] = hex.EncodeToString(pk)
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(m)
 	})
 
-	// 0) GET /sign
-	mux.HandleFunc("/sign", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[node %s] /sign from %s", n.ID, r.RemoteAddr)
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		if !validatorSet[n.ID] {
-			http.Error(w, "forbidden", http.StatusForbidden)
-			return
-		}
-
-		var hdr block.BlockHeader
-		if err := json.NewDecoder(r.Body).Decode(&hdr); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			return
-		}
-
-		sig := block.SignMeta(hdr, n.SK)
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Write(sig)
-
-		log.Printf("[node %s] signed header", n.ID)
-	})
-
 	mux.HandleFunc("/chain", func(w http.ResponseWriter, r *http.Request) {
 		// log.Printf("[node %s] /chain from %s", n.ID, r.RemoteAddr)
-		json.NewEncoder(w).Encode(block.GetBlockchain())
+		json.NewEncoder(w).Encode(n.ServedChain(block.GetBlockchain()))
 	})
 
 	mux.HandleFunc("/sum", func(w http.ResponseWriter, r *http.Request) {
@@ -373,8 +165,7 @@ func (n *Node) RegisterHandlers(mux *http.ServeMux, ctr *incentive.Contract) {
 			}
 
 		} else {
-			chain := block.GetBlockchain()
-			height = block.GetBlockchain()[len(chain)-1].Header.Height
+			height = block.Tip().Header.Height
 		}
 
 		val, proof, err := block.QueryADS(key, height)
@@ -389,108 +180,258 @@ func (n *Node) RegisterHandlers(mux *http.ServeMux, ctr *incentive.Contract) {
 		}
 
 		rootAtH := block.GetADSRootAt(height)
+		if n.Faults&FaultLieQuery != 0 {
+			val, proof = lie(val, proof)
+		}
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"value": val,
-			"proof": proof,
-			"root":  rootAtH,
+			"value":   val,
+			"proof":   proof,
+			"root":    rootAtH,
+			"version": block.VersionOf(key, height),
 		})
 
 		log.Printf("[node %s] /query responded valueLen=%d proofLen=%d", n.ID, len(val), len(proof))
 	})
 
-	mux.HandleFunc("/addblock", func(w http.ResponseWriter, r *http.Request) {
-		if !validatorSet[n.ID] {
-			http.Error(w, "forbidden", http.StatusForbidden)
+	// GET /block/{h}/rwset: the read/write log committed by the header's RWHash
+	mux.HandleFunc("GET /block/{h}/rwset", func(w http.ResponseWriter, r *http.Request) {
+		h, err := strconv.ParseInt(r.PathValue("h"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad height", 400)
 			return
 		}
-		k, v := r.URL.Query().Get("key"), []byte(r.URL.Query().Get("value"))
-		log.Printf("[node %s] /addblock key=%s value=%s", n.ID, k, v)
+		log.Printf("[node %s] /block/%d/rwset from %s", n.ID, h, r.RemoteAddr)
 
-		// service fee
-		if err := ctr.PayService(n.ID); err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
+		raw, err := block.GetRWLog(h)
+		if err != nil {
+			http.Error(w, "no rw log at this height", http.StatusNotFound)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+	})
 
-		chain := block.GetBlockchain()
-		prev := chain[len(chain)-1]
-		blk, err := block.NewBlock(prev, block.Operation{Key: k, Value: v}, n.PK)
+	// GET /key/{k}/blocks: heights and block hashes where key k changed
+	mux.HandleFunc("GET /key/{k}/blocks", func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("k")
+		log.Printf("[node %s] /key/%s/blocks from %s", n.ID, key, r.RemoteAddr)
+
+		changes, err := block.KeyHistory(key)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		blk.Header.Signature = block.SignMeta(blk.Header, n.SK)
-		blk.Header.Validators = []string{n.ID}
-		blk.Header.Signatures = [][]byte{blk.Header.Signature}
-
-		buf := new(bytes.Buffer)
-		if err := json.NewEncoder(buf).Encode(blk.Header); err != nil {
-			http.Error(w, "encode header", http.StatusInternalServerError)
-			return
+		if changes == nil {
+			changes = []block.KeyChange{}
 		}
-		go n.broadcastPrePrepare(blk.Header)
-
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(changes)
 	})
 
-	mux.HandleFunc("/broadcast", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[node %s] /broadcast from %s", n.ID, r.RemoteAddr)
+	// GET /subscribe?[from=H][&key=K ...][&prefix=P ...]: committed blocks and key changes as server-sent events
+	mux.HandleFunc("GET /subscribe", n.handleSubscribe)
 
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
+	// GET /receipt?tx=ID|nonce=REQ[&wait=1]: commit certificate, inclusion and ADS proof of tx,
+	// or of the write a 202 answered with its request id
+	mux.HandleFunc("/receipt", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		ref := receiptRef{"tx", q.Get("tx")}
+		if ref.id == "" {
+			ref = receiptRef{"nonce", q.Get("nonce")}
 		}
-		var blk block.Block
-		if err := json.NewDecoder(r.Body).Decode(&blk); err != nil {
-			http.Error(w, "bad payload", http.StatusBadRequest)
+		log.Printf("[node %s] /receipt %s=%s from %s", n.ID, ref.by, ref.id, r.RemoteAddr)
+		if ref.id == "" {
+			http.Error(w, "missing tx or nonce", http.StatusBadRequest)
 			return
 		}
-
-		if !block.VerifySig(blk.Header.Initiator, blk.Header, blk.Header.Signature) {
-			http.Error(w, "invalid initiator signature", http.StatusBadRequest)
-			return
+		var wait time.Duration
+		if q.Get("wait") != "" {
+			wait = receiptWait
 		}
+		writeReceipt(w, ref, wait)
+	})
 
-		if len(blk.Header.Validators) != len(blk.Header.Signatures) {
-			http.Error(w, "validator/signature count mismatch", http.StatusBadRequest)
+	// /addblock?key=K&value=V[&type=T][&wait=1][&if_absent=1][&if_version=VF][&guard=KEY:VF|KEY:absent|KEY:exists ...]
+	// if_version=0 and KEY:0 ask for an absent key, the version /query reports for one
+	mux.HandleFunc("/addblock", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		k, v := q.Get("key"), []byte(q.Get("value"))
+		log.Printf("[node %s] /addblock type=%s key=%s value=%s", n.ID, q.Get("type"), k, v)
+
+		if block.ReservedKey(k) {
+			http.Error(w, "key "+k+" is reserved", http.StatusBadRequest)
 			return
 		}
-		for i, peerID := range blk.Header.Validators {
-			sig := blk.Header.Signatures[i]
-			pk, ok := n.PeerPK[peerID]
-			if !ok {
-				http.Error(w, fmt.Sprintf("unknown validator %s", peerID), http.StatusBadRequest)
+		op := block.Operation{Type: q.Get("type"), Key: k, Value: v}
+		if q.Get("if_absent") != "" {
+			op.If = append(op.If, block.Condition{Key: k, Absent: true})
+		}
+		if vq := q.Get("if_version"); vq != "" {
+			vf, err := strconv.ParseInt(vq, 10, 64)
+			if err != nil {
+				http.Error(w, "bad if_version", http.StatusBadRequest)
 				return
 			}
-			if !block.VerifySig(pk, blk.Header, sig) {
-				http.Error(w, fmt.Sprintf("invalid signature from validator %s", peerID), http.StatusBadRequest)
+			op.If = append(op.If, block.Condition{Key: k, Version: vf})
+		}
+		for _, g := range q["guard"] {
+			c, err := block.ParseCondition(g)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			op.If = append(op.If, c)
 		}
+		n.propose(w, r, op)
+	})
 
-		bid := block.BlockHash(blk)
-		n.mu.Lock()
-		if n.seen[bid] {
-			n.mu.Unlock()
-			w.WriteHeader(http.StatusOK)
+	// /reconfig?action=add|remove|rotate&id=ID&pk=HEX&nonce=N&approval=ID:SIGHEX...
+	// or POST /reconfig with the JSON update. A quorum of the active
+	// validators must have approved it (block.ValidatorUpdate.Approve).
+	mux.HandleFunc("/reconfig", func(w http.ResponseWriter, r *http.Request) {
+		var upd block.ValidatorUpdate
+		if r.Method == http.MethodPost {
+			if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+				http.Error(w, "bad update", http.StatusBadRequest)
+				return
+			}
+		} else {
+			q := r.URL.Query()
+			upd = block.ValidatorUpdate{Action: q.Get("action"), ID: q.Get("id"), Nonce: q.Get("nonce")}
+			if pk := q.Get("pk"); pk != "" {
+				b, err := hex.DecodeString(pk)
+				if err != nil {
+					http.Error(w, "bad pk", http.StatusBadRequest)
+					return
+				}
+				upd.PK = ed25519.PublicKey(b)
+			}
+			for _, a := range q["approval"] {
+				id, sigHex, _ := strings.Cut(a, ":")
+				sig, err := hex.DecodeString(sigHex)
+				if err != nil || id == "" {
+					http.Error(w, "bad approval", http.StatusBadRequest)
+					return
+				}
+				if upd.Approvals == nil {
+					upd.Approvals = map[string][]byte{}
+				}
+				upd.Approvals[id] = sig
+			}
+		}
+		log.Printf("[node %s] /reconfig action=%s id=%s approvals=%d", n.ID, upd.Action, upd.ID, len(upd.Approvals))
+		if err := upd.CheckApprovals(n.Ledger.ValidatorsAt(n.nextHeight())); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
-		n.seen[bid] = true
-		n.mu.Unlock()
+		n.propose(w, r, block.Operation{Validator: &upd})
+	})
 
-		if err := block.ApplyOperation(blk); err != nil {
+	mux.HandleFunc("/broadcast", n.nodeOnly(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("[node %s] /broadcast from %s", n.ID, r.RemoteAddr)
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		chain := block.GetBlockchain()
-		block.ReplaceChain(append(chain, blk))
-
+		if err := n.applyBlock(body); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
+	}))
 
-		log.Printf("[node %s] /broadcast applied block height=%d", n.ID, blk.Header.Height)
-	})
+}
+
+// propose accepts a client write on any node. It is queued in the
+// mempool, which routes it to the primary, or proposes it when this node
+// is the primary. The answer comes once the write is committed: the
+// transaction id and height, or the receipt when the request has wait=1.
+func (n *Node) propose(w http.ResponseWriter, r *http.Request, op block.Operation) {
+	e, err := n.submitTx(op)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	n.awaitTx(w, r, e)
+}
 
+// newProposal builds and signs a block for op on top of prev, executing
+// it on the ADS. The block carries the pending equivocation evidence
+// besides any op brought along.
+func (n *Node) newProposal(prev block.Block, op block.Operation) (block.Block, error) {
+	op.Evidence = n.withEvidence(op.Evidence)
+	twin, equivocate := n.twinOf(prev, op)
+	blk, err := n.signedBlock(prev, op)
+	if err != nil {
+		return block.Block{}, err
+	}
+	if equivocate {
+		n.keepTwin(blk, twin)
+	}
+	return blk, nil
+}
+
+// signedBlock executes op on top of prev under a fresh nonce, which keeps
+// equal operations distinct, and signs the header. A write from the
+// mempool keeps its nonce, the request id its block is recognised by.
+func (n *Node) signedBlock(prev block.Block, op block.Operation) (block.Block, error) {
+	if op.Nonce == "" {
+		nonce := make([]byte, 8)
+		n.rng.Read(nonce)
+		op.Nonce = hex.EncodeToString(nonce)
+	}
+
+	blk, err := n.Ledger.NewBlock(prev, op, n.PK)
+	if err != nil {
+		return block.Block{}, reject(http.StatusInternalServerError, "%v", err)
+	}
+	blk.Header.Signature = block.SignMeta(blk.Header, n.SK)
+	return blk, nil
+}
+
+const receiptWait = 10 * time.Second
+
+// receiptRef names a transaction by its id (by "tx") or by the request id
+// of its write (by "nonce").
+type receiptRef struct {
+	by, id string
+}
+
+func (ref receiptRef) tx() string {
+	if ref.by == "tx" {
+		return ref.id
+	}
+	tx, _ := block.TxOfNonce(ref.id)
+	return tx
+}
+
+// writeReceipt answers with the receipt of ref, waiting up to wait for it
+// to be committed. A tx that is not final yet gets 202 with its reference.
+func writeReceipt(w http.ResponseWriter, ref receiptRef, wait time.Duration) {
+	deadline := time.After(wait)
+	for {
+		next := block.Committed()
+		if rc, err := block.GetReceipt(ref.tx()); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(rc)
+			return
+		}
+		select {
+		case <-next:
+		case <-deadline:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{ref.by: ref.id})
+			return
+		}
+	}
 }
 
 func (n *Node) StartServer() {
@@ -502,24 +443,16 @@ func (n *Node) StartServer() {
 	ctr.MountHTTP(mux)
 
 	n.RegisterHandlers(mux, ctr)
+	n.StartMembership()
 
-	go func() {
-		ticker := time.NewTicker(2 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			for id, addr := range n.PeerAddrs {
-				if id == n.ID {
-					continue
-				}
-				url := "http://" + addr
-				if err := block.SyncChainFromPeer(url); err == nil {
-					// log.Printf("[node %s]  sync from %s", n.ID, addr)
-				}
-			}
-		}
-	}()
+	n.StartSync()
+	n.StartMempool()
 
 	addr := fmt.Sprintf("127.0.0.1:%d", n.Port)
 	log.Printf("[Node %s] listening on %s", n.ID, addr)
+	if n.tls != nil {
+		srv := &http.Server{Addr: addr, Handler: mux, TLSConfig: n.tls}
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
 	log.Fatal(http.ListenAndServe(addr, mux))
 }
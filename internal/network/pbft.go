@@ -0,0 +1,824 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// viewTimeout is the first round timeout of a height; every view change
+// at the same height doubles it, up to maxBackoff doublings.
+const (
+	viewTimeout = 2 * time.Second
+	maxBackoff  = 5
+)
+
+// pbft is the PBFT engine: pre-prepare, prepare and commit per height,
+// all-to-all votes, view changes carrying prepared certificates, a
+// bounded pipeline of heights and a write-ahead log.
+type pbft struct {
+	*Node
+
+	mu         sync.Mutex
+	cons       map[int64]*ConsensusState
+	stableView int64      // view the last height was decided in
+	wal        *wal       // nil until Recover
+	propMu     sync.Mutex // orders proposals built on one another
+}
+
+func newPBFT(n *Node) Consensus {
+	return &pbft{Node: n, cons: make(map[int64]*ConsensusState)}
+}
+
+func (p *pbft) OnMessage(kind string, body []byte) error {
+	switch kind {
+	case kindPrePrepare:
+		return p.onPrePrepare(body)
+	case kindPrepare:
+		return p.onPrepare(body)
+	case kindCommit:
+		return p.onCommit(body)
+	case kindViewChange:
+		return p.onViewChange(body)
+	case kindNewView:
+		return p.onNewView(body)
+	}
+	return reject(http.StatusNotFound, "pbft: unknown message %q", kind)
+}
+
+// Leader is the primary of the next height this node would propose.
+func (p *pbft) Leader() string {
+	height := p.Ledger.ProposalTip().Header.Height + 1
+	view, _ := p.currentView(height)
+	leader := p.primaryOf(height, view)
+	if leader != p.ID {
+		p.expectProposal(height)
+	}
+	return leader
+}
+
+// Propose builds a block for op on top of this node's latest proposal,
+// up to PipelineWindow heights above the committed tip, executes it
+// speculatively and pre-prepares it.
+func (p *pbft) Propose(op block.Operation) (block.Block, error) {
+	p.propMu.Lock()
+	defer p.propMu.Unlock()
+
+	prev := p.Ledger.ProposalTip()
+	height := prev.Header.Height + 1
+	tip := p.nextHeight() - 1
+	if height-tip > PipelineWindow {
+		return block.Block{}, reject(http.StatusServiceUnavailable, "pipeline full")
+	}
+	// the validator set of a new epoch depends on the blocks before it
+	if height > tip+1 && height%block.EpochLength == 0 {
+		return block.Block{}, reject(http.StatusServiceUnavailable, "waiting for epoch %d", height)
+	}
+	view, changing := p.currentView(height)
+	if changing {
+		return block.Block{}, reject(http.StatusServiceUnavailable, "view change in progress")
+	}
+	if primary := p.primaryOf(height, view); primary != p.ID {
+		p.expectProposal(height)
+		return block.Block{}, reject(http.StatusMisdirectedRequest, "not primary, primary is %s", primary)
+	}
+
+	blk, err := p.newProposal(prev, op)
+	if err != nil {
+		return block.Block{}, err
+	}
+	if err := p.broadcastPrePrepare(blk); err != nil {
+		p.Ledger.DropProposal(blk.Header.Height)
+		return block.Block{}, reject(http.StatusConflict, "%v", err)
+	}
+	return blk, nil
+}
+
+// ConsensusState is the PBFT instance of one height.
+type ConsensusState struct {
+	mu         sync.Mutex
+	height     int64
+	view       int64
+	startView  int64 // view the height started in, base of the backoff
+	prePrep    *block.Block
+	prepares   *voteSet
+	commits    *voteSet
+	commitSent bool
+	decided    bool
+	prepared   *preparedCert // highest-view certificate this node prepared
+	changing   bool          // sent a view change, waiting for the new view
+	vcMsgs     map[int64]map[string]viewChangeMsg
+	nvSent     map[int64]bool
+	newView    *newViewMsg // the last new view this node sent as primary
+	retried    bool        // this node's messages of the view were resent
+	timer      Timer
+	armed      bool
+	waiting    *prePrepareMsg   // pre-prepare whose parent is not known yet
+	abandoned  *block.Operation // client write of the proposal a view change dropped
+}
+
+// preparedCert proves that a quorum of validators prepared Block in View.
+type preparedCert struct {
+	View     int64             `json:"view"`
+	Block    block.Block       `json:"block"`
+	Prepares map[string][]byte `json:"prepares"`
+}
+
+func (pc *preparedCert) verify(height int64, vals block.ValidatorSet) error {
+	hdr := pc.Block.Header
+	if hdr.Height != height {
+		return fmt.Errorf("prepared block at height %d, want %d", hdr.Height, height)
+	}
+	if sum := sha256.Sum256(pc.Block.Content); !bytes.Equal(sum[:], hdr.ContentHash) {
+		return fmt.Errorf("prepared block does not match its header")
+	}
+	valid := 0
+	for id, sig := range pc.Prepares {
+		if pk, ok := vals[id]; ok && block.VerifySig(pk, hdr, sig) {
+			valid++
+		}
+	}
+	if valid < block.Quorum(len(vals)) {
+		return fmt.Errorf("prepared certificate has %d of %d prepares", valid, block.Quorum(len(vals)))
+	}
+	return nil
+}
+
+// preparedDigest binds a view change signature to its certificate.
+func preparedDigest(pc *preparedCert) []byte {
+	if pc == nil {
+		return nil
+	}
+	b, _ := json.Marshal(struct {
+		View int64  `json:"view"`
+		Hash []byte `json:"hash"`
+	}{pc.View, block.HashHeader(pc.Block.Header)})
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+// highestPrepared picks the certificate of the highest view, if any.
+func highestPrepared(vcs []viewChangeMsg) *preparedCert {
+	var best *preparedCert
+	for i := range vcs {
+		if pc := vcs[i].Prepared; pc != nil && (best == nil || pc.View > best.View) {
+			best = pc
+		}
+	}
+	return best
+}
+
+func (p *pbft) primaryOf(height, view int64) string {
+	ids := p.Ledger.ValidatorsAt(height).IDs()
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[view%int64(len(ids))]
+}
+
+func (p *pbft) isPrimary(height, view int64) bool {
+	return p.primaryOf(height, view) == p.ID
+}
+
+func (p *pbft) getState(height int64) *ConsensusState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cs, ok := p.cons[height]
+	if !ok {
+		cs = &ConsensusState{
+			height:    height,
+			view:      p.stableView,
+			startView: p.stableView,
+			prepares:  newVoteSet(block.VerifySig),
+			commits:   newVoteSet(block.VerifyCommitSig),
+			vcMsgs:    map[int64]map[string]viewChangeMsg{},
+			nvSent:    map[int64]bool{},
+		}
+		p.cons[height] = cs
+	}
+	return cs
+}
+
+// newRound forgets the votes of the previous view. cs.mu must be held.
+func (cs *ConsensusState) newRound() {
+	cs.prePrep = nil
+	cs.prepares = newVoteSet(block.VerifySig)
+	cs.commits = newVoteSet(block.VerifyCommitSig)
+	cs.commitSent = false
+	cs.retried = false
+}
+
+// header is the pre-prepared header, nil until it arrives. cs.mu must be held.
+func (cs *ConsensusState) header() *block.BlockHeader {
+	if cs.prePrep == nil {
+		return nil
+	}
+	return &cs.prePrep.Header
+}
+
+// armTimer (re)starts the round timeout with exponential backoff. cs.mu
+// must be held.
+func (p *pbft) armTimer(cs *ConsensusState) {
+	p.stopTimer(cs)
+	shift := cs.view - cs.startView
+	if shift > maxBackoff {
+		shift = maxBackoff
+	}
+	h, v := cs.height, cs.view
+	cs.timer = p.Clock.AfterFunc(viewTimeout<<uint(shift), func() { p.OnTimeout(h, v) })
+	cs.armed = true
+}
+
+func (p *pbft) stopTimer(cs *ConsensusState) {
+	if cs.timer != nil {
+		cs.timer.Stop()
+	}
+	cs.armed = false
+}
+
+func (p *pbft) OnTimeout(height, view int64) {
+	cs := p.getState(height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.decided || cs.view != view || p.nextHeight() > height {
+		return
+	}
+	log.Printf("[node %s] timeout height=%d view=%d", p.ID, height, view)
+	// A lost message costs one retransmission rather than a view change.
+	// Without a quorum of view changes for this view, moving on would
+	// leave this node alone in the next one: it keeps asking instead.
+	vals := p.Ledger.ValidatorsAt(height)
+	stuck := cs.changing && len(cs.vcMsgs[view]) < block.Quorum(len(vals))
+	if stuck || (!cs.retried && (cs.changing || cs.prePrep != nil)) {
+		cs.retried = true
+		p.resend(cs)
+		p.armTimer(cs)
+		return
+	}
+	p.startViewChange(cs, view+1)
+}
+
+// resend multicasts again what this node sent in the current view: its
+// view change while that is under way, otherwise the proposal when it is
+// the primary and its votes. cs.mu must be held.
+func (p *pbft) resend(cs *ConsensusState) {
+	if cs.changing {
+		if vc, ok := cs.vcMsgs[cs.view][p.ID]; ok {
+			p.multicast(cs.height, kindViewChange, vc)
+		}
+		return
+	}
+	if cs.prePrep == nil {
+		return
+	}
+	digest := block.HashHeader(cs.prePrep.Header)
+	if p.isPrimary(cs.height, cs.view) {
+		nv := cs.newView
+		if nv != nil && nv.View == cs.view {
+			p.multicast(cs.height, kindNewView, *nv)
+		}
+		if nv == nil || nv.View != cs.view || nv.Block == nil {
+			p.multicast(cs.height, kindPrePrepare,
+				prePrepareMsg{p.auth(kindPrePrepare, cs.height, cs.view, digest), *cs.prePrep})
+		}
+	}
+	if sig, ok := cs.prepares.votes[p.ID]; ok {
+		p.multicast(cs.height, kindPrepare, prepareMsg{p.auth(kindPrepare, cs.height, cs.view, digest), sig})
+	}
+	if sig, ok := cs.commits.votes[p.ID]; ok && cs.commitSent {
+		p.multicast(cs.height, kindCommit, commitMsg{p.auth(kindCommit, cs.height, cs.view, digest), sig})
+	}
+}
+
+// expectProposal arms the timer of height when a client write reached a
+// backup, so that a dead primary is replaced.
+func (p *pbft) expectProposal(height int64) {
+	cs := p.getState(height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !cs.decided && !cs.armed && cs.prePrep == nil {
+		p.armTimer(cs)
+	}
+}
+
+// currentView returns the view of height and whether a view change is
+// under way.
+func (p *pbft) currentView(height int64) (int64, bool) {
+	cs := p.getState(height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.view, cs.changing
+}
+
+// broadcastPrePrepare proposes blk in the current view. It refuses when
+// this node is not the primary or already pre-prepared another block in
+// the view, so that a primary never proposes twice.
+func (p *pbft) broadcastPrePrepare(blk block.Block) error {
+	cs := p.getState(blk.Header.Height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	switch {
+	case cs.changing || !p.isPrimary(cs.height, cs.view):
+		return fmt.Errorf("not primary of view %d", cs.view)
+	case cs.prePrep != nil:
+		return fmt.Errorf("view %d already has a proposal", cs.view)
+	}
+	log.Printf("[node %s] broadcastPrePrepare height=%d view=%d", p.ID, blk.Header.Height, cs.view)
+
+	p.acceptPrePrepare(cs, blk)
+	digest := block.HashHeader(blk.Header)
+	p.multicast(cs.height, kindPrePrepare,
+		prePrepareMsg{p.auth(kindPrePrepare, cs.height, cs.view, digest), blk})
+	return nil
+}
+
+func (p *pbft) onPrePrepare(body []byte) error {
+	var msg prePrepareMsg
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return fmt.Errorf("bad preprepare: %w", err)
+	}
+	if err := p.verifyAuth(kindPrePrepare, msg.msgAuth); err != nil {
+		return reject(http.StatusUnauthorized, "%v", err)
+	}
+	log.Printf("[node %s] handlePrePrepare from=%s height=%d view=%d", p.ID, msg.From, msg.Height, msg.View)
+
+	if msg.From != p.primaryOf(msg.Height, msg.View) {
+		return reject(http.StatusForbidden, "preprepare from non-primary")
+	}
+	if err := checkProposal(msg.Block, msg.Height, msg.Digest); err != nil {
+		return err
+	}
+
+	if msg.Height >= p.nextHeight()+PipelineWindow {
+		return reject(http.StatusServiceUnavailable, "height beyond pipeline window")
+	}
+	links := p.linksToParent(msg.Block)
+
+	cs := p.getState(msg.Height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if msg.View != cs.view || cs.changing || cs.decided {
+		return nil
+	}
+	if !links {
+		// the parent's pre-prepare may still be on its way
+		cs.waiting = &msg
+		return nil
+	}
+	p.acceptPrePrepare(cs, msg.Block)
+	return nil
+}
+
+// checkProposal validates a proposed block against its height and digest.
+func checkProposal(blk block.Block, height int64, digest []byte) error {
+	hdr := blk.Header
+	if !bytes.Equal(digest, block.HashHeader(hdr)) {
+		return fmt.Errorf("digest does not match block")
+	}
+	if sum := sha256.Sum256(blk.Content); hdr.Height != height || !bytes.Equal(sum[:], hdr.ContentHash) {
+		return fmt.Errorf("block does not match header")
+	}
+	if len(hdr.Initiator) != ed25519.PublicKeySize || !block.VerifySig(hdr.Initiator, hdr, hdr.Signature) {
+		return fmt.Errorf("invalid initiator signature")
+	}
+	return nil
+}
+
+// acceptPrePrepare makes blk the proposal of the current view and sends
+// this node's prepare. cs.mu must be held.
+func (p *pbft) acceptPrePrepare(cs *ConsensusState, blk block.Block) {
+	hdr := blk.Header
+	if cs.prePrep != nil {
+		if !bytes.Equal(block.HashHeader(cs.prePrep.Header), block.HashHeader(hdr)) {
+			log.Printf("[node %s] conflicting preprepare height=%d view=%d", p.ID, cs.height, cs.view)
+		}
+		return
+	}
+	vals := p.Ledger.ValidatorsAt(cs.height)
+	p.logState(walRecord{Kind: walPrePrepare, Height: cs.height, View: cs.view, Block: &blk})
+	cs.prePrep = &blk
+	sig := block.SignMeta(hdr, p.SK)
+	p.logState(walRecord{Kind: walPrepare, Height: cs.height, View: cs.view, Sig: sig})
+	cs.prepares.add(p.ID, sig, &hdr, vals)
+	cs.prepares.resolve(hdr, vals)
+	cs.commits.resolve(hdr, vals)
+	p.armTimer(cs)
+
+	p.multicast(cs.height, kindPrepare,
+		prepareMsg{p.auth(kindPrepare, cs.height, cs.view, block.HashHeader(hdr)), sig})
+	p.maybeCommit(cs)
+	p.Clock.AfterFunc(0, func() { p.advance(cs.height + 1) })
+}
+
+func (p *pbft) onPrepare(body []byte) error {
+	var req prepareMsg
+	if err := json.Unmarshal(body, &req); err != nil {
+		return fmt.Errorf("bad prepare: %w", err)
+	}
+	if err := p.verifyAuth(kindPrepare, req.msgAuth); err != nil {
+		return reject(http.StatusUnauthorized, "%v", err)
+	}
+
+	cs := p.getState(req.Height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	log.Printf("[node %s] handlePrepare height=%d view=%d from=%s prepares=%d", p.ID, req.Height, req.View, req.From, cs.prepares.count())
+
+	// while the new view is on its way, votes of that view wait in pending
+	if req.View != cs.view {
+		return nil
+	}
+	if cs.prepares.add(req.From, req.Sig, cs.header(), p.Ledger.ValidatorsAt(req.Height)) {
+		p.maybeCommit(cs)
+	}
+	return nil
+}
+
+// maybeCommit sends this node's commit vote once the block is prepared
+// (pre-prepare known and block.Quorum prepares from distinct validators,
+// ⌈(n+f+1)/2⌉ with f = (n-1)/3, which is 2f+1 when n = 3f+1) and the
+// block below it is final. A block whose
+// parent lost is abandoned instead. cs.mu must be held.
+func (p *pbft) maybeCommit(cs *ConsensusState) {
+	if cs.commitSent || cs.prePrep == nil {
+		return
+	}
+	parent, final := p.parentHash(cs.height)
+	if final && !bytes.Equal(parent, cs.prePrep.Header.PrevHash) {
+		p.orphan(cs)
+		return
+	}
+	vals := p.Ledger.ValidatorsAt(cs.height)
+	if cs.prepares.count() < block.Quorum(len(vals)) {
+		return
+	}
+	if cs.prepared == nil || cs.prepared.View < cs.view {
+		prepares := make(map[string][]byte, cs.prepares.count())
+		for id, sig := range cs.prepares.votes {
+			prepares[id] = sig
+		}
+		cs.prepared = &preparedCert{View: cs.view, Block: *cs.prePrep, Prepares: prepares}
+	}
+	if !final {
+		return
+	}
+
+	sigC := block.SignCommit(cs.prePrep.Header, p.SK)
+	p.logState(walRecord{Kind: walCommit, Height: cs.height, View: cs.view, Sig: sigC, Prepared: cs.prepared})
+	cs.commitSent = true
+	cs.commits.add(p.ID, sigC, cs.header(), vals)
+
+	p.multicast(cs.height, kindCommit,
+		commitMsg{p.auth(kindCommit, cs.height, cs.view, block.HashHeader(cs.prePrep.Header)), sigC})
+	p.tryFinalize(cs)
+}
+
+func (p *pbft) onCommit(body []byte) error {
+	var req commitMsg
+	if err := json.Unmarshal(body, &req); err != nil {
+		return fmt.Errorf("bad commit: %w", err)
+	}
+	if err := p.verifyAuth(kindCommit, req.msgAuth); err != nil {
+		return reject(http.StatusUnauthorized, "%v", err)
+	}
+
+	cs := p.getState(req.Height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	log.Printf("[node %s] handleCommit height=%d view=%d from=%s commits=%d", p.ID, req.Height, req.View, req.From, cs.commits.count())
+
+	if req.View != cs.view {
+		return nil
+	}
+	vals := p.Ledger.ValidatorsAt(req.Height)
+	if !vals.Has(req.From) {
+		return reject(400, "unknown validator")
+	}
+	if cs.commits.add(req.From, req.Sig, cs.header(), vals) {
+		p.tryFinalize(cs)
+	}
+	return nil
+}
+
+// tryFinalize attaches the commit certificate to the pre-prepared block
+// once a quorum of valid commit signatures is collected and hands it to
+// deliver. cs.mu must be held.
+func (p *pbft) tryFinalize(cs *ConsensusState) {
+	if cs.prePrep == nil || cs.decided || !cs.commitSent {
+		return
+	}
+	vals := p.Ledger.ValidatorsAt(cs.height)
+	if cs.commits.count() < block.Quorum(len(vals)) {
+		return
+	}
+	blk := *cs.prePrep
+	blk.Header.Validators, blk.Header.Signatures = cs.commits.certificate(vals)
+	cs.decided = true
+	p.stopTimer(cs)
+
+	p.mu.Lock()
+	if cs.view > p.stableView {
+		p.stableView = cs.view
+	}
+	p.mu.Unlock()
+
+	p.deliver(blk)
+	p.compactWAL()
+	p.Clock.AfterFunc(0, func() { p.advance(cs.height + 1) })
+}
+
+// startViewChange moves this node to view v and asks the other validators
+// to do the same, carrying its prepared certificate. cs.mu must be held.
+func (p *pbft) startViewChange(cs *ConsensusState, v int64) {
+	if v <= cs.view || cs.decided {
+		return
+	}
+	log.Printf("[node %s] sendViewChange height=%d view=%d", p.ID, cs.height, v)
+	p.logState(walRecord{Kind: walViewChange, Height: cs.height, View: v})
+	cs.view = v
+	cs.changing = true
+	if cs.prePrep != nil {
+		var op block.Operation
+		if json.Unmarshal(cs.prePrep.Content, &op) == nil && op.Type != block.OpNoop {
+			op.Evidence = nil // a new proposal carries what is still pending
+			cs.abandoned = &op
+		}
+	}
+	cs.newRound()
+	p.Ledger.DropProposal(cs.height)
+
+	vc := viewChangeMsg{p.auth(kindViewChange, cs.height, v, preparedDigest(cs.prepared)), cs.prepared}
+	p.recordViewChange(cs, vc)
+	p.multicast(cs.height, kindViewChange, vc)
+	p.armTimer(cs)
+	p.maybeNewView(cs, v)
+}
+
+func (p *pbft) recordViewChange(cs *ConsensusState, vc viewChangeMsg) {
+	if cs.vcMsgs[vc.View] == nil {
+		cs.vcMsgs[vc.View] = map[string]viewChangeMsg{}
+	}
+	cs.vcMsgs[vc.View][vc.From] = vc
+}
+
+// checkViewChange validates the prepared certificate a view change carries.
+func checkViewChange(vc viewChangeMsg, vals block.ValidatorSet) error {
+	if !vals.Has(vc.From) {
+		return fmt.Errorf("view change from non-validator %s", vc.From)
+	}
+	if !bytes.Equal(vc.Digest, preparedDigest(vc.Prepared)) {
+		return fmt.Errorf("view change digest does not match certificate")
+	}
+	if vc.Prepared == nil {
+		return nil
+	}
+	if vc.Prepared.View >= vc.View {
+		return fmt.Errorf("certificate view %d not below %d", vc.Prepared.View, vc.View)
+	}
+	return vc.Prepared.verify(vc.Height, vals)
+}
+
+func (p *pbft) onViewChange(body []byte) error {
+	var vc viewChangeMsg
+	if err := json.Unmarshal(body, &vc); err != nil {
+		return fmt.Errorf("bad viewchange: %w", err)
+	}
+	if err := p.verifyAuth(kindViewChange, vc.msgAuth); err != nil {
+		return reject(http.StatusUnauthorized, "%v", err)
+	}
+	vals := p.Ledger.ValidatorsAt(vc.Height)
+	if err := checkViewChange(vc, vals); err != nil {
+		return err
+	}
+	log.Printf("[node %s] handleViewChange from=%s height=%d view=%d prepared=%v", p.ID, vc.From, vc.Height, vc.View, vc.Prepared != nil)
+
+	cs := p.getState(vc.Height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.decided || vc.View < cs.view {
+		return nil
+	}
+	p.recordViewChange(cs, vc)
+	if nv := cs.newView; nv != nil && nv.View == vc.View && !cs.changing && vc.From != p.ID {
+		// it missed the new view
+		p.send(vc.From, kindNewView, *nv)
+	}
+
+	// join once f+1 validators moved past our view: one of them is correct
+	if vc.View > cs.view {
+		ahead := map[string]bool{}
+		target := vc.View
+		for v, msgs := range cs.vcMsgs {
+			if v <= cs.view {
+				continue
+			}
+			for from := range msgs {
+				ahead[from] = true
+			}
+			if v < target {
+				target = v
+			}
+		}
+		if len(ahead) >= (len(vals)-1)/3+1 {
+			p.startViewChange(cs, target)
+		} else if !cs.armed {
+			// someone is waiting on this height: time the primary out too
+			p.armTimer(cs)
+		}
+	}
+	p.maybeNewView(cs, vc.View)
+	return nil
+}
+
+// maybeNewView lets the primary of view v announce it once a quorum of
+// view changes arrived, re-proposing the highest prepared block. cs.mu
+// must be held.
+func (p *pbft) maybeNewView(cs *ConsensusState, v int64) {
+	if cs.view != v || !cs.changing || cs.nvSent[v] || !p.isPrimary(cs.height, v) {
+		return
+	}
+	vals := p.Ledger.ValidatorsAt(cs.height)
+	if len(cs.vcMsgs[v]) < block.Quorum(len(vals)) {
+		return
+	}
+	cs.nvSent[v] = true
+
+	var blk *block.Block
+	if best := highestPrepared(cs.viewChanges(v)); best != nil {
+		blk = &best.Block
+	} else if cs.abandoned != nil {
+		// Propose takes cs.mu: the block is built once it is released
+		height, op := cs.height, *cs.abandoned
+		p.Clock.AfterFunc(0, func() { p.reproposeNewView(height, v, op) })
+		return
+	}
+	p.sendNewView(cs, v, blk)
+}
+
+// reproposeNewView builds a block for the client write the view change
+// dropped and sends the new view v of height with it.
+func (p *pbft) reproposeNewView(height, v int64, op block.Operation) {
+	p.propMu.Lock()
+	defer p.propMu.Unlock()
+	var blk *block.Block
+	if prev := p.Ledger.ProposalTip(); prev.Header.Height == height-1 {
+		log.Printf("[node %s] reproposing abandoned write height=%d view=%d", p.ID, height, v)
+		b, err := p.newProposal(prev, op)
+		if err != nil {
+			log.Printf("[node %s] reproposal: %v", p.ID, err)
+		} else {
+			blk = &b
+		}
+	}
+	cs := p.getState(height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.decided || cs.view != v || !cs.changing {
+		if blk != nil {
+			p.Ledger.DropProposal(height)
+		}
+		return
+	}
+	p.sendNewView(cs, v, blk)
+}
+
+// viewChanges lists the view changes for v by sender. cs.mu must be held.
+func (cs *ConsensusState) viewChanges(v int64) []viewChangeMsg {
+	vcs := make([]viewChangeMsg, 0, len(cs.vcMsgs[v]))
+	for _, vc := range cs.vcMsgs[v] {
+		vcs = append(vcs, vc)
+	}
+	sort.Slice(vcs, func(i, j int) bool { return vcs[i].From < vcs[j].From })
+	return vcs
+}
+
+// sendNewView starts view v with blk, the highest prepared block or a new
+// one when none was prepared, or with no block. cs.mu must be held.
+func (p *pbft) sendNewView(cs *ConsensusState, v int64, blk *block.Block) {
+	nv := newViewMsg{ViewChanges: cs.viewChanges(v), Block: blk}
+	var digest []byte
+	if blk != nil {
+		digest = block.HashHeader(blk.Header)
+	}
+	nv.msgAuth = p.auth(kindNewView, cs.height, v, digest)
+	log.Printf("[node %s] new view height=%d view=%d reproposal=%v", p.ID, cs.height, v, nv.Block != nil)
+
+	cs.newView = &nv
+	p.multicast(cs.height, kindNewView, nv)
+	p.acceptNewView(cs, nv)
+}
+
+func (p *pbft) onNewView(body []byte) error {
+	var nv newViewMsg
+	if err := json.Unmarshal(body, &nv); err != nil {
+		return fmt.Errorf("bad newview: %w", err)
+	}
+	if err := p.verifyAuth(kindNewView, nv.msgAuth); err != nil {
+		return reject(http.StatusUnauthorized, "%v", err)
+	}
+	log.Printf("[node %s] handleNewView from=%s height=%d view=%d", p.ID, nv.From, nv.Height, nv.View)
+
+	if nv.From != p.primaryOf(nv.Height, nv.View) {
+		return reject(http.StatusForbidden, "new view from non-primary")
+	}
+	if err := p.checkNewView(nv); err != nil {
+		return err
+	}
+
+	cs := p.getState(nv.Height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.decided || nv.View < cs.view || (nv.View == cs.view && !cs.changing) {
+		return nil
+	}
+	p.acceptNewView(cs, nv)
+	return nil
+}
+
+// checkNewView verifies the view changes a new view is built from and that
+// it re-proposes exactly the highest prepared block among them.
+func (p *pbft) checkNewView(nv newViewMsg) error {
+	vals := p.Ledger.ValidatorsAt(nv.Height)
+	from := map[string]bool{}
+	for _, vc := range nv.ViewChanges {
+		if vc.View != nv.View || vc.Height != nv.Height {
+			return fmt.Errorf("view change for %d/%d in new view %d/%d", vc.Height, vc.View, nv.Height, nv.View)
+		}
+		if err := p.verifyAuth(kindViewChange, vc.msgAuth); err != nil {
+			return err
+		}
+		if err := checkViewChange(vc, vals); err != nil {
+			return err
+		}
+		from[vc.From] = true
+	}
+	if len(from) < block.Quorum(len(vals)) {
+		return fmt.Errorf("new view has %d of %d view changes", len(from), block.Quorum(len(vals)))
+	}
+
+	// without a prepared certificate nothing can have committed in the
+	// views before, and the primary may propose a new block
+	best := highestPrepared(nv.ViewChanges)
+	switch {
+	case nv.Block == nil && best == nil:
+		return nil
+	case nv.Block == nil:
+		return fmt.Errorf("new view proposal does not match prepared certificates")
+	case best == nil:
+	case !bytes.Equal(block.HashHeader(best.Block.Header), block.HashHeader(nv.Block.Header)):
+		return fmt.Errorf("new view does not re-propose the highest prepared block")
+	}
+	return checkProposal(*nv.Block, nv.Height, nv.Digest)
+}
+
+// acceptNewView enters the view of nv and processes its re-proposal as
+// the pre-prepare of that view. cs.mu must be held.
+func (p *pbft) acceptNewView(cs *ConsensusState, nv newViewMsg) {
+	p.logState(walRecord{Kind: walNewView, Height: cs.height, View: nv.View})
+	if nv.View != cs.view {
+		cs.newRound()
+	}
+	cs.view = nv.View
+	cs.changing = false
+	cs.retried = false
+	if nv.Block == nil {
+		p.stopTimer(cs)
+		p.handOff(cs)
+		return
+	}
+	cs.abandoned = nil
+	p.acceptPrePrepare(cs, *nv.Block)
+}
+
+// handOff passes on the client write of the proposal the view change
+// dropped, when the new view carries no prepared block instead: the new
+// primary proposes it again, the other nodes send it to the new primary's
+// mempool in case it never saw the proposal. cs.mu must be held.
+func (p *pbft) handOff(cs *ConsensusState) {
+	if cs.abandoned == nil {
+		return
+	}
+	op := *cs.abandoned
+	cs.abandoned = nil
+	primary := p.primaryOf(cs.height, cs.view)
+	if primary != p.ID {
+		p.send(primary, kindTx, op)
+		return
+	}
+	log.Printf("[node %s] reproposing abandoned write height=%d view=%d", p.ID, cs.height, cs.view)
+	// Propose takes cs.mu
+	p.Clock.AfterFunc(0, func() {
+		if _, err := p.Propose(op); err != nil {
+			log.Printf("[node %s] reproposal: %v", p.ID, err)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package network
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// PipelineWindow bounds how many heights above the committed tip can be
+// in consensus at once. Height h may be pre-prepared and prepared while
+// h-1 is still running, but its commit vote waits until h-1 is final, so
+// a decided block always extends the decided block below it.
+var PipelineWindow int64 = 4
+
+// linksToParent reports whether blk extends the final block below it or,
+// while that one is still in consensus, the block pre-prepared there. No
+// consensus lock may be held by the caller.
+func (p *pbft) linksToParent(blk block.Block) bool {
+	h := blk.Header.Height
+	if parent, ok := p.parentHash(h); ok {
+		return bytes.Equal(parent, blk.Header.PrevHash)
+	}
+	cs := p.getState(h - 1)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.prePrep != nil && bytes.Equal(block.HashHeader(cs.prePrep.Header), blk.Header.PrevHash)
+}
+
+// advance resumes height h once the block below it is known: it takes up
+// a pre-prepare that waited for its parent and sends the commit vote that
+// waited for the parent to become final.
+func (p *pbft) advance(h int64) {
+	cs := p.getState(h)
+	cs.mu.Lock()
+	waiting := cs.waiting
+	cs.waiting = nil
+	cs.mu.Unlock()
+	if waiting != nil && p.linksToParent(waiting.Block) {
+		cs.mu.Lock()
+		if waiting.View == cs.view && !cs.changing && !cs.decided {
+			p.acceptPrePrepare(cs, waiting.Block)
+		}
+		cs.mu.Unlock()
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	p.maybeCommit(cs)
+}
+
+// orphan abandons the round of cs: its block extends a block that lost
+// at the height below. The node has signed for that block in this view,
+// so it moves on to a view it has signed nothing in: the one the height
+// below was decided in if that is higher, the next one otherwise. cs.mu
+// must be held.
+func (p *pbft) orphan(cs *ConsensusState) {
+	log.Printf("[node %s] orphaned proposal height=%d view=%d", p.ID, cs.height, cs.view)
+	cs.prepared = nil
+	// the height below may have been decided after a view change
+	p.mu.Lock()
+	stable := p.stableView
+	p.mu.Unlock()
+	if stable <= cs.view {
+		p.logState(walRecord{Kind: walReset, Height: cs.height, View: cs.view})
+		p.startViewChange(cs, cs.view+1)
+		return
+	}
+	cs.view, cs.startView = stable, stable
+
+	p.logState(walRecord{Kind: walReset, Height: cs.height, View: cs.view})
+	cs.newRound()
+	p.stopTimer(cs)
+	p.Ledger.DropProposal(cs.height)
+}
@@ -0,0 +1,738 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+const (
+	kindRaftVote       = "raft-vote"
+	kindRaftVoteResp   = "raft-vote-resp"
+	kindRaftAppend     = "raft-append"
+	kindRaftAppendResp = "raft-append-resp"
+	kindRaftSnapshot   = "raft-snapshot"
+)
+
+var (
+	raftHeartbeat = 300 * time.Millisecond
+	// raftElection is the shortest election timeout; each one is drawn
+	// from [raftElection, 2*raftElection).
+	raftElection = 1500 * time.Millisecond
+	// raftSnapshotGap is how far behind an empty follower must be to get
+	// the ADS snapshot instead of the blocks.
+	raftSnapshotGap int64 = 256
+	raftBatch             = 64
+)
+
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+// raftEntry is the block at one log index. The index is the height.
+type raftEntry struct {
+	Term  int64       `json:"term"`
+	Block block.Block `json:"block"`
+	sig   []byte      // this node's signature over the header
+}
+
+type raftVoteReq struct {
+	Term      int64  `json:"term"`
+	From      string `json:"from"`
+	LastIndex int64  `json:"last_index"`
+	LastTerm  int64  `json:"last_term"`
+}
+
+type raftVoteResp struct {
+	Term    int64  `json:"term"`
+	From    string `json:"from"`
+	Granted bool   `json:"granted"`
+}
+
+type raftAppend struct {
+	Term      int64       `json:"term"`
+	From      string      `json:"from"`
+	PrevIndex int64       `json:"prev_index"`
+	PrevTerm  int64       `json:"prev_term"`
+	Entries   []raftEntry `json:"entries,omitempty"`
+}
+
+// raftAppendResp acknowledges an append. Sigs are the follower's
+// signatures over the headers it appended, which the leader assembles
+// into commit certificates; Tip is its committed height.
+type raftAppendResp struct {
+	Term    int64            `json:"term"`
+	From    string           `json:"from"`
+	Success bool             `json:"success"`
+	Match   int64            `json:"match"`
+	Tip     int64            `json:"tip"`
+	Sigs    map[int64][]byte `json:"sigs,omitempty"`
+}
+
+// raftSnapshot brings a follower up to the leader's committed tip: with
+// committed blocks, or with an ADS archive when the follower is empty.
+// LastTerm is the term of the last block when the leader knows it.
+type raftSnapshot struct {
+	Term     int64         `json:"term"`
+	From     string        `json:"from"`
+	Blocks   []block.Block `json:"blocks,omitempty"`
+	Archive  []byte        `json:"archive,omitempty"`
+	LastTerm int64         `json:"last_term,omitempty"`
+}
+
+// raftState is what a node persists before answering: its term, its vote
+// and its log above the committed tip.
+type raftState struct {
+	Term      int64       `json:"term"`
+	VotedFor  string      `json:"voted_for"`
+	SnapIndex int64       `json:"snap_index"`
+	SnapTerm  int64       `json:"snap_term"`
+	Log       []raftEntry `json:"log"`
+}
+
+// raft is a crash-fault-tolerant engine for clusters whose validators all
+// trust each other: messages are not signed, a leader elected by majority
+// replicates blocks and a block is final once a majority stored it. The
+// committed chain is the Raft snapshot, so the log only holds the heights
+// above the tip; a lagging follower gets committed blocks, an empty one
+// the ADS archive. To keep the chain verifiable by light clients, every
+// validator signs each header once when it appends it, and the leader
+// delivers a block with the signatures of the majority that stored it.
+// Such a certificate is only accepted under the block.Majority commit
+// rule, which selecting this engine sets.
+type raft struct {
+	*Node
+
+	mu        sync.Mutex
+	path      string // persisted state, empty until recoverWAL
+	term      int64
+	votedFor  string
+	snapIndex int64 // latest committed height whose term is known
+	snapTerm  int64
+	log       []raftEntry // entries above the committed tip
+	role      int
+	leader    string
+	votes     map[string]bool
+	next      map[string]int64
+	match     map[string]int64
+	tips      map[string]int64
+	sigs      map[int64]map[string][]byte // certificate signatures by height
+	commit    int64
+	archived  map[string]time.Time // last ADS snapshot sent to each follower
+	timer     Timer
+}
+
+func newRaft(n *Node) Consensus {
+	r := &raft{Node: n, snapIndex: n.nextHeight() - 1}
+	r.mu.Lock()
+	r.resetElection()
+	r.mu.Unlock()
+	return r
+}
+
+func (r *raft) OnMessage(kind string, body []byte) error {
+	var err error
+	switch kind {
+	case kindRaftVote:
+		var m raftVoteReq
+		if err = json.Unmarshal(body, &m); err == nil {
+			r.onVote(m)
+		}
+	case kindRaftVoteResp:
+		var m raftVoteResp
+		if err = json.Unmarshal(body, &m); err == nil {
+			r.onVoteResp(m)
+		}
+	case kindRaftAppend:
+		var m raftAppend
+		if err = json.Unmarshal(body, &m); err == nil {
+			r.onAppend(m)
+		}
+	case kindRaftAppendResp:
+		var m raftAppendResp
+		if err = json.Unmarshal(body, &m); err == nil {
+			r.onAppendResp(m)
+		}
+	case kindRaftSnapshot:
+		var m raftSnapshot
+		if err = json.Unmarshal(body, &m); err == nil {
+			r.onSnapshot(m)
+		}
+	default:
+		return reject(http.StatusNotFound, "raft: unknown message %q", kind)
+	}
+	if err != nil {
+		return fmt.Errorf("bad %s: %w", kind, err)
+	}
+	return nil
+}
+
+func (r *raft) Leader() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role == raftLeader {
+		return r.ID
+	}
+	return r.leader
+}
+
+func (r *raft) Propose(op block.Operation) (block.Block, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role != raftLeader {
+		return block.Block{}, reject(http.StatusMisdirectedRequest, "not leader, leader is %s", r.leader)
+	}
+	tip := r.compact()
+	h := r.lastIndex() + 1
+	if h-tip > PipelineWindow {
+		return block.Block{}, reject(http.StatusServiceUnavailable, "pipeline full")
+	}
+	// an update must be committed before its epoch starts, and the pipeline
+	// never reaches further than PipelineWindow above the tip
+	if (op.Validator != nil || op.Type == block.OpValidator) && block.NextEpoch(h)-h <= PipelineWindow {
+		return block.Block{}, reject(http.StatusServiceUnavailable, "too close to epoch %d", block.NextEpoch(h))
+	}
+	return r.appendOp(op)
+}
+
+// appendOp builds a block for op on top of the log, stores it and sends
+// it to the followers. r.mu must be held.
+func (r *raft) appendOp(op block.Operation) (block.Block, error) {
+	prev := r.Ledger.ProposalTip()
+	if prev.Header.Height != r.lastIndex() {
+		return block.Block{}, reject(http.StatusServiceUnavailable, "log at %d, executed up to %d", r.lastIndex(), prev.Header.Height)
+	}
+	blk, err := r.newProposal(prev, op)
+	if err != nil {
+		return block.Block{}, err
+	}
+	r.log = append(r.log, raftEntry{Term: r.term, Block: blk, sig: block.SignCommit(blk.Header, r.SK)})
+	r.save()
+	for id := range r.members() {
+		if id != r.ID {
+			r.sendAppend(id)
+		}
+	}
+	r.advanceCommit()
+	return blk, nil
+}
+
+// OnTimeout is the election timeout of term.
+func (r *raft) OnTimeout(_, term int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if term != r.term || r.role == raftLeader {
+		return
+	}
+	r.resetElection()
+	if !r.members().Has(r.ID) {
+		return
+	}
+	last, lastTerm, ok := r.last()
+	if !ok {
+		// the term of the tip arrives with the next append or snapshot
+		return
+	}
+	r.term++
+	r.role, r.votedFor, r.leader = raftCandidate, r.ID, ""
+	r.votes = map[string]bool{r.ID: true}
+	r.save()
+	r.resetElection()
+	log.Printf("[node %s] raft election term=%d last=%d/%d", r.ID, r.term, last, lastTerm)
+	req := raftVoteReq{r.term, r.ID, last, lastTerm}
+	for id := range r.members() {
+		r.send(id, kindRaftVote, req)
+	}
+	r.maybeWin()
+}
+
+func (r *raft) onVote(m raftVoteReq) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m.Term > r.term {
+		r.stepDown(m.Term)
+	}
+	last, lastTerm, ok := r.last()
+	upToDate := m.LastTerm > lastTerm || m.LastTerm == lastTerm && m.LastIndex >= last
+	grant := m.Term == r.term && ok && upToDate && (r.votedFor == "" || r.votedFor == m.From)
+	if grant {
+		r.votedFor = m.From
+		r.save()
+		r.resetElection()
+	}
+	r.send(m.From, kindRaftVoteResp, raftVoteResp{r.term, r.ID, grant})
+}
+
+func (r *raft) onVoteResp(m raftVoteResp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m.Term > r.term {
+		r.stepDown(m.Term)
+		return
+	}
+	if r.role != raftCandidate || m.Term != r.term || !m.Granted {
+		return
+	}
+	r.votes[m.From] = true
+	r.maybeWin()
+}
+
+// maybeWin makes the candidate leader once a majority voted for it.
+// r.mu must be held.
+func (r *raft) maybeWin() {
+	vals := r.members()
+	n := 0
+	for id := range r.votes {
+		if vals.Has(id) {
+			n++
+		}
+	}
+	if r.role != raftCandidate || n < block.Majority(len(vals)) {
+		return
+	}
+	r.role, r.leader = raftLeader, r.ID
+	r.timer.Stop()
+	log.Printf("[node %s] raft leader term=%d", r.ID, r.term)
+
+	// execute the entries of earlier terms, to build on them
+	tip := r.compact()
+	r.Ledger.DropProposal(tip + 1)
+	for _, e := range r.log {
+		if err := r.Ledger.Speculate(e.Block); err != nil {
+			log.Printf("[node %s] raft: cannot execute entry %d: %v", r.ID, e.Block.Header.Height, err)
+			break
+		}
+	}
+	r.next, r.match, r.tips = map[string]int64{}, map[string]int64{}, map[string]int64{}
+	r.sigs, r.archived, r.commit = map[int64]map[string][]byte{}, map[string]time.Time{}, tip
+	for id := range vals {
+		r.next[id] = r.lastIndex() + 1
+	}
+	// entries of earlier terms commit with the first entry of this one
+	if _, err := r.appendOp(block.Operation{Type: block.OpNoop}); err != nil {
+		log.Printf("[node %s] raft noop: %v", r.ID, err)
+	}
+	r.heartbeat(r.term)
+}
+
+// heartbeat sends appends to every follower each raftHeartbeat while this
+// node leads term.
+func (r *raft) heartbeat(term int64) {
+	r.Clock.AfterFunc(raftHeartbeat, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.role != raftLeader || r.term != term {
+			return
+		}
+		for id := range r.members() {
+			if id != r.ID {
+				r.sendAppend(id)
+			}
+		}
+		r.heartbeat(term)
+	})
+}
+
+// stepDown follows a newer term. r.mu must be held.
+func (r *raft) stepDown(term int64) {
+	if term > r.term {
+		r.term, r.votedFor = term, ""
+		r.save()
+	}
+	if r.role == raftLeader {
+		r.Ledger.DropProposal(r.nextHeight())
+	}
+	r.role = raftFollower
+	r.resetElection()
+}
+
+// resetElection restarts the election timer of the current term. r.mu
+// must be held.
+func (r *raft) resetElection() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	term := r.term
+	d := raftElection + time.Duration(r.rng.Int63n(int64(raftElection)))
+	r.timer = r.Clock.AfterFunc(d, func() { r.OnTimeout(0, term) })
+}
+
+// sendAppend sends follower id the entries from its next index, or the
+// committed blocks it misses. r.mu must be held.
+func (r *raft) sendAppend(id string) {
+	prev := r.next[id] - 1
+	if prev < r.snapIndex {
+		r.sendSnapshot(id)
+		return
+	}
+	prevTerm, _ := r.termAt(prev)
+	m := raftAppend{Term: r.term, From: r.ID, PrevIndex: prev, PrevTerm: prevTerm}
+	for _, e := range r.log {
+		if e.Block.Header.Height > prev && len(m.Entries) < raftBatch {
+			m.Entries = append(m.Entries, e)
+		}
+	}
+	r.send(id, kindRaftAppend, m)
+}
+
+// sendSnapshot sends follower id the committed blocks above its tip, or
+// the whole ADS archive when it has none. r.mu must be held.
+func (r *raft) sendSnapshot(id string) {
+	tip := r.nextHeight() - 1
+	from := r.tips[id] + 1
+	m := raftSnapshot{Term: r.term, From: r.ID}
+	if from <= 2 && tip-from >= raftSnapshotGap {
+		if r.Clock.Now().Sub(r.archived[id]) < 10*time.Second {
+			return
+		}
+		var buf bytes.Buffer
+		if err := r.Ledger.Snapshot(&buf); err != nil {
+			log.Printf("[node %s] raft snapshot: %v", r.ID, err)
+			return
+		}
+		r.archived[id] = r.Clock.Now()
+		m.Archive = buf.Bytes()
+		if r.Ledger.Tip().Header.Height == r.snapIndex {
+			m.LastTerm = r.snapTerm
+		}
+		log.Printf("[node %s] raft ADS snapshot to %s up to %d", r.ID, id, tip)
+	} else {
+		for h := from; h <= tip && len(m.Blocks) < raftBatch; h++ {
+			b, err := r.Ledger.GetBlock(h)
+			if err != nil {
+				break
+			}
+			m.Blocks = append(m.Blocks, b)
+		}
+		if n := len(m.Blocks); n > 0 && m.Blocks[n-1].Header.Height == r.snapIndex {
+			m.LastTerm = r.snapTerm
+		}
+	}
+	r.send(id, kindRaftSnapshot, m)
+}
+
+func (r *raft) onAppend(m raftAppend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resp := raftAppendResp{Term: r.term, From: r.ID}
+	defer func() {
+		resp.Tip = r.nextHeight() - 1
+		r.send(m.From, kindRaftAppendResp, resp)
+	}()
+	if m.Term < r.term {
+		resp.Match = r.lastIndex()
+		return
+	}
+	if m.Term > r.term || r.role != raftFollower {
+		r.stepDown(m.Term)
+		resp.Term = r.term
+	}
+	r.leader = m.From
+	r.resetElection()
+
+	tip := r.compact()
+	switch {
+	case m.PrevIndex == tip && r.snapIndex < tip:
+		// the leader has every committed entry, so it knows their terms
+		r.snapIndex, r.snapTerm = tip, m.PrevTerm
+	case m.PrevIndex > tip:
+		if t, ok := r.termAt(m.PrevIndex); !ok || t != m.PrevTerm {
+			if ok {
+				r.truncate(m.PrevIndex)
+				r.save()
+			}
+			resp.Match = min(r.lastIndex(), m.PrevIndex-1)
+			return
+		}
+	}
+
+	changed := false
+	resp.Sigs = map[int64][]byte{}
+	for _, e := range m.Entries {
+		h := e.Block.Header.Height
+		if h <= tip {
+			continue
+		}
+		if t, ok := r.termAt(h); ok && t == e.Term {
+			resp.Sigs[h] = r.entryAt(h).sig
+			continue
+		} else if ok {
+			r.truncate(h)
+		}
+		if h != r.lastIndex()+1 {
+			break
+		}
+		if err := checkProposal(e.Block, h, block.HashHeader(e.Block.Header)); err != nil {
+			log.Printf("[node %s] raft: bad entry %d: %v", r.ID, h, err)
+			break
+		}
+		e.sig = block.SignCommit(e.Block.Header, r.SK)
+		r.log = append(r.log, e)
+		resp.Sigs[h] = e.sig
+		changed = true
+	}
+	if changed {
+		r.save()
+	}
+	resp.Success = true
+	resp.Match = max(tip, min(r.lastIndex(), m.PrevIndex+int64(len(m.Entries))))
+}
+
+func (r *raft) onAppendResp(m raftAppendResp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// nothing authenticates the sender: a stranger, or a validator since
+	// removed, has no say in the log
+	pk, ok := r.Ledger.ValidatorsAt(r.nextHeight())[m.From]
+	if !ok || len(pk) != ed25519.PublicKeySize {
+		return
+	}
+	if m.Term > r.term {
+		r.stepDown(m.Term)
+		return
+	}
+	if r.role != raftLeader || m.Term != r.term {
+		return
+	}
+	r.tips[m.From] = m.Tip
+	if !m.Success {
+		r.next[m.From] = max(m.Tip+1, min(r.next[m.From]-1, m.Match+1))
+		r.sendAppend(m.From)
+		return
+	}
+	if m.Match > r.match[m.From] {
+		r.match[m.From] = m.Match
+	}
+	r.next[m.From] = max(r.next[m.From], r.match[m.From]+1)
+
+	for h, sig := range m.Sigs {
+		e := r.entryAt(h)
+		if e == nil || !block.VerifyCommitSig(pk, e.Block.Header, sig) {
+			continue
+		}
+		if r.sigs[h] == nil {
+			r.sigs[h] = map[string][]byte{}
+		}
+		r.sigs[h][m.From] = sig
+	}
+	r.advanceCommit()
+	if r.tips[m.From] < r.snapIndex && r.next[m.From]-1 < r.snapIndex {
+		r.sendSnapshot(m.From)
+	}
+}
+
+// advanceCommit moves the commit index to the highest entry of this term
+// stored by a majority, and delivers the committed blocks whose
+// certificate is complete. r.mu must be held.
+func (r *raft) advanceCommit() {
+	vals := r.members()
+	for h := r.lastIndex(); h > r.commit; h-- {
+		if t, _ := r.termAt(h); t != r.term {
+			break
+		}
+		n := 1
+		for id := range vals {
+			if id != r.ID && r.match[id] >= h {
+				n++
+			}
+		}
+		if n >= block.Majority(len(vals)) {
+			r.commit = h
+			break
+		}
+	}
+
+	for h := r.nextHeight(); h <= r.commit; h++ {
+		e := r.entryAt(h)
+		if e == nil {
+			break
+		}
+		hv := r.Ledger.ValidatorsAt(h)
+		ids := []string{r.ID}
+		for id := range r.sigs[h] {
+			if hv.Has(id) {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) < r.commits(len(hv)) {
+			break
+		}
+		sort.Strings(ids)
+		blk := e.Block
+		blk.Header.Validators, blk.Header.Signatures = nil, nil
+		for _, id := range ids {
+			sig := e.sig
+			if id != r.ID {
+				sig = r.sigs[h][id]
+			}
+			blk.Header.Validators = append(blk.Header.Validators, id)
+			blk.Header.Signatures = append(blk.Header.Signatures, sig)
+		}
+		log.Printf("[node %s] raft commit height=%d term=%d", r.ID, h, e.Term)
+		r.deliver(blk)
+		delete(r.sigs, h)
+	}
+	if tip := r.nextHeight() - 1; tip >= r.snapIndex && len(r.log) > 0 && r.log[0].Block.Header.Height <= tip {
+		r.compact()
+		r.save()
+	}
+}
+
+func (r *raft) onSnapshot(m raftSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resp := raftAppendResp{Term: r.term, From: r.ID}
+	defer func() {
+		resp.Tip = r.nextHeight() - 1
+		resp.Match = r.lastIndex()
+		r.send(m.From, kindRaftAppendResp, resp)
+	}()
+	if m.Term < r.term {
+		return
+	}
+	if m.Term > r.term || r.role != raftFollower {
+		r.stepDown(m.Term)
+		resp.Term = r.term
+	}
+	r.leader = m.From
+	r.resetElection()
+
+	last := int64(0)
+	if m.Archive != nil {
+		if err := r.Ledger.Restore(bytes.NewReader(m.Archive), r.commits); err != nil {
+			log.Printf("[node %s] raft snapshot: %v", r.ID, err)
+			return
+		}
+		last = r.Ledger.Tip().Header.Height
+		log.Printf("[node %s] raft installed ADS snapshot up to %d", r.ID, last)
+	}
+	for _, b := range m.Blocks {
+		if err := r.Ledger.CommitBlock(b, r.commits); err != nil {
+			log.Printf("[node %s] raft snapshot block %d: %v", r.ID, b.Header.Height, err)
+			break
+		}
+		last = b.Header.Height
+	}
+	tip := r.compact()
+	if m.LastTerm > 0 && last == tip && r.snapIndex < tip {
+		r.snapIndex, r.snapTerm = tip, m.LastTerm
+	}
+	r.save()
+}
+
+func (r *raft) members() block.ValidatorSet {
+	return r.Ledger.ValidatorsAt(r.nextHeight())
+}
+
+// compact drops the entries the chain committed meanwhile and returns the
+// committed tip. r.mu must be held.
+func (r *raft) compact() int64 {
+	tip := r.nextHeight() - 1
+	i := 0
+	for ; i < len(r.log) && r.log[i].Block.Header.Height <= tip; i++ {
+		if r.log[i].Block.Header.Height == tip {
+			r.snapIndex, r.snapTerm = tip, r.log[i].Term
+		}
+	}
+	r.log = r.log[i:]
+	return tip
+}
+
+func (r *raft) lastIndex() int64 {
+	if len(r.log) > 0 {
+		return r.log[len(r.log)-1].Block.Header.Height
+	}
+	return max(r.snapIndex, r.nextHeight()-1)
+}
+
+// last is the index and term of the last entry, for elections; ok is
+// false while the term of a tip committed from outside is unknown.
+func (r *raft) last() (index, term int64, ok bool) {
+	tip := r.compact()
+	if len(r.log) > 0 {
+		e := r.log[len(r.log)-1]
+		return e.Block.Header.Height, e.Term, true
+	}
+	return tip, r.snapTerm, r.snapIndex >= tip
+}
+
+func (r *raft) entryAt(h int64) *raftEntry {
+	if len(r.log) == 0 {
+		return nil
+	}
+	i := h - r.log[0].Block.Header.Height
+	if i < 0 || i >= int64(len(r.log)) {
+		return nil
+	}
+	return &r.log[i]
+}
+
+func (r *raft) termAt(h int64) (int64, bool) {
+	if e := r.entryAt(h); e != nil {
+		return e.Term, true
+	}
+	if h == r.snapIndex {
+		return r.snapTerm, true
+	}
+	return 0, false
+}
+
+// truncate drops the entries from height h up. r.mu must be held.
+func (r *raft) truncate(h int64) {
+	for i, e := range r.log {
+		if e.Block.Header.Height >= h {
+			r.log = r.log[:i]
+			break
+		}
+	}
+}
+
+// save persists the state before the node answers or sends anything that
+// depends on it. r.mu must be held.
+func (r *raft) save() {
+	if r.path == "" {
+		return
+	}
+	raw, _ := json.Marshal(raftState{r.term, r.votedFor, r.snapIndex, r.snapTerm, r.log})
+	if err := writeFileSync(r.path, raw); err != nil {
+		log.Fatalf("[node %s] raft state: %v", r.ID, err)
+	}
+}
+
+// recoverWAL loads the term, vote and log persisted at path. Without a
+// state file the committed tip counts as the last entry of term 0.
+func (r *raft) recoverWAL(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	raw, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var st raftState
+		if err := json.Unmarshal(raw, &st); err != nil {
+			return fmt.Errorf("raft state %s: %w", path, err)
+		}
+		r.term, r.votedFor, r.snapIndex, r.snapTerm, r.log = st.Term, st.VotedFor, st.SnapIndex, st.SnapTerm, st.Log
+		for i := range r.log {
+			r.log[i].sig = block.SignCommit(r.log[i].Block.Header, r.SK)
+		}
+	}
+	r.path = path
+	tip := r.compact()
+	r.save()
+	r.resetElection()
+	log.Printf("[node %s] raft state term=%d tip=%d log=%d", r.ID, r.term, tip, len(r.log))
+	return nil
+}
@@ -0,0 +1,238 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// State sync tuning. A node started with StateSync and an empty chain
+// whose peers are StateSyncMin or more blocks ahead installs the state at
+// their tip instead of replaying every block.
+var (
+	StateSyncMin  = int64(100)
+	snapshotChunk = 2048 // keys per chunk
+	chunkFetchers = 8    // chunks fetched in parallel
+)
+
+// stateLedger is a Ledger that can serve the state at a committed height
+// and install a chain with the state at its tip, as the node's own chain
+// can and a simulated one cannot.
+type stateLedger interface {
+	StateAt(h int64) ([]block.StateEntry, error)
+	InstallState(blocks []block.Block, state []block.StateEntry, rule block.CommitRule) error
+}
+
+// snapshotManifest describes the snapshot of the state at a height: the
+// sha256 of each of its chunks, so that the chunks can come from anyone.
+type snapshotManifest struct {
+	Height int64    `json:"height"`
+	Keys   int      `json:"keys"`
+	Chunks [][]byte `json:"chunks"`
+}
+
+// snapshot is the last snapshot this node served, kept since its peers
+// ask for it chunk by chunk.
+type snapshot struct {
+	mu       sync.Mutex
+	manifest *snapshotManifest
+	chunks   [][]byte
+}
+
+// snapshotAt returns the manifest and the JSON chunks of the state at h.
+func (n *Node) snapshotAt(h int64) (*snapshotManifest, [][]byte, error) {
+	sl, ok := n.Ledger.(stateLedger)
+	if !ok {
+		return nil, nil, fmt.Errorf("no state snapshots")
+	}
+	s := &n.snap
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.manifest != nil && s.manifest.Height == h {
+		return s.manifest, s.chunks, nil
+	}
+	state, err := sl.StateAt(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &snapshotManifest{Height: h, Keys: len(state)}
+	var chunks [][]byte
+	for i := 0; i < len(state); i += snapshotChunk {
+		end := min(i+snapshotChunk, len(state))
+		raw, err := json.Marshal(state[i:end])
+		if err != nil {
+			return nil, nil, err
+		}
+		sum := sha256.Sum256(raw)
+		chunks = append(chunks, raw)
+		m.Chunks = append(m.Chunks, sum[:])
+	}
+	s.manifest, s.chunks = m, chunks
+	log.Printf("[node %s] snapshot at height %d: %d keys in %d chunks", n.ID, h, m.Keys, len(chunks))
+	return m, chunks, nil
+}
+
+// handleSnapshot serves GET /snapshot?height=H, the manifest of the state
+// at H, and GET /snapshot/chunk?height=H&index=I, its I-th chunk.
+func (n *Node) handleSnapshot(what syncWhat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		h, err := strconv.ParseInt(q.Get("height"), 10, 64)
+		if err != nil || h < 1 {
+			http.Error(w, "bad height", http.StatusBadRequest)
+			return
+		}
+		var index int64
+		if what == syncChunk {
+			if index, err = strconv.ParseInt(q.Get("index"), 10, 64); err != nil || index < 0 {
+				http.Error(w, "bad index", http.StatusBadRequest)
+				return
+			}
+		}
+		raw, err := n.serveRange(what, h, index)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+	}
+}
+
+// stateSync installs the chain and the state at the tip of the peer
+// furthest ahead: the manifest and the headers come from that peer, the
+// blocks and the snapshot chunks from every peer that has them. The blocks
+// are checked against the headers and the chunks against the manifest as
+// they come; the certificates and the state root once all are in. A bad
+// manifest, header chain or state bans the source.
+func (n *Node) stateSync(sl stateLedger, peers []Peer) error {
+	start := time.Now()
+	src := peers[0]
+	var m snapshotManifest
+	if err := n.fetch(src.ID, syncManifest, src.Tip, 0, &m); err != nil {
+		n.backoff(src.ID, err)
+		return err
+	}
+	if m.Height != src.Tip {
+		err := fmt.Errorf("manifest of height %d for %d", m.Height, src.Tip)
+		n.ban(src.ID, err)
+		return err
+	}
+
+	blocks := []block.Block{n.Ledger.Tip()}
+	for from := int64(2); from <= m.Height; from += headerBatch {
+		count := min(headerBatch, m.Height-from+1)
+		var hdrs []block.BlockHeader
+		if err := n.fetch(src.ID, syncHeaders, from, count, &hdrs); err != nil {
+			n.backoff(src.ID, err)
+			return err
+		}
+		if err := linkHeaders(blocks[len(blocks)-1].Header, hdrs, count); err != nil {
+			n.ban(src.ID, err)
+			return err
+		}
+		err := n.fetchBodies(hdrs, peers, func(b block.Block) error {
+			blocks = append(blocks, b)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	state, err := n.fetchState(m, peers)
+	if err != nil {
+		return err
+	}
+	if err := sl.InstallState(blocks, state, n.commits); err != nil {
+		n.ban(src.ID, err)
+		return err
+	}
+	n.syncOK(src.ID)
+	n.settle()
+	log.Printf("[node %s] state-synced to height %d, %d keys, in %v",
+		n.ID, m.Height, m.Keys, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// linkHeaders checks that hdrs are the count headers following prev.
+func linkHeaders(prev block.BlockHeader, hdrs []block.BlockHeader, count int64) error {
+	if int64(len(hdrs)) != count {
+		return fmt.Errorf("%d headers for %d", len(hdrs), count)
+	}
+	for _, h := range hdrs {
+		if h.Height != prev.Height+1 || !bytes.Equal(h.PrevHash, block.HashHeader(prev)) {
+			return fmt.Errorf("header %d does not link to %d", h.Height, prev.Height)
+		}
+		prev = h
+	}
+	return nil
+}
+
+// fetchState downloads the chunks of the snapshot m, chunkFetchers at a
+// time, each from the peers that have the height in turn until one serves
+// it matching the manifest, and returns the state they make up.
+func (n *Node) fetchState(m snapshotManifest, peers []Peer) ([]block.StateEntry, error) {
+	parts := make([][]block.StateEntry, len(m.Chunks))
+	errs := make(chan error, len(m.Chunks))
+	sem := make(chan struct{}, chunkFetchers)
+	var wg sync.WaitGroup
+	for i := range m.Chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			part, err := n.fetchStateChunk(m, i, peers)
+			if err != nil {
+				errs <- err
+				return
+			}
+			parts[i] = part
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	state := make([]block.StateEntry, 0, m.Keys)
+	for _, p := range parts {
+		state = append(state, p...)
+	}
+	return state, nil
+}
+
+func (n *Node) fetchStateChunk(m snapshotManifest, i int, peers []Peer) ([]block.StateEntry, error) {
+	for k := range peers {
+		p := peers[(i+k)%len(peers)]
+		if p.Tip < m.Height {
+			continue
+		}
+		raw, err := n.fetchRaw(p.ID, syncChunk, m.Height, int64(i))
+		if err != nil {
+			n.backoff(p.ID, err)
+			continue
+		}
+		// a mismatch may as well be the manifest's fault: the root check
+		// tells, so the peer is only left alone for a while
+		if sum := sha256.Sum256(raw); !bytes.Equal(sum[:], m.Chunks[i]) {
+			n.backoff(p.ID, fmt.Errorf("chunk %d does not match the manifest", i))
+			continue
+		}
+		var part []block.StateEntry
+		if err := json.Unmarshal(raw, &part); err != nil {
+			n.backoff(p.ID, err)
+			continue
+		}
+		return part, nil
+	}
+	return nil, fmt.Errorf("no peer served chunk %d of the state at %d", i, m.Height)
+}
@@ -0,0 +1,61 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/block"
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// A snapshot chunk that does not match the manifest is refused and its
+// server backed off; the chunk is taken from the next peer, and fetching
+// fails when no peer serves it right.
+func TestBadStateChunk(t *testing.T) {
+	state := []block.StateEntry{
+		{Key: "a", Version: storage.Version{Value: []byte("1"), VF: 2}},
+		{Key: "b", Version: storage.Version{Value: []byte("2"), VF: 3}},
+	}
+	raw, _ := json.Marshal(state)
+	sum := sha256.Sum256(raw)
+	m := snapshotManifest{Height: 3, Keys: len(state), Chunks: [][]byte{sum[:]}}
+
+	serve := func(chunk []byte) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(chunk)
+		}))
+		t.Cleanup(srv.Close)
+		return strings.TrimPrefix(srv.URL, "http://")
+	}
+	lied := []byte(strings.Replace(string(raw), `"a"`, `"c"`, 1))
+	n := NewNode("validator1", 0, map[string]string{
+		"liar":   serve(lied),
+		"honest": serve(raw),
+	}, nil)
+	n.UseHTTP()
+	liar := Peer{PeerInfo: PeerInfo{ID: "liar"}, Tip: 3}
+	honest := Peer{PeerInfo: PeerInfo{ID: "honest"}, Tip: 3}
+
+	if _, err := n.fetchState(m, []Peer{liar}); err == nil {
+		t.Fatal("state fetched from a liar alone")
+	}
+	got, err := n.fetchState(m, []Peer{liar, honest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := json.Marshal(got); string(b) != string(raw) {
+		t.Fatalf("fetched state %s, want %s", b, raw)
+	}
+	n.sync.mu.Lock()
+	defer n.sync.mu.Unlock()
+	if sp := n.sync.peers["liar"]; sp == nil || sp.fails != 2 {
+		t.Fatal("liar not backed off after each bad chunk")
+	}
+	if sp := n.sync.peers["honest"]; sp != nil && sp.fails != 0 {
+		t.Fatal("honest peer backed off")
+	}
+}
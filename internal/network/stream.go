@@ -0,0 +1,487 @@
+package network
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// streamProto is the protocol a node connection upgrades GET /stream to.
+const streamProto = "falcon-stream/1"
+
+// Frames of a node stream. Each is a 4-byte big-endian length of what
+// follows, a type byte, a 4-byte request id (zero outside sync) and the
+// payload:
+//
+//	frameMsg       kind length (1 byte), kind, message body
+//	frameSyncReq   first height (8 bytes), count (4 bytes), what (1 byte)
+//	frameSyncResp  JSON array of committed headers or blocks, or a snapshot
+//	               manifest or chunk; empty if the peer has none
+const (
+	frameMsg byte = iota + 1
+	frameSyncReq
+	frameSyncResp
+)
+
+// Stream tuning.
+var (
+	streamQueue   = 1024             // frames waiting for a connection; more are dropped
+	streamRetry   = 5 * time.Second  // after a failed dial, HTTP is used so long
+	streamTimeout = 5 * time.Second  // dial, upgrade and sync request deadline
+	maxFrame      = 64 << 20         // largest frame accepted
+	streamIdle    = 30 * time.Second // keepalive of the TCP connection
+	streamSkew    = 30 * time.Second // clock difference a handshake may show
+)
+
+type frame struct {
+	typ     byte
+	req     uint32
+	payload []byte
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	var hdr [9]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(5+len(f.payload)))
+	hdr[4] = f.typ
+	binary.BigEndian.PutUint32(hdr[5:], f.req)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.payload)
+	return err
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var hdr [9]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	size := binary.BigEndian.Uint32(hdr[0:])
+	if size < 5 || size > uint32(maxFrame) {
+		return frame{}, fmt.Errorf("bad frame size %d", size)
+	}
+	f := frame{typ: hdr[4], req: binary.BigEndian.Uint32(hdr[5:]), payload: make([]byte, size-5)}
+	_, err := io.ReadFull(r, f.payload)
+	return f, err
+}
+
+func msgFrame(kind string, body []byte) frame {
+	p := make([]byte, 0, 1+len(kind)+len(body))
+	p = append(p, byte(len(kind)))
+	p = append(p, kind...)
+	return frame{typ: frameMsg, payload: append(p, body...)}
+}
+
+func parseMsg(p []byte) (kind string, body []byte, err error) {
+	if len(p) == 0 || len(p) < 1+int(p[0]) {
+		return "", nil, errors.New("short message frame")
+	}
+	return string(p[1 : 1+p[0]]), p[1+p[0]:], nil
+}
+
+// stream is one connection to a peer, dialed by this node or by the peer.
+// Frames are queued and written by a single goroutine, so that Send never
+// blocks.
+type stream struct {
+	peer   string
+	dialed bool // by this node
+	out    chan frame
+
+	mu     sync.Mutex
+	conn   net.Conn // nil while dialing
+	closed bool
+}
+
+// enqueue queues f, or drops it when the queue is full or the stream is
+// closed.
+func (s *stream) enqueue(f frame) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.out <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// retire stops writing to s. The peer sees the end of the stream once the
+// queue is flushed, and the reader ends once the peer stops writing too.
+func (s *stream) retire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.out)
+	}
+}
+
+// streamTransport carries consensus messages, blocks and sync requests
+// over one persistent connection per peer, an upgraded GET /stream of the
+// peer's HTTP server, so that it shares the port and mutual TLS. Until a
+// connection is up, or while a peer cannot be dialed, messages go over
+// HTTP.
+type streamTransport struct {
+	n    *Node
+	http httpTransport
+
+	mu      sync.Mutex
+	streams map[string]*stream   // the one used to write to each peer
+	retry   map[string]time.Time // no dial before
+	hello   map[string]int64     // time of the last handshake each peer signed
+	nextReq uint32
+	pending map[syncReq]chan []byte
+}
+
+// syncReq identifies a sync request by the peer asked and its id, so that
+// a peer can only answer its own requests.
+type syncReq struct {
+	peer string
+	req  uint32
+}
+
+func newStreamTransport(n *Node) *streamTransport {
+	return &streamTransport{
+		n:       n,
+		http:    httpTransport{n},
+		streams: map[string]*stream{},
+		retry:   map[string]time.Time{},
+		hello:   map[string]int64{},
+		pending: map[syncReq]chan []byte{},
+	}
+}
+
+// UseStreams makes the node talk to its peers over streams, with HTTP as
+// the fallback. It is the default of real nodes; peers that do not speak
+// the protocol are reached over HTTP.
+func (n *Node) UseStreams() {
+	n.Transport = newStreamTransport(n)
+}
+
+// UseHTTP makes the node post every message to the peers over HTTP.
+func (n *Node) UseHTTP() {
+	n.Transport = httpTransport{n}
+}
+
+func (t *streamTransport) Send(to, kind string, body []byte) {
+	s := t.streamTo(to)
+	if s == nil || !s.enqueue(msgFrame(kind, body)) {
+		t.http.Send(to, kind, body)
+	}
+}
+
+// streamTo returns the stream to a peer, dialing one when there is none,
+// or nil when the last dial failed recently.
+func (t *streamTransport) streamTo(to string) *stream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.streams[to]; ok {
+		return s
+	}
+	if time.Now().Before(t.retry[to]) {
+		return nil
+	}
+	s := &stream{peer: to, dialed: true, out: make(chan frame, streamQueue)}
+	t.streams[to] = s
+	go t.dial(s)
+	return s
+}
+
+func (t *streamTransport) dial(s *stream) {
+	conn, r, err := t.connect(s.peer)
+	if err != nil {
+		t.n.peerFailed(s.peer)
+		t.mu.Lock()
+		_, failed := t.retry[s.peer]
+		t.retry[s.peer] = time.Now().Add(streamRetry)
+		t.mu.Unlock()
+		if !failed {
+			log.Printf("[node %s] stream to %s: %v, using HTTP", t.n.ID, s.peer, err)
+		}
+		t.drop(s)
+		// what queued up meanwhile goes over HTTP
+		for f := range s.out {
+			if f.typ == frameMsg {
+				if kind, body, err := parseMsg(f.payload); err == nil {
+					t.http.Send(s.peer, kind, body)
+				}
+			}
+		}
+		return
+	}
+	t.mu.Lock()
+	delete(t.retry, s.peer)
+	t.mu.Unlock()
+	t.run(s, conn, r)
+}
+
+// connect dials the peer and upgrades the connection to a stream.
+func (t *streamTransport) connect(to string) (net.Conn, *bufio.Reader, error) {
+	addr, ok := t.n.addrOf(to)
+	if !ok {
+		return nil, nil, fmt.Errorf("no address")
+	}
+	d := net.Dialer{Timeout: streamTimeout, KeepAlive: streamIdle}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.n.clientTLS != nil {
+		cfg := t.n.clientTLS.Clone()
+		cfg.NextProtos = []string{"http/1.1"} // HTTP/2 cannot be upgraded
+		tc := tls.Client(conn, cfg)
+		conn = tc
+	}
+	conn.SetDeadline(time.Now().Add(streamTimeout))
+	req, _ := http.NewRequest(http.MethodGet, t.n.baseURL(addr)+"/stream", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", streamProto)
+	at := time.Now().UnixNano()
+	req.Header.Set("X-Node-ID", t.n.ID)
+	req.Header.Set("X-Node-Time", strconv.FormatInt(at, 10))
+	req.Header.Set("X-Node-Sig", hex.EncodeToString(ed25519.Sign(t.n.SK, helloBytes(t.n.ID, to, at))))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, nil, fmt.Errorf("upgrade refused: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, br, nil
+}
+
+// helloBytes is what a node dialing a stream signs: its id, the id of the
+// node it dials and the time, so that the handshake is good for one
+// connection to that node only.
+func helloBytes(from, to string, at int64) []byte {
+	return []byte("falcondb/stream/" + from + "/" + to + "/" + strconv.FormatInt(at, 10))
+}
+
+// checkHello verifies the handshake of a stream the peer dialed against
+// the key this node knows for it. Without TLS, X-Node-ID is all the
+// request says about who sent it, and an accepted stream replaces the one
+// this node writes to the peer.
+func (t *streamTransport) checkHello(peer string, r *http.Request) error {
+	pk, ok := t.n.peerKey(peer, t.n.nextHeight())
+	if !ok {
+		return fmt.Errorf("unknown node %s", peer)
+	}
+	at, err := strconv.ParseInt(r.Header.Get("X-Node-Time"), 10, 64)
+	if err != nil {
+		return errors.New("missing X-Node-Time")
+	}
+	sig, err := hex.DecodeString(r.Header.Get("X-Node-Sig"))
+	if err != nil || !ed25519.Verify(pk, helloBytes(peer, t.n.ID, at), sig) {
+		return fmt.Errorf("bad stream signature of %s", peer)
+	}
+	if d := time.Since(time.Unix(0, at)); d > streamSkew || d < -streamSkew {
+		return fmt.Errorf("stale stream handshake of %s", peer)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at <= t.hello[peer] {
+		return fmt.Errorf("replayed stream handshake of %s", peer)
+	}
+	t.hello[peer] = at
+	return nil
+}
+
+// handleStream serves GET /stream: it upgrades the connection of a peer
+// to a stream, once the peer proved its id by its certificate and by the
+// signed handshake.
+func (n *Node) handleStream(w http.ResponseWriter, r *http.Request) {
+	t, ok := n.Transport.(*streamTransport)
+	if !ok || r.Header.Get("Upgrade") != streamProto {
+		http.Error(w, "streams not served", http.StatusNotFound)
+		return
+	}
+	peer := r.Header.Get("X-Node-ID")
+	if peer == "" || peer == n.ID {
+		http.Error(w, "missing X-Node-ID", http.StatusBadRequest)
+		return
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 &&
+		r.TLS.PeerCertificates[0].Subject.CommonName != peer {
+		http.Error(w, "X-Node-ID does not match the certificate", http.StatusForbidden)
+		return
+	}
+	if err := t.checkHello(peer, r); err != nil {
+		log.Printf("[node %s] rejected stream: %v", n.ID, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", streamProto)
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	s := &stream{peer: peer, out: make(chan frame, streamQueue)}
+	t.adopt(s)
+	go t.run(s, conn, brw.Reader)
+}
+
+// adopt makes a stream the peer dialed the one to write to, unless a
+// stream this node dialed is already up and this node's id is the lower:
+// both ends keep the stream dialed by the lower id, and retire the other.
+func (t *streamTransport) adopt(s *stream) {
+	t.mu.Lock()
+	old, ok := t.streams[s.peer]
+	if ok && old.dialed && t.n.ID < s.peer {
+		t.mu.Unlock()
+		s.retire()
+		return
+	}
+	t.streams[s.peer] = s
+	t.mu.Unlock()
+	if ok {
+		old.retire()
+	}
+}
+
+// drop forgets s, if it is still the stream to its peer.
+func (t *streamTransport) drop(s *stream) {
+	t.mu.Lock()
+	if t.streams[s.peer] == s {
+		delete(t.streams, s.peer)
+	}
+	t.mu.Unlock()
+	s.retire()
+}
+
+// run writes the queue of s to conn and reads the peer's frames until the
+// connection ends.
+func (t *streamTransport) run(s *stream, conn net.Conn, r *bufio.Reader) {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	go func() {
+		w := bufio.NewWriter(conn)
+		for f := range s.out {
+			if err := writeFrame(w, f); err != nil {
+				t.n.peerFailed(s.peer)
+				break
+			}
+			if len(s.out) == 0 && w.Flush() != nil {
+				t.n.peerFailed(s.peer)
+				break
+			}
+		}
+		t.drop(s)
+		w.Flush()
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			break
+		}
+		t.handle(s, f)
+	}
+	t.drop(s)
+	conn.Close()
+}
+
+func (t *streamTransport) handle(s *stream, f frame) {
+	switch f.typ {
+	case frameMsg:
+		kind, body, err := parseMsg(f.payload)
+		if err != nil {
+			return
+		}
+		if err := t.n.Receive(kind, body); err != nil && kind != kindBlock {
+			log.Printf("[node %s] %s from %s: %v", t.n.ID, kind, s.peer, err)
+		}
+	case frameSyncReq:
+		if len(f.payload) != 13 {
+			return
+		}
+		from := int64(binary.BigEndian.Uint64(f.payload))
+		count := int64(binary.BigEndian.Uint32(f.payload[8:]))
+		what := syncWhat(f.payload[12])
+		go func() {
+			raw, _ := t.n.serveRange(what, from, count)
+			s.enqueue(frame{typ: frameSyncResp, req: f.req, payload: raw})
+		}()
+	case frameSyncResp:
+		id := syncReq{s.peer, f.req}
+		t.mu.Lock()
+		ch, ok := t.pending[id]
+		delete(t.pending, id)
+		t.mu.Unlock()
+		if ok {
+			ch <- f.payload
+		}
+	}
+}
+
+// request asks a peer for a range of committed headers or blocks, or a
+// piece of a snapshot, and returns the JSON answer.
+func (t *streamTransport) request(peer string, what syncWhat, from, count int64) ([]byte, error) {
+	s := t.streamTo(peer)
+	if s == nil {
+		return nil, fmt.Errorf("no stream to %s", peer)
+	}
+	ch := make(chan []byte, 1)
+	t.mu.Lock()
+	t.nextReq++
+	req := t.nextReq
+	t.pending[syncReq{peer, req}] = ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, syncReq{peer, req})
+		t.mu.Unlock()
+	}()
+
+	payload := binary.BigEndian.AppendUint64(nil, uint64(from))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(count))
+	payload = append(payload, byte(what))
+	if !s.enqueue(frame{typ: frameSyncReq, req: req, payload: payload}) {
+		return nil, fmt.Errorf("stream to %s is full", peer)
+	}
+	select {
+	case raw := <-ch:
+		return raw, nil
+	case <-time.After(streamTimeout):
+		return nil, fmt.Errorf("sync request to %s timed out", peer)
+	}
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// A frame whose length is out of bounds or runs past the end of the
+// stream is refused, as is a message frame whose kind overruns it.
+func TestMalformedFrame(t *testing.T) {
+	var good bytes.Buffer
+	if err := writeFrame(&good, msgFrame(kindPing, []byte("{}"))); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readFrame(bytes.NewReader(good.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, body, err := parseMsg(f.payload); err != nil || kind != kindPing || string(body) != "{}" {
+		t.Fatalf("round trip: %q %q %v", kind, body, err)
+	}
+
+	sized := func(size uint32) []byte {
+		b := append([]byte(nil), good.Bytes()...)
+		binary.BigEndian.PutUint32(b, size)
+		return b
+	}
+	for name, raw := range map[string][]byte{
+		"short header": good.Bytes()[:7],
+		"truncated":    good.Bytes()[:good.Len()-1],
+		"undersized":   sized(4),
+	} {
+		if _, err := readFrame(bytes.NewReader(raw)); err == nil {
+			t.Errorf("%s frame read", name)
+		}
+	}
+	defer func(m int) { maxFrame = m }(maxFrame)
+	maxFrame = len(f.payload) + 4
+	if _, err := readFrame(bytes.NewReader(good.Bytes())); err == nil {
+		t.Error("frame over maxFrame read")
+	}
+	for name, p := range map[string][]byte{
+		"empty":           nil,
+		"long kind":       {9, 'p', 'i', 'n', 'g'},
+		"kind off by one": {5, 'p', 'i', 'n', 'g'},
+	} {
+		if _, _, err := parseMsg(p); err == nil {
+			t.Errorf("%s message parsed", name)
+		}
+	}
+}
+
+// A stream handshake is refused unless the dialing node signed it, for
+// this node, recently and for the first time.
+func TestBadStreamHello(t *testing.T) {
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	vals := block.ValidatorSet{
+		"validator1": sk1.Public().(ed25519.PublicKey),
+		"validator2": sk2.Public().(ed25519.PublicKey),
+	}
+	n := NewNode("validator1", 0, map[string]string{}, nil)
+	n.SK, n.PK = sk1, vals["validator1"]
+	n.Ledger = staticLedger{vals: vals}
+	tr := newStreamTransport(n)
+
+	hello := func(from, to string, sk ed25519.PrivateKey, at time.Time) error {
+		r := httptest.NewRequest("GET", "/stream", nil)
+		r.Header.Set("X-Node-Time", strconv.FormatInt(at.UnixNano(), 10))
+		r.Header.Set("X-Node-Sig", hex.EncodeToString(ed25519.Sign(sk, helloBytes(from, to, at.UnixNano()))))
+		return tr.checkHello(from, r)
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+	for name, err := range map[string]error{
+		"unknown node":   hello("node9", "validator1", other, now),
+		"wrong key":      hello("validator2", "validator1", other, now),
+		"for other node": hello("validator2", "validator3", sk2, now),
+		"stale":          hello("validator2", "validator1", sk2, now.Add(-2*streamSkew)),
+	} {
+		if err == nil {
+			t.Errorf("%s: handshake accepted", name)
+		}
+	}
+	if err := hello("validator2", "validator1", sk2, now); err != nil {
+		t.Fatalf("honest handshake: %v", err)
+	}
+	if err := hello("validator2", "validator1", sk2, now); err == nil {
+		t.Fatal("replayed handshake accepted")
+	}
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// subscribeKeepalive is how often an idle subscription gets a comment
+// line, so that proxies and clients see the connection is alive.
+const subscribeKeepalive = 15 * time.Second
+
+// keyFilter selects changes by exact key or by prefix. An empty filter
+// selects none.
+type keyFilter struct {
+	keys     map[string]bool
+	prefixes []string
+}
+
+func (f keyFilter) empty() bool { return len(f.keys) == 0 && len(f.prefixes) == 0 }
+
+func (f keyFilter) match(key string) bool {
+	if f.keys[key] {
+		return true
+	}
+	for _, p := range f.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSubscribe serves GET /subscribe as server-sent events: a "block"
+// event with every committed block from height `from` on (by default the
+// next one, or the one after Last-Event-ID), each followed by a "change"
+// event for the keys it wrote that match a `key` or `prefix` parameter.
+// Event ids are heights, so a client reconnects where it left off.
+func (n *Node) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	next := n.nextHeight()
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		h, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			http.Error(w, "bad Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		next = h + 1
+	} else if fq := q.Get("from"); fq != "" {
+		h, err := strconv.ParseInt(fq, 10, 64)
+		if err != nil || h < 1 {
+			http.Error(w, "bad from", http.StatusBadRequest)
+			return
+		}
+		next = h
+	}
+	f := keyFilter{keys: map[string]bool{}, prefixes: q["prefix"]}
+	for _, k := range q["key"] {
+		f.keys[k] = true
+	}
+	log.Printf("[node %s] /subscribe from=%d keys=%v prefixes=%v by %s", n.ID, next, q["key"], f.prefixes, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	keepalive := time.NewTicker(subscribeKeepalive)
+	defer keepalive.Stop()
+	for {
+		committed := block.Committed()
+		for ; next < n.nextHeight(); next++ {
+			b, err := n.Ledger.GetBlock(next)
+			if err != nil {
+				return
+			}
+			if err := writeEvent(w, next, "block", b); err != nil {
+				return
+			}
+			if f.empty() {
+				continue
+			}
+			changes, err := block.ChangesAt(next, f.match)
+			if err != nil {
+				continue
+			}
+			for _, c := range changes {
+				if err := writeEvent(w, next, "change", c); err != nil {
+					return
+				}
+			}
+		}
+		fl.Flush()
+
+		select {
+		case <-committed:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			fl.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, id int64, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data)
+	return err
+}
@@ -0,0 +1,421 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// Sync tuning. A node compares its tip with the tips its peers report in
+// pings every SyncInterval, or as soon as a gossiped block shows it fell
+// behind, and only then asks for anything.
+var (
+	SyncInterval   = 2 * time.Second
+	headerBatch    = int64(512) // headers per request
+	bodyChunk      = int64(64)  // blocks per request, fetched in parallel
+	syncBackoff    = time.Second
+	maxSyncBackoff = time.Minute
+	banTime        = 10 * time.Minute
+)
+
+// syncWhat is what a sync request asks for.
+type syncWhat byte
+
+const (
+	syncBlocks syncWhat = iota
+	syncHeaders
+	syncManifest // snapshot manifest of the state at a height
+	syncChunk    // one chunk of that snapshot
+)
+
+// syncPeer is what the sync manager remembers of a peer: its failures in
+// a row and until when it is left alone, backing off or banned.
+type syncPeer struct {
+	fails  int
+	until  time.Time
+	banned bool
+}
+
+// syncer catches the node up with the tips its peers report: it fetches
+// and validates the headers first, downloads the bodies in chunks from
+// several peers in parallel and commits them in order.
+type syncer struct {
+	mu    sync.Mutex
+	peers map[string]*syncPeer
+	wake  chan struct{}
+	run   sync.Mutex // one catch-up at a time
+}
+
+// StartSync runs the sync manager until the process exits.
+func (n *Node) StartSync() {
+	n.sync.wake = make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-n.sync.wake:
+			}
+			n.catchUp()
+		}
+	}()
+}
+
+// wakeSync makes the sync manager look at the peers' tips now.
+func (n *Node) wakeSync() {
+	select {
+	case n.sync.wake <- struct{}{}:
+	default:
+	}
+}
+
+// syncPeers lists the peers ahead of height that are neither backing off
+// nor banned, the furthest ahead first.
+func (n *Node) syncPeers(height int64) []Peer {
+	now := time.Now()
+	var out []Peer
+	n.sync.mu.Lock()
+	for _, p := range n.Peers() {
+		if sp := n.sync.peers[p.ID]; p.Tip > height && (sp == nil || now.After(sp.until)) {
+			out = append(out, p)
+		}
+	}
+	n.sync.mu.Unlock()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Tip > out[j].Tip })
+	return out
+}
+
+func (n *Node) syncPeer(id string) *syncPeer {
+	if n.sync.peers == nil {
+		n.sync.peers = map[string]*syncPeer{}
+	}
+	sp, ok := n.sync.peers[id]
+	if !ok {
+		sp = &syncPeer{}
+		n.sync.peers[id] = sp
+	}
+	return sp
+}
+
+// backoff leaves a peer that failed to answer alone for a while, twice as
+// long with every failure in a row.
+func (n *Node) backoff(id string, err error) {
+	n.sync.mu.Lock()
+	sp := n.syncPeer(id)
+	d := syncBackoff << sp.fails
+	if d > maxSyncBackoff || d <= 0 {
+		d = maxSyncBackoff
+	}
+	sp.fails++
+	sp.until = time.Now().Add(d)
+	n.sync.mu.Unlock()
+	log.Printf("[node %s] sync from %s: %v, backing off %v", n.ID, id, err, d)
+}
+
+// ban leaves a peer that served bad data alone for banTime.
+func (n *Node) ban(id string, err error) {
+	n.sync.mu.Lock()
+	sp := n.syncPeer(id)
+	sp.banned = true
+	sp.until = time.Now().Add(banTime)
+	n.sync.mu.Unlock()
+	n.peerFailed(id)
+	log.Printf("[node %s] banned %s for %v: %v", n.ID, id, banTime, err)
+}
+
+func (n *Node) syncOK(id string) {
+	n.sync.mu.Lock()
+	if sp, ok := n.sync.peers[id]; ok {
+		sp.fails, sp.banned = 0, false
+	}
+	n.sync.mu.Unlock()
+}
+
+// catchUp syncs until no peer in good standing reports a higher tip.
+func (n *Node) catchUp() {
+	n.sync.run.Lock()
+	defer n.sync.run.Unlock()
+	for {
+		tip := n.nextHeight() - 1
+		peers := n.syncPeers(tip)
+		if len(peers) == 0 {
+			return
+		}
+		src := peers[0]
+		if n.StateSync && tip == 1 && src.Tip-tip >= StateSyncMin {
+			if sl, ok := n.Ledger.(stateLedger); ok {
+				if err := n.stateSync(sl, peers); err != nil {
+					log.Printf("[node %s] state sync: %v", n.ID, err)
+					return
+				}
+				continue
+			}
+		}
+		count := src.Tip - tip
+		if count > headerBatch {
+			count = headerBatch
+		}
+		var hdrs []block.BlockHeader
+		if err := n.fetch(src.ID, syncHeaders, tip+1, count, &hdrs); err != nil {
+			n.backoff(src.ID, err)
+			continue
+		}
+		hdrs, err := n.checkHeaders(hdrs)
+		if err != nil {
+			n.ban(src.ID, err)
+			continue
+		}
+		n.syncOK(src.ID)
+		commit := func(b block.Block) error { return n.Ledger.CommitBlock(b, n.commits) }
+		if err := n.fetchBodies(hdrs, peers, commit); err != nil {
+			log.Printf("[node %s] sync: %v", n.ID, err)
+			return
+		}
+		n.settle()
+		log.Printf("[node %s] synced to height %d", n.ID, n.nextHeight()-1)
+	}
+}
+
+// checkHeaders validates headers as the continuation of the tip: heights,
+// hash links and commit certificates under the current validator set. A
+// set that changes along the way fails the certificates from there on:
+// the valid prefix is returned and the rest is checked once the blocks
+// that change it are committed. Nothing valid is an error.
+func (n *Node) checkHeaders(hdrs []block.BlockHeader) ([]block.BlockHeader, error) {
+	prev := n.Ledger.Tip().Header
+	vals := n.Ledger.ValidatorsAt(prev.Height + 1)
+	for i, h := range hdrs {
+		var err error
+		switch {
+		case h.Height != prev.Height+1:
+			err = fmt.Errorf("header %d where %d was due", h.Height, prev.Height+1)
+		case !bytes.Equal(h.PrevHash, block.HashHeader(prev)):
+			err = fmt.Errorf("header %d does not link to %d", h.Height, prev.Height)
+		default:
+			err = block.VerifyCommit(h, vals, n.commits)
+		}
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			return hdrs[:i], nil
+		}
+		prev = h
+	}
+	if len(hdrs) == 0 {
+		return nil, fmt.Errorf("no headers")
+	}
+	return hdrs, nil
+}
+
+// fetchBodies downloads the blocks of hdrs in chunks, spread over peers
+// and fetched in parallel, and hands them to commit in order. A peer that
+// serves a block not matching its header is banned and its chunk asked of
+// the next peer.
+func (n *Node) fetchBodies(hdrs []block.BlockHeader, peers []Peer, commit func(block.Block) error) error {
+	type chunk struct {
+		hdrs []block.BlockHeader
+		done chan []block.Block
+	}
+	var chunks []chunk
+	for i := int64(0); i < int64(len(hdrs)); i += bodyChunk {
+		end := i + bodyChunk
+		if end > int64(len(hdrs)) {
+			end = int64(len(hdrs))
+		}
+		c := chunk{hdrs: hdrs[i:end], done: make(chan []block.Block, 1)}
+		chunks = append(chunks, c)
+		go func(k int) { c.done <- n.fetchChunk(c.hdrs, peers, k) }(len(chunks) - 1)
+	}
+	for _, c := range chunks {
+		blocks := <-c.done
+		if blocks == nil {
+			return fmt.Errorf("no peer served blocks %d-%d", c.hdrs[0].Height, c.hdrs[len(c.hdrs)-1].Height)
+		}
+		for _, b := range blocks {
+			if err := commit(b); err != nil {
+				return fmt.Errorf("commit %d: %w", b.Header.Height, err)
+			}
+		}
+	}
+	return nil
+}
+
+// fetchChunk asks the peers that have them, starting with the k-th, for
+// the blocks of hdrs until one serves them all, matching their headers.
+func (n *Node) fetchChunk(hdrs []block.BlockHeader, peers []Peer, k int) []block.Block {
+	last := hdrs[len(hdrs)-1].Height
+	for i := range peers {
+		p := peers[(k+i)%len(peers)]
+		if p.Tip < last {
+			continue
+		}
+		var blocks []block.Block
+		if err := n.fetch(p.ID, syncBlocks, hdrs[0].Height, int64(len(hdrs)), &blocks); err != nil {
+			n.backoff(p.ID, err)
+			continue
+		}
+		if err := matchHeaders(blocks, hdrs); err != nil {
+			n.ban(p.ID, err)
+			continue
+		}
+		return blocks
+	}
+	return nil
+}
+
+// matchHeaders checks that blocks are the bodies of hdrs.
+func matchHeaders(blocks []block.Block, hdrs []block.BlockHeader) error {
+	if len(blocks) != len(hdrs) {
+		return fmt.Errorf("%d blocks for %d headers", len(blocks), len(hdrs))
+	}
+	for i, b := range blocks {
+		if !bytes.Equal(block.HashHeader(b.Header), block.HashHeader(hdrs[i])) {
+			return fmt.Errorf("block %d does not match its header", hdrs[i].Height)
+		}
+		if err := block.CheckContent(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetch asks a peer for a range of headers or blocks, or a piece of a
+// snapshot, and decodes the answer into v.
+func (n *Node) fetch(peer string, what syncWhat, from, count int64, v interface{}) error {
+	raw, err := n.fetchRaw(peer, what, from, count)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// fetchRaw asks a peer over its stream when there is one and over HTTP
+// otherwise. For snapshots from is the height and count the chunk index.
+func (n *Node) fetchRaw(peer string, what syncWhat, from, count int64) ([]byte, error) {
+	if t, ok := n.Transport.(*streamTransport); ok {
+		raw, err := t.request(peer, what, from, count)
+		if err == nil && len(raw) > 0 {
+			return raw, nil
+		}
+	}
+	addr, ok := n.addrOf(peer)
+	if !ok {
+		return nil, fmt.Errorf("no address")
+	}
+	var path string
+	switch what {
+	case syncBlocks:
+		path = fmt.Sprintf("/blocks?from=%d&count=%d", from, count)
+	case syncHeaders:
+		path = fmt.Sprintf("/headers?from=%d&count=%d", from, count)
+	case syncManifest:
+		path = fmt.Sprintf("/snapshot?height=%d", from)
+	default:
+		path = fmt.Sprintf("/snapshot/chunk?height=%d&index=%d", from, count)
+	}
+	resp, err := n.rpc().Get(n.baseURL(addr) + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// serveRange answers a sync request: the JSON array of the committed
+// headers or blocks from height on, at most count of them, or a piece of
+// the snapshot at height from.
+func (n *Node) serveRange(what syncWhat, from, count int64) ([]byte, error) {
+	switch what {
+	case syncManifest:
+		m, _, err := n.snapshotAt(from)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(m)
+	case syncChunk:
+		_, chunks, err := n.snapshotAt(from)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 || count >= int64(len(chunks)) {
+			return nil, fmt.Errorf("no chunk %d", count)
+		}
+		return chunks[count], nil
+	}
+	if count > headerBatch {
+		count = headerBatch
+	}
+	blocks := n.servedBlocks(from, count)
+	if what == syncBlocks {
+		return json.Marshal(blocks)
+	}
+	hdrs := make([]block.BlockHeader, len(blocks))
+	for i, b := range blocks {
+		hdrs[i] = b.Header
+	}
+	return json.Marshal(hdrs)
+}
+
+// handleRange serves GET /headers and GET /blocks?from=H&count=N.
+func (n *Node) handleRange(what syncWhat) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		from, err := strconv.ParseInt(q.Get("from"), 10, 64)
+		if err != nil || from < 1 {
+			http.Error(w, "bad from", http.StatusBadRequest)
+			return
+		}
+		count, err := strconv.ParseInt(q.Get("count"), 10, 64)
+		if err != nil || count < 1 {
+			http.Error(w, "bad count", http.StatusBadRequest)
+			return
+		}
+		raw, err := n.serveRange(what, from, count)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+	}
+}
+
+// servedBlocks lists the committed blocks from height on, as served to
+// syncing peers.
+func (n *Node) servedBlocks(from, max int64) []block.Block {
+	if n.Faults&FaultForkChain != 0 {
+		chain := n.ServedChain(block.GetBlockchain())
+		if from < 1 || from > int64(len(chain)) {
+			return nil
+		}
+		chain = chain[from-1:]
+		if int64(len(chain)) > max {
+			chain = chain[:max]
+		}
+		return chain
+	}
+	var out []block.Block
+	for h := from; h < from+max; h++ {
+		b, err := n.Ledger.GetBlock(h)
+		if err != nil {
+			break
+		}
+		out = append(out, b)
+	}
+	return out
+}
@@ -0,0 +1,195 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// NodeCertificate is the TLS certificate of node id: self-signed with its
+// ed25519 identity key, which is also the certificate key, and the id as
+// common name. A peer holding the certificate proves it holds the key.
+func NodeCertificate(id string, sk ed25519.PrivateKey) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost", id},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, sk.Public(), sk)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: sk, Leaf: leaf}, nil
+}
+
+// certIdentity reads the node id and key a certificate claims.
+func certIdentity(cert *x509.Certificate) (string, ed25519.PublicKey, error) {
+	pk, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok || cert.Subject.CommonName == "" {
+		return "", nil, errors.New("not a node certificate")
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return "", nil, fmt.Errorf("node certificate: %w", err)
+	}
+	return cert.Subject.CommonName, pk, nil
+}
+
+// knownKey reports whether pk is the key of node id: its validator key or
+// its configured key. The key a peer joined the peer table with does not
+// count, since anyone may join by a ping. unknown is set when this node
+// has no such key for id.
+func (n *Node) knownKey(id string, pk ed25519.PublicKey) (known, unknown bool) {
+	if want, ok := n.peerKey(id, n.nextHeight()); ok {
+		return bytes.Equal(want, pk), false
+	}
+	return false, true
+}
+
+// UseTLS switches node-to-node traffic to mutual TLS with the certificate
+// of n.SK, and the server to HTTPS. Every node of the cluster must use
+// it. With certDir set, the certificate and key are also written there as
+// <id>.crt and <id>.key, for curl and other local clients.
+func (n *Node) UseTLS(certDir string) error {
+	cert, err := NodeCertificate(n.ID, n.SK)
+	if err != nil {
+		return err
+	}
+	if certDir != "" {
+		if err := writeCertPEM(certDir, n.ID, cert); err != nil {
+			return err
+		}
+	}
+	n.tls = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// clients may come without a certificate; nodeOnly keeps them out
+		// of the internal endpoints
+		ClientAuth: tls.RequestClientCert,
+		MinVersion: tls.VersionTLS13,
+	}
+	n.clientTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// node certificates are self-signed: the chain is not checked
+		// against roots but the server's key against its id
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: n.verifyServer,
+		MinVersion:            tls.VersionTLS13,
+	}
+	n.client = &http.Client{
+		Timeout:   rpcClient.Timeout,
+		Transport: &http.Transport{TLSClientConfig: n.clientTLS},
+	}
+	log.Printf("[node %s] mutual TLS on", n.ID)
+	return nil
+}
+
+// verifyServer accepts the certificate of a node whose key matches the
+// one this node knows for it, or of a node it has no key for yet, which
+// then has to join the peer table by a signed ping.
+func (n *Node) verifyServer(raw [][]byte, _ [][]*x509.Certificate) error {
+	if len(raw) == 0 {
+		return errors.New("no server certificate")
+	}
+	cert, err := x509.ParseCertificate(raw[0])
+	if err != nil {
+		return err
+	}
+	id, pk, err := certIdentity(cert)
+	if err != nil {
+		return err
+	}
+	if known, unknown := n.knownKey(id, pk); !known && !unknown {
+		return fmt.Errorf("certificate of %s does not carry its key", id)
+	}
+	return nil
+}
+
+// nodeOnly guards the endpoints only nodes may call: with TLS on, the
+// client certificate must carry the key of a validator or of a configured
+// peer. Pings and pongs are let through from any other node certificate,
+// since joining the peer table is what they are for, but joining it grants
+// nothing more.
+func (n *Node) nodeOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if n.tls == nil {
+			h(w, r)
+			return
+		}
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "node certificate required", http.StatusForbidden)
+			return
+		}
+		id, pk, err := certIdentity(r.TLS.PeerCertificates[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		known, unknown := n.knownKey(id, pk)
+		kind := strings.TrimPrefix(r.URL.Path, "/consensus/")
+		joining := unknown && (kind == kindPing || kind == kindPong)
+		if !known && !joining {
+			log.Printf("[node %s] rejected %s from certificate %s", n.ID, r.URL.Path, id)
+			http.Error(w, "unknown node "+id, http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// baseURL is the URL of the node at addr.
+func (n *Node) baseURL(addr string) string {
+	if n.tls != nil {
+		return "https://" + addr
+	}
+	return "http://" + addr
+}
+
+// rpc is the client for node-to-node requests.
+func (n *Node) rpc() *http.Client {
+	if n.client != nil {
+		return n.client
+	}
+	return rpcClient
+}
+
+func writeCertPEM(dir, id string, cert tls.Certificate) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := os.WriteFile(filepath.Join(dir, id+".crt"), crt, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, id+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+}
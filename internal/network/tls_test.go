@@ -0,0 +1,129 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// staticLedger is a ledger at genesis with a fixed validator set.
+type staticLedger struct {
+	Ledger
+	vals block.ValidatorSet
+}
+
+func (l staticLedger) Tip() block.Block                      { return block.GenesisBlock() }
+func (l staticLedger) ValidatorsAt(int64) block.ValidatorSet { return l.vals }
+
+func testIdentity(t *testing.T, id string) (ed25519.PrivateKey, tls.Certificate) {
+	t.Helper()
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := NodeCertificate(id, sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk, cert
+}
+
+// tlsNode serves the consensus endpoints of validator1 over mutual TLS, in
+// a cluster of validator1 and validator2 where observer is a configured
+// non-validator peer.
+func tlsNode(t *testing.T, val2, observer ed25519.PublicKey) (*Node, *httptest.Server) {
+	t.Helper()
+	sk, _ := testIdentity(t, "validator1")
+	n := NewNode("validator1", 0, map[string]string{}, map[string]ed25519.PublicKey{"observer": observer})
+	n.SK, n.PK = sk, sk.Public().(ed25519.PublicKey)
+	n.Ledger = staticLedger{vals: block.ValidatorSet{"validator1": n.PK, "validator2": val2}}
+	if err := n.UseTLS(""); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/consensus/", n.nodeOnly(n.handleConsensus))
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = n.tls
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return n, srv
+}
+
+func post(t *testing.T, srv *httptest.Server, cert *tls.Certificate, kind string, body []byte) (int, string) {
+	t.Helper()
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	resp, err := c.Post(srv.URL+"/consensus/"+kind, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(msg)
+}
+
+func TestNodeOnlyCertificates(t *testing.T) {
+	val2SK, val2Cert := testIdentity(t, "validator2")
+	obsSK, obsCert := testIdentity(t, "observer")
+	_, forged := testIdentity(t, "validator2") // the id of validator2, another key
+	_, stranger := testIdentity(t, "stranger")
+	_, srv := tlsNode(t, val2SK.Public().(ed25519.PublicKey), obsSK.Public().(ed25519.PublicKey))
+
+	cases := []struct {
+		name   string
+		cert   *tls.Certificate
+		denied bool
+	}{
+		{"validator", &val2Cert, false},
+		{"configured peer", &obsCert, false},
+		{"no certificate", nil, true},
+		{"unknown node", &stranger, true},
+		{"validator id with another key", &forged, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			code, msg := post(t, srv, c.cert, kindPrepare, []byte("{"))
+			if denied := code == http.StatusForbidden; denied != c.denied {
+				t.Fatalf("status %d (%s), want denied=%v", code, strings.TrimSpace(msg), c.denied)
+			}
+		})
+	}
+}
+
+// A node nobody configured may join the peer table by a ping, but that
+// grants it nothing else.
+func TestNodeOnlyPingDoesNotGrantAccess(t *testing.T) {
+	val2SK, _ := testIdentity(t, "validator2")
+	obsSK, _ := testIdentity(t, "observer")
+	n, srv := tlsNode(t, val2SK.Public().(ed25519.PublicKey), obsSK.Public().(ed25519.PublicKey))
+
+	sk, cert := testIdentity(t, "stranger")
+	joiner := NewNode("stranger", 0, map[string]string{}, nil)
+	joiner.SK, joiner.PK = sk, sk.Public().(ed25519.PublicKey)
+	joiner.Ledger = n.Ledger
+	ping, _ := json.Marshal(joiner.newPing(kindPing))
+	if code, msg := post(t, srv, &cert, kindPing, ping); code != http.StatusOK {
+		t.Fatalf("ping: status %d (%s)", code, strings.TrimSpace(msg))
+	}
+	joined := false
+	for _, p := range n.Peers() {
+		joined = joined || p.ID == "stranger"
+	}
+	if !joined {
+		t.Fatal("ping did not add the peer")
+	}
+	if code, _ := post(t, srv, &cert, kindPrepare, []byte("{")); code != http.StatusForbidden {
+		t.Fatalf("prepare after joining: status %d, want %d", code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,216 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// kindBlock carries a committed block to the peers, the /broadcast
+// endpoint over HTTP.
+const kindBlock = "block"
+
+// Transport carries consensus messages between nodes. Send must not block
+// and must not deliver before it returns: the engines send while holding
+// their locks.
+type Transport interface {
+	Send(to, kind string, body []byte)
+}
+
+// Clock schedules the timers of a node, so a simulation can run them on
+// virtual time.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc runs f after d, outside of the caller.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer of a Clock.
+type Timer interface {
+	Stop() bool
+}
+
+// Ledger is the chain a node runs consensus for: the committed blocks, the
+// validator sets and the proposals executed ahead of the tip.
+type Ledger interface {
+	Tip() block.Block
+	GetBlock(h int64) (block.Block, error)
+	ValidatorsAt(h int64) block.ValidatorSet
+	// NewBlock executes op on top of prev and records it as this node's
+	// proposal at the next height.
+	NewBlock(prev block.Block, op block.Operation, initiator []byte) (block.Block, error)
+	// Speculate executes a peer's block ahead of the tip to build on it.
+	Speculate(b block.Block) error
+	ProposalTip() block.Block
+	DropProposal(h int64)
+	// CommitBlock stores a finalized block whose commit certificate is
+	// valid under rule, the consensus engine's.
+	CommitBlock(b block.Block, rule block.CommitRule) error
+	// Snapshot writes the committed state, Restore loads it into an empty
+	// ledger.
+	Snapshot(w io.Writer) error
+	Restore(r io.ReadSeeker, rule block.CommitRule) error
+}
+
+// httpTransport posts messages to the peers' HTTP endpoints.
+type httpTransport struct {
+	n *Node
+}
+
+func (t httpTransport) Send(to, kind string, body []byte) {
+	addr, ok := t.n.addrOf(to)
+	if !ok {
+		return
+	}
+	url := t.n.baseURL(addr) + "/consensus/" + kind
+	if kind == kindBlock {
+		url = t.n.baseURL(addr) + "/broadcast"
+	}
+	go func() {
+		resp, err := t.n.rpc().Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.n.peerFailed(to)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// chainLedger is the node's own chain and ADS in package block.
+type chainLedger struct{}
+
+func (chainLedger) Tip() block.Block { return block.Tip() }
+
+func (chainLedger) GetBlock(h int64) (block.Block, error) { return block.GetBlock(h) }
+
+func (chainLedger) ValidatorsAt(h int64) block.ValidatorSet { return block.ValidatorsAt(h) }
+
+func (chainLedger) NewBlock(prev block.Block, op block.Operation, initiator []byte) (block.Block, error) {
+	return block.NewBlock(prev, op, initiator)
+}
+
+func (chainLedger) Speculate(b block.Block) error { return block.Speculate(b) }
+
+func (chainLedger) ProposalTip() block.Block { return block.ProposalTip() }
+
+func (chainLedger) DropProposal(h int64) { block.DropProposal(h) }
+
+func (chainLedger) CommitBlock(b block.Block, rule block.CommitRule) error {
+	return block.CommitBlock(b, rule)
+}
+
+func (chainLedger) Snapshot(w io.Writer) error { return block.ExportArchive(w, block.ArchiveADS) }
+
+// Restore accepts only a snapshot of the chain this node was configured with.
+func (chainLedger) Restore(r io.ReadSeeker, rule block.CommitRule) error {
+	genesis, err := block.GenesisValidators()
+	if err != nil {
+		return fmt.Errorf("genesis validators: %w", err)
+	}
+	return block.ImportArchive(r, genesis, rule)
+}
+
+func (chainLedger) StateAt(h int64) ([]block.StateEntry, error) { return block.StateAt(h) }
+
+func (chainLedger) InstallState(blocks []block.Block, state []block.StateEntry, rule block.CommitRule) error {
+	return block.InstallState(blocks, state, rule)
+}
+
+// lockedRand is a rand.Rand safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (lr *lockedRand) Int63n(n int64) int64 {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.Int63n(n)
+}
+
+func (lr *lockedRand) Read(p []byte) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.r.Read(p)
+}
+
+// Seed makes the node's random choices (nonces, election timeouts)
+// reproducible.
+func (n *Node) Seed(seed int64) {
+	n.rng = &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+// Receive handles a message from a peer; the HTTP handlers and simulated
+// transports call it.
+func (n *Node) Receive(kind string, body []byte) error {
+	switch kind {
+	case kindBlock:
+		return n.applyBlock(body)
+	case kindEvidence:
+		return n.onEvidence(body)
+	case kindPing, kindPong:
+		return n.onPing(kind, body)
+	case kindTx:
+		return n.onTx(body)
+	}
+	n.stats.add(&n.stats.recv, kind, 1)
+	return n.engine.OnMessage(kind, body)
+}
+
+// Engine returns the consensus engine of the node.
+func (n *Node) Engine() Consensus { return n.engine }
+
+func (n *Node) nextHeight() int64 {
+	return n.Ledger.Tip().Header.Height + 1
+}
+
+// applyBlock commits a block a peer decided, if its certificate checks,
+// and passes it on.
+func (n *Node) applyBlock(body []byte) error {
+	var blk block.Block
+	if err := json.Unmarshal(body, &blk); err != nil {
+		return reject(http.StatusBadRequest, "bad payload")
+	}
+	if len(blk.Header.Initiator) != ed25519.PublicKeySize ||
+		!block.VerifySig(blk.Header.Initiator, blk.Header, blk.Header.Signature) {
+		return reject(http.StatusBadRequest, "invalid initiator signature")
+	}
+
+	bid := block.BlockHash(blk)
+	n.mu.Lock()
+	if n.seen[bid] {
+		n.mu.Unlock()
+		return nil
+	}
+	n.seen[bid] = true
+	n.mu.Unlock()
+
+	if err := n.Ledger.CommitBlock(blk, n.commits); err != nil {
+		n.mu.Lock()
+		delete(n.seen, bid)
+		n.mu.Unlock()
+		if blk.Header.Height > n.nextHeight() {
+			n.wakeSync() // fell behind
+		}
+		return reject(http.StatusBadRequest, "%v", err)
+	}
+	log.Printf("[node %s] /broadcast applied block height=%d", n.ID, blk.Header.Height)
+	n.gossip(kindBlock, body)
+	n.settle()
+	return nil
+}
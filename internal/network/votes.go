@@ -0,0 +1,87 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// voteSet holds at most one vote per validator for one round. Votes that
+// arrive before the pre-prepare cannot be checked yet and wait in pending,
+// every distinct signature claimed for a validator: a forged one must not
+// keep out the genuine vote that follows.
+type voteSet struct {
+	pending map[string][][]byte
+	votes   map[string][]byte
+	verify  func(ed25519.PublicKey, block.BlockHeader, []byte) bool
+}
+
+// maxPendingVotes bounds the unchecked signatures held per validator.
+const maxPendingVotes = 4
+
+// newVoteSet collects votes that verify checks: block.VerifySig for
+// prepares, block.VerifyCommitSig for commits.
+func newVoteSet(verify func(ed25519.PublicKey, block.BlockHeader, []byte) bool) *voteSet {
+	return &voteSet{pending: map[string][][]byte{}, votes: map[string][]byte{}, verify: verify}
+}
+
+// add records a signature over hdr from validator `from`. hdr may be nil
+// while the pre-prepare is still unknown. It reports whether the vote was
+// new; repeated and invalid votes are ignored.
+func (vs *voteSet) add(from string, sig []byte, hdr *block.BlockHeader, vals block.ValidatorSet) bool {
+	pk, ok := vals[from]
+	if !ok {
+		return false
+	}
+	if _, dup := vs.votes[from]; dup {
+		return false
+	}
+	if hdr == nil {
+		held := vs.pending[from]
+		for _, p := range held {
+			if bytes.Equal(p, sig) {
+				return false
+			}
+		}
+		if len(held) == maxPendingVotes {
+			held = held[1:] // the oldest goes: a resent genuine vote still gets in
+		}
+		vs.pending[from] = append(held, sig)
+		return true
+	}
+	if !vs.verify(pk, *hdr, sig) {
+		return false
+	}
+	vs.votes[from] = sig
+	return true
+}
+
+// resolve checks the pending votes once the header is known.
+func (vs *voteSet) resolve(hdr block.BlockHeader, vals block.ValidatorSet) {
+	for from, sigs := range vs.pending {
+		delete(vs.pending, from)
+		for _, sig := range sigs {
+			if vs.add(from, sig, &hdr, vals) {
+				break
+			}
+		}
+	}
+}
+
+func (vs *voteSet) count() int {
+	return len(vs.votes)
+}
+
+// certificate lists the verified votes in validator order.
+func (vs *voteSet) certificate(vals block.ValidatorSet) ([]string, [][]byte) {
+	var ids []string
+	var sigs [][]byte
+	for _, id := range vals.IDs() {
+		if sig, ok := vs.votes[id]; ok {
+			ids = append(ids, id)
+			sigs = append(sigs, sig)
+		}
+	}
+	return ids, sigs
+}
@@ -0,0 +1,61 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// A forged vote that arrives before the pre-prepare does not keep out the
+// genuine one from the same validator.
+func TestForgedEarlyVote(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	vals := block.ValidatorSet{"validator1": pk}
+	hdr := block.BlockHeader{Height: 3}
+
+	vs := newVoteSet(block.VerifySig)
+	if !vs.add("validator1", make([]byte, ed25519.SignatureSize), nil, vals) {
+		t.Fatal("forged vote not held")
+	}
+	if !vs.add("validator1", block.SignMeta(hdr, sk), nil, vals) {
+		t.Fatal("genuine vote refused after a forged one")
+	}
+	vs.resolve(hdr, vals)
+	if vs.count() != 1 {
+		t.Fatalf("%d votes after resolve, want 1", vs.count())
+	}
+}
+
+// The commit rule goes with a node's engine: a raft node accepts a
+// certificate of a majority, and starting it does not make a pbft node in
+// the same process accept one.
+func TestCommitRulePerNode(t *testing.T) {
+	vals := block.ValidatorSet{}
+	hdr := block.BlockHeader{Height: 3}
+	for i := 1; i <= 5; i++ {
+		pk, sk, _ := ed25519.GenerateKey(nil)
+		id := fmt.Sprintf("validator%d", i)
+		vals[id] = pk
+		if i <= 3 {
+			hdr.Validators = append(hdr.Validators, id)
+			hdr.Signatures = append(hdr.Signatures, block.SignCommit(hdr, sk))
+		}
+	}
+	node := func(engine string) *Node {
+		n := NewNode("validator1", 0, map[string]string{}, nil)
+		n.Ledger = staticLedger{vals: vals}
+		if err := n.UseConsensus(engine); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	bft, cft := node("pbft"), node("raft")
+	if err := block.VerifyCommit(hdr, vals, cft.CommitRule()); err != nil {
+		t.Fatalf("raft refuses 3 of 5: %v", err)
+	}
+	if err := block.VerifyCommit(hdr, vals, bft.CommitRule()); err == nil {
+		t.Fatal("pbft accepts 3 of 5 once a raft node started")
+	}
+}
@@ -0,0 +1,263 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// WAL record kinds, one per consensus state transition.
+const (
+	walPrePrepare = "preprepare" // accepted Block as the proposal of View
+	walPrepare    = "prepare"    // sent prepare Sig
+	walCommit     = "commit"     // sent commit Sig, Prepared is the certificate
+	walViewChange = "viewchange" // moved to View, waiting for its new view
+	walNewView    = "newview"    // entered View
+	walDecided    = "decided"    // Height final in View
+	walReset      = "reset"      // abandoned the round, its parent lost
+)
+
+type walRecord struct {
+	Kind     string        `json:"kind"`
+	Height   int64         `json:"height"`
+	View     int64         `json:"view"`
+	Block    *block.Block  `json:"block,omitempty"`
+	Sig      []byte        `json:"sig,omitempty"`
+	Prepared *preparedCert `json:"prepared,omitempty"`
+}
+
+// wal is the consensus write-ahead log: JSON lines, each synced to disk
+// before the message it allows is sent. A torn last line is ignored.
+type wal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	recs []walRecord
+}
+
+func openWAL(path string) (*wal, error) {
+	w := &wal{path: path}
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 64<<20)
+		for sc.Scan() {
+			var rec walRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				log.Printf("[wal] stop at bad record: %v", err)
+				break
+			}
+			w.recs = append(w.recs, rec)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// rewrite what was read, dropping a torn tail
+	if err := w.rewrite(w.recs); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wal) append(rec walRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	w.recs = append(w.recs, rec)
+	return w.f.Sync()
+}
+
+// compact forgets the heights up to tip, keeping the view they ended in.
+func (w *wal) compact(tip, stableView int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	recs := []walRecord{{Kind: walDecided, Height: tip, View: stableView}}
+	for _, rec := range w.recs {
+		if rec.Height > tip {
+			recs = append(recs, rec)
+		}
+	}
+	return w.rewrite(recs)
+}
+
+// rewrite atomically replaces the log with recs. w.mu must be held.
+func (w *wal) rewrite(recs []walRecord) error {
+	tmp := w.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for _, rec := range recs {
+		line, _ := json.Marshal(rec)
+		bw.Write(append(line, '\n'))
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, w.path); err != nil {
+		return err
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.f, err = os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	w.recs = recs
+	return err
+}
+
+// writeFileSync atomically replaces the file at path with raw, synced to
+// disk, for engines that persist their state as a whole.
+func writeFileSync(path string, raw []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(raw)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// logState persists a transition before it becomes visible to peers. A
+// validator that cannot write its WAL must stop rather than risk voting
+// twice after a restart.
+func (p *pbft) logState(rec walRecord) {
+	if p.wal == nil {
+		return
+	}
+	if err := p.wal.append(rec); err != nil {
+		log.Fatalf("[node %s] wal: %v", p.ID, err)
+	}
+}
+
+// compactWAL drops the records of committed heights.
+func (p *pbft) compactWAL() {
+	if p.wal == nil {
+		return
+	}
+	p.mu.Lock()
+	stable := p.stableView
+	p.mu.Unlock()
+	if err := p.wal.compact(p.nextHeight()-1, stable); err != nil {
+		log.Printf("[node %s] wal compact: %v", p.ID, err)
+	}
+}
+
+// recoverWAL opens the WAL at path and rebuilds the consensus state of the
+// heights above the local tip, so the node neither votes against what it
+// already sent nor forgets the round it was in. It re-sends its latest
+// messages for those heights.
+func (p *pbft) recoverWAL(path string) error {
+	w, err := openWAL(path)
+	if err != nil {
+		return err
+	}
+	tip := p.nextHeight() - 1
+	for _, rec := range w.recs {
+		if rec.Kind == walDecided {
+			if rec.View > p.stableView {
+				p.stableView = rec.View
+			}
+			continue
+		}
+		if rec.Height <= tip {
+			continue
+		}
+		p.replay(rec)
+	}
+	p.wal = w
+	if err := w.compact(tip, p.stableView); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	states := make([]*ConsensusState, 0, len(p.cons))
+	for _, cs := range p.cons {
+		states = append(states, cs)
+	}
+	p.mu.Unlock()
+	for _, cs := range states {
+		p.resume(cs)
+	}
+	log.Printf("[node %s] wal replayed %d records, tip=%d stable view=%d", p.ID, len(w.recs), tip, p.stableView)
+	return nil
+}
+
+func (p *pbft) replay(rec walRecord) {
+	cs := p.getState(rec.Height)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	vals := p.Ledger.ValidatorsAt(rec.Height)
+	switch rec.Kind {
+	case walViewChange:
+		cs.view, cs.changing = rec.View, true
+		cs.newRound()
+	case walNewView:
+		cs.view, cs.changing = rec.View, false
+		cs.newRound()
+	case walReset:
+		cs.view = rec.View
+		cs.newRound()
+		cs.prepared = nil
+	case walPrePrepare:
+		blk := *rec.Block
+		cs.view, cs.prePrep = rec.View, &blk
+	case walPrepare:
+		cs.prepares.add(p.ID, rec.Sig, cs.header(), vals)
+	case walCommit:
+		cs.commitSent = true
+		cs.commits.add(p.ID, rec.Sig, cs.header(), vals)
+		cs.prepared = rec.Prepared
+	}
+}
+
+// resume re-sends this node's latest messages of a recovered height and
+// restarts its timer.
+func (p *pbft) resume(cs *ConsensusState) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	switch {
+	case cs.changing:
+		p.multicast(cs.height, kindViewChange,
+			viewChangeMsg{p.auth(kindViewChange, cs.height, cs.view, preparedDigest(cs.prepared)), cs.prepared})
+	case cs.prePrep != nil:
+		digest := block.HashHeader(cs.prePrep.Header)
+		if p.isPrimary(cs.height, cs.view) {
+			p.multicast(cs.height, kindPrePrepare,
+				prePrepareMsg{p.auth(kindPrePrepare, cs.height, cs.view, digest), *cs.prePrep})
+		}
+		if sig, ok := cs.prepares.votes[p.ID]; ok {
+			p.multicast(cs.height, kindPrepare,
+				prepareMsg{p.auth(kindPrepare, cs.height, cs.view, digest), sig})
+		}
+		if sig, ok := cs.commits.votes[p.ID]; ok {
+			p.multicast(cs.height, kindCommit,
+				commitMsg{p.auth(kindCommit, cs.height, cs.view, digest), sig})
+		}
+		p.maybeCommit(cs)
+	}
+	p.armTimer(cs)
+}
@@ -0,0 +1,59 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// A record torn by a crash in the middle of its write is dropped on
+// replay: the records before it are restored, and the log takes new
+// records after them.
+func TestWALTornWrite(t *testing.T) {
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	vals := block.ValidatorSet{
+		"validator1": sk1.Public().(ed25519.PublicKey),
+		"validator2": sk2.Public().(ed25519.PublicKey),
+	}
+	path := filepath.Join(t.TempDir(), "wal.log")
+	good, _ := json.Marshal(walRecord{Kind: walViewChange, Height: 2, View: 3})
+	torn := []byte(`{"kind":"newview","height":2,"vi`)
+	if err := os.WriteFile(path, append(append(good, '\n'), torn...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNode("validator1", 0, map[string]string{}, nil)
+	n.SK, n.PK = sk1, vals["validator1"]
+	n.Ledger = staticLedger{vals: vals}
+	if err := n.Recover(path); err != nil {
+		t.Fatal(err)
+	}
+	p := n.Engine().(*pbft)
+	cs := p.getState(2)
+	cs.mu.Lock()
+	view, changing := cs.view, cs.changing
+	cs.mu.Unlock()
+	if view != 3 || !changing {
+		t.Fatalf("recovered view %d changing=%v, want the view change to 3", view, changing)
+	}
+
+	if err := p.wal.append(walRecord{Kind: walNewView, Height: 2, View: 3}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, rec := range w.recs {
+		kinds = append(kinds, rec.Kind)
+	}
+	if len(kinds) != 3 || kinds[1] != walViewChange || kinds[2] != walNewView {
+		t.Fatalf("log after recovery holds %v", kinds)
+	}
+}
@@ -0,0 +1,173 @@
+// Package sim runs a cluster of network.Node in one process on virtual
+// time: a seeded network with delays, reordering, drops and partitions,
+// and in-memory ledgers. The same seed replays the same run.
+package sim
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/network"
+)
+
+// epoch is the virtual time a simulation starts at.
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock is a virtual clock. Callbacks run one at a time on the goroutine
+// that steps the clock; events due at the same time run in the order of
+// (key, seq), where key names the node or link that scheduled them, so the
+// order does not depend on how the Go runtime interleaves anything.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	events eventHeap
+	seqs   map[string]uint64
+}
+
+type event struct {
+	at   time.Time
+	key  string
+	seq  uint64
+	f    func()
+	done bool // ran or stopped
+}
+
+func NewClock() *Clock {
+	return &Clock{now: epoch, seqs: map[string]uint64{}}
+}
+
+// Now returns the virtual time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Elapsed is the virtual time since the start of the simulation.
+func (c *Clock) Elapsed() time.Duration {
+	return c.Now().Sub(epoch)
+}
+
+// schedule queues f to run after d, ordered by key among events due at the
+// same time.
+func (c *Clock) schedule(key string, d time.Duration, f func()) *event {
+	if d < 0 {
+		d = 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seqs[key]++
+	ev := &event{at: c.now.Add(d), key: key, seq: c.seqs[key], f: f}
+	heap.Push(&c.events, ev)
+	return ev
+}
+
+// Step runs the next event, moving the clock to its time. It reports
+// false when nothing is scheduled.
+func (c *Clock) Step() bool {
+	c.mu.Lock()
+	for c.events.Len() > 0 {
+		ev := heap.Pop(&c.events).(*event)
+		if ev.done {
+			continue
+		}
+		ev.done = true
+		c.now = ev.at
+		c.mu.Unlock()
+		ev.f()
+		return true
+	}
+	c.mu.Unlock()
+	return false
+}
+
+// RunFor runs every event due within d and leaves the clock at now+d.
+func (c *Clock) RunFor(d time.Duration) {
+	end := c.Now().Add(d)
+	for {
+		c.mu.Lock()
+		for c.events.Len() > 0 && c.events[0].done {
+			heap.Pop(&c.events)
+		}
+		due := c.events.Len() > 0 && !c.events[0].at.After(end)
+		c.mu.Unlock()
+		if !due {
+			break
+		}
+		c.Step()
+	}
+	c.mu.Lock()
+	c.now = end
+	c.mu.Unlock()
+}
+
+// RunUntil steps until cond holds or limit of virtual time has passed, and
+// reports whether cond holds.
+func (c *Clock) RunUntil(cond func() bool, limit time.Duration) bool {
+	end := c.Now().Add(limit)
+	for !cond() {
+		if !c.Now().Before(end) {
+			return false
+		}
+		c.RunFor(10 * time.Millisecond)
+	}
+	return true
+}
+
+// For returns the clock as seen by node id, which keys its timers.
+func (c *Clock) For(id string) network.Clock {
+	return nodeClock{c, "timer/" + id}
+}
+
+type nodeClock struct {
+	c   *Clock
+	key string
+}
+
+func (nc nodeClock) Now() time.Time { return nc.c.Now() }
+
+func (nc nodeClock) AfterFunc(d time.Duration, f func()) network.Timer {
+	return timer{nc.c, nc.c.schedule(nc.key, d, f)}
+}
+
+type timer struct {
+	c  *Clock
+	ev *event
+}
+
+func (t timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	if t.ev.done {
+		return false
+	}
+	t.ev.done = true
+	return true
+}
+
+type eventHeap []*event
+
+func (h eventHeap) Len() int { return len(h) }
+
+func (h eventHeap) Less(i, j int) bool {
+	a, b := h[i], h[j]
+	if !a.at.Equal(b.at) {
+		return a.at.Before(b.at)
+	}
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return a.seq < b.seq
+}
+
+func (h eventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x interface{}) { *h = append(*h, x.(*event)) }
+
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	ev := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return ev
+}
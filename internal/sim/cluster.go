@@ -0,0 +1,319 @@
+package sim
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+	"github.com/mauzec/falcondb/internal/network"
+)
+
+// Config describes a simulated cluster.
+type Config struct {
+	Seed       int64
+	Validators int
+	Engine     string // registered consensus engine, pbft by default
+
+	Drop     float64       // fraction of messages lost
+	MinDelay time.Duration // message delay range, 5ms-50ms by default
+	MaxDelay time.Duration
+
+	// Byzantine makes the validators it names misbehave. Safety is only
+	// checked on the others.
+	Byzantine map[string]network.Fault
+
+	// BlockDir, when set, runs the last validator on the ledger of a real
+	// node, package block, with its chain and ADS stored in this
+	// directory; the others keep simulated ledgers. Package block is process-wide, so a
+	// process runs one such cluster at a time.
+	BlockDir string
+}
+
+// Cluster is a set of validators running consensus over a simulated
+// network on one virtual clock.
+type Cluster struct {
+	Config
+	Clock   *Clock
+	Net     *Network
+	Nodes   []*network.Node
+	Ledgers []Chain
+
+	// checked is how far CheckSafety has verified each ledger; agreed
+	// holds the header hashes of the blocks verified so far, by height.
+	checked []int64
+	agreed  []agreedBlock
+}
+
+// Chain is what the cluster reads of a validator's ledger.
+type Chain interface {
+	network.Ledger
+	// Since returns the committed blocks above height h.
+	Since(h int64) []block.Block
+	// StateRoot is the ADS root after the block at height h.
+	StateRoot(h int64) string
+}
+
+// blockLedger is the ledger of a validator on package block.
+type blockLedger struct{ network.Ledger }
+
+func (l blockLedger) Since(h int64) []block.Block {
+	var bs []block.Block
+	for tip := l.Tip().Header.Height; h < tip; h++ {
+		b, err := l.GetBlock(h + 1)
+		if err != nil {
+			break
+		}
+		bs = append(bs, b)
+	}
+	return bs
+}
+
+func (blockLedger) StateRoot(h int64) string { return block.GetADSRootAt(h) }
+
+type agreedBlock struct {
+	hash []byte
+	by   string
+}
+
+// NodeID names the i-th validator of a cluster, from 1.
+func NodeID(i int) string {
+	return fmt.Sprintf("validator%d", i)
+}
+
+// NodeKey derives the key of validator id from the cluster seed.
+func NodeKey(seed int64, id string) ed25519.PrivateKey {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("falcondb-sim:%d:%s", seed, id)))
+	return ed25519.NewKeyFromSeed(sum[:])
+}
+
+func NewCluster(cfg Config) (*Cluster, error) {
+	if cfg.Validators < 1 {
+		return nil, errors.New("sim: a cluster needs validators")
+	}
+	if cfg.Engine == "" {
+		cfg.Engine = "pbft"
+	}
+	c := &Cluster{Config: cfg, Clock: NewClock()}
+	c.Net = NewNetwork(c.Clock, cfg.Seed)
+	c.Net.Drop = cfg.Drop
+	if cfg.MaxDelay > 0 {
+		c.Net.MinDelay, c.Net.MaxDelay = cfg.MinDelay, cfg.MaxDelay
+	}
+
+	vals := block.ValidatorSet{}
+	addrs := map[string]string{}
+	keys := map[string]ed25519.PrivateKey{}
+	for i := 1; i <= cfg.Validators; i++ {
+		id := NodeID(i)
+		keys[id] = NodeKey(cfg.Seed, id)
+		vals[id] = keys[id].Public().(ed25519.PublicKey)
+		addrs[id] = id
+	}
+
+	for i := 1; i <= cfg.Validators; i++ {
+		id := NodeID(i)
+		n := network.NewNode(id, 0, addrs, vals)
+		n.SK, n.PK = keys[id], vals[id]
+		var l Chain
+		if i == cfg.Validators && cfg.BlockDir != "" {
+			if err := block.Open(filepath.Join(cfg.BlockDir, "bc.db"), filepath.Join(cfg.BlockDir, "ads.db")); err != nil {
+				return nil, err
+			}
+			block.SetGenesisValidators(vals)
+			l = blockLedger{n.Ledger}
+		} else {
+			sl := NewLedger(vals)
+			n.Ledger, l = sl, sl
+		}
+		n.Clock = c.Clock.For(id)
+		n.Transport = c.Net.Attach(n)
+		n.Seed(cfg.Seed + int64(i))
+		n.Faults = cfg.Byzantine[id]
+		if err := n.UseConsensus(cfg.Engine); err != nil {
+			return nil, err
+		}
+		n.StartMembership()
+		c.Nodes = append(c.Nodes, n)
+		c.Ledgers = append(c.Ledgers, l)
+		c.checked = append(c.checked, 1)
+	}
+	c.Clock.schedule("sync", syncInterval, c.sync)
+	c.Clock.schedule("mempool", mempoolInterval, c.pump)
+	return c, nil
+}
+
+// mempoolInterval is how often the simulated mempools pass their writes
+// on; real nodes do it on every wake.
+const mempoolInterval = 100 * time.Millisecond
+
+func (c *Cluster) pump() {
+	for _, n := range c.Nodes {
+		n.PumpMempool()
+	}
+	c.Clock.schedule("mempool", mempoolInterval, c.pump)
+}
+
+// syncInterval matches network.SyncInterval.
+const syncInterval = 2 * time.Second
+
+// sync stands in for the sync manager of real nodes: every validator
+// sends the committed blocks a peer lacks over the simulated network, so
+// they may still be lost or cut off.
+func (c *Cluster) sync() {
+	for i, from := range c.Nodes {
+		chain := from.ServedChain(c.Ledgers[i].Since(0))
+		for j, to := range c.Nodes {
+			if i == j {
+				continue
+			}
+			for h := c.Ledgers[j].Tip().Header.Height; h < int64(len(chain)); h++ {
+				raw, _ := json.Marshal(chain[h])
+				c.Net.send(from.ID, to.ID, "block", raw)
+			}
+		}
+	}
+	c.Clock.schedule("sync", syncInterval, c.sync)
+}
+
+// Node returns the validator with id, or nil.
+func (c *Cluster) Node(id string) *network.Node {
+	for _, n := range c.Nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// Submit queues op at validator via, as a client of its /addblock would,
+// and returns the request id.
+func (c *Cluster) Submit(via string, op block.Operation) (string, error) {
+	n := c.Node(via)
+	if n == nil {
+		return "", fmt.Errorf("sim: no node %s", via)
+	}
+	return n.Submit(op)
+}
+
+// Heights returns the committed height of every validator.
+func (c *Cluster) Heights() []int64 {
+	hs := make([]int64, len(c.Ledgers))
+	for i, l := range c.Ledgers {
+		hs[i] = l.Tip().Header.Height
+	}
+	return hs
+}
+
+// MinHeight is the lowest committed height in the cluster.
+func (c *Cluster) MinHeight() int64 {
+	min := int64(-1)
+	for _, h := range c.Heights() {
+		if min < 0 || h < min {
+			min = h
+		}
+	}
+	return min
+}
+
+// CheckSafety verifies that no two honest validators committed different
+// blocks at the same height, that every block they committed carries a
+// valid certificate and that none of them was slashed. Committed blocks
+// never change, so each one is checked once.
+func (c *Cluster) CheckSafety() error {
+	for i, l := range c.Ledgers {
+		if c.Nodes[i].Faults != 0 {
+			continue
+		}
+		for _, b := range l.Since(c.checked[i]) {
+			h := b.Header.Height
+			if err := block.VerifyBlock(b, l.ValidatorsAt(h), c.Nodes[i].CommitRule()); err != nil {
+				return fmt.Errorf("%s height %d: %w", c.Nodes[i].ID, h, err)
+			}
+			hash := block.HashHeader(b.Header)
+			if h-2 < int64(len(c.agreed)) {
+				if a := c.agreed[h-2]; !bytes.Equal(a.hash, hash) {
+					return fmt.Errorf("fork at height %d: %s has %x, %s has %x", h,
+						a.by, a.hash[:6], c.Nodes[i].ID, hash[:6])
+				}
+			} else {
+				c.agreed = append(c.agreed, agreedBlock{hash, c.Nodes[i].ID})
+			}
+			c.checked[i] = h
+		}
+	}
+	for _, id := range c.Slashed() {
+		if c.Node(id).Faults == 0 {
+			return fmt.Errorf("honest %s slashed", id)
+		}
+	}
+	return nil
+}
+
+// CheckState verifies that the honest validators hold the state their
+// chains commit to: each one's ADS root at its tip is the DataHash of the
+// tip block, and at the height they all reached their roots are one.
+func (c *Cluster) CheckState() error {
+	common := int64(-1)
+	for i, l := range c.Ledgers {
+		if c.Nodes[i].Faults != 0 {
+			continue
+		}
+		tip := l.Tip().Header
+		if root := l.StateRoot(tip.Height); root != hex.EncodeToString(tip.DataHash) {
+			return fmt.Errorf("%s height %d: ADS root %.12s, block commits to %.12x", c.Nodes[i].ID, tip.Height, root, tip.DataHash)
+		}
+		if common < 0 || tip.Height < common {
+			common = tip.Height
+		}
+	}
+	var ref, refID string
+	for i, l := range c.Ledgers {
+		if c.Nodes[i].Faults != 0 {
+			continue
+		}
+		root := l.StateRoot(common)
+		if refID == "" {
+			ref, refID = root, c.Nodes[i].ID
+		} else if root != ref {
+			return fmt.Errorf("state differs at height %d: %s has root %.12s, %s has %.12s", common, refID, ref, c.Nodes[i].ID, root)
+		}
+	}
+	return nil
+}
+
+// Slashed lists the validators some honest validator slashed.
+func (c *Cluster) Slashed() []string {
+	seen := map[string]bool{}
+	var ids []string
+	for _, n := range c.Nodes {
+		if n.Faults != 0 {
+			continue
+		}
+		for _, id := range n.Slashed() {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Digest fingerprints the run: the message trace and the committed chains.
+func (c *Cluster) Digest() string {
+	sum := sha256.New()
+	sum.Write(c.Net.Digest())
+	for _, l := range c.Ledgers {
+		sum.Write(block.HashHeader(l.Tip().Header))
+	}
+	return fmt.Sprintf("%x", sum.Sum(nil)[:8])
+}
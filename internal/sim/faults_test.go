@@ -0,0 +1,42 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/mauzec/falcondb/internal/block"
+	"github.com/mauzec/falcondb/internal/network"
+)
+
+// One validator showing each Byzantine behaviour breaks neither safety nor
+// progress of the BFT engines, and only it may be slashed. The honest
+// validators, one of them on package block, end with the same ADS state.
+// Raft trusts its validators and is left out.
+func TestFaults(t *testing.T) {
+	seeds, writes := runs()
+	names := []string{"equivocate", "forge-votes", "duplicate-votes", "withhold-commits", "lie-query", "fork-chain"}
+	for _, engine := range []string{"pbft", "hotstuff"} {
+		for _, name := range names {
+			f, err := network.ParseFaults(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Run(engine+"/"+name, func(t *testing.T) {
+				for s := int64(1); s <= seeds; s++ {
+					cfg := Config{Seed: s, Validators: 4, Engine: engine, Drop: 0.05,
+						Byzantine: map[string]network.Fault{NodeID(1): f}, BlockDir: t.TempDir()}
+					c := runSeed(t, cfg, Scenario{Writes: writes})
+					block.Close()
+					slashed := c.Slashed()
+					for _, id := range slashed {
+						if cfg.Byzantine[id] == 0 {
+							t.Errorf("seed %d: honest %s slashed", s, id)
+						}
+					}
+					if f == network.FaultEquivocate && len(slashed) == 0 {
+						t.Errorf("seed %d: equivocation went unpunished", s)
+					}
+				}
+			})
+		}
+	}
+}
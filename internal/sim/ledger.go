@@ -0,0 +1,250 @@
+package sim
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/mauzec/falcondb/internal/block"
+	"github.com/mauzec/falcondb/internal/storage"
+)
+
+// Ledger is an in-memory chain for one simulated node. It executes blocks
+// the way package block does, on an in-memory ADS and validator history of
+// its own, so that its headers carry real state roots and read/write logs
+// and a block it drops or fails to speculate is rolled back out of its
+// state.
+type Ledger struct {
+	mu       sync.Mutex
+	genesis  block.ValidatorSet
+	m        block.Machine
+	chain    []block.Block
+	proposed map[int64]block.Block
+}
+
+func NewLedger(vals block.ValidatorSet) *Ledger {
+	return &Ledger{
+		genesis: vals,
+		m: block.Machine{
+			ADS:        storage.NewMemADS(),
+			Validators: block.NewValidatorHistory(vals),
+			Replays:    block.NewReplayIndex(),
+		},
+		chain:    []block.Block{block.GenesisBlock()},
+		proposed: map[int64]block.Block{},
+	}
+}
+
+// Chain returns the committed blocks.
+func (l *Ledger) Chain() []block.Block {
+	return l.Since(0)
+}
+
+// Since returns the committed blocks above height h.
+func (l *Ledger) Since(h int64) []block.Block {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if h < 0 || h >= int64(len(l.chain)) {
+		return nil
+	}
+	return append([]block.Block(nil), l.chain[h:]...)
+}
+
+func (l *Ledger) Tip() block.Block {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.chain[len(l.chain)-1]
+}
+
+func (l *Ledger) GetBlock(h int64) (block.Block, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if h < 1 || h > int64(len(l.chain)) {
+		return block.Block{}, fmt.Errorf("no block at height %d", h)
+	}
+	return l.chain[h-1], nil
+}
+
+func (l *Ledger) ValidatorsAt(h int64) block.ValidatorSet { return l.m.Validators.At(h) }
+
+// StateRoot is the ADS root after the block at height h.
+func (l *Ledger) StateRoot(h int64) string { return l.m.ADS.SumAt(h) }
+
+func (l *Ledger) NewBlock(prev block.Block, op block.Operation, initiator []byte) (block.Block, error) {
+	height := prev.Header.Height + 1
+	content, _ := json.Marshal(op)
+	phi := sha256.Sum256(content)
+	root, rejected, rw, err := l.m.Execute(op, height)
+	if err != nil {
+		return block.Block{}, err
+	}
+	data, _ := hex.DecodeString(root)
+	blk := block.Block{
+		Header: block.BlockHeader{
+			Height:      height,
+			PrevHash:    block.HashHeader(prev.Header),
+			ContentHash: phi[:],
+			DataHash:    data,
+			RWHash:      rw.Hash(),
+			Initiator:   initiator,
+			ValSetHash:  l.m.Validators.At(height).Hash(),
+			Rejected:    rejected,
+		},
+		Content: content,
+	}
+	l.mu.Lock()
+	l.proposed[height] = blk
+	l.mu.Unlock()
+	return blk, nil
+}
+
+// apply checks that b extends parent and executes it, checking the outcome
+// against its header. A mismatch undoes the writes.
+func (l *Ledger) apply(parent, b block.Block) error {
+	h := b.Header.Height
+	if h != parent.Header.Height+1 || !bytes.Equal(b.Header.PrevHash, block.HashHeader(parent.Header)) {
+		return fmt.Errorf("block %d does not extend %d", h, parent.Header.Height)
+	}
+	if err := l.m.Validators.VerifyValSet(b.Header); err != nil {
+		return err
+	}
+	var op block.Operation
+	if err := json.Unmarshal(b.Content, &op); err != nil {
+		return err
+	}
+	root, rejected, rw, err := l.m.Execute(op, h)
+	switch {
+	case err != nil:
+	case !bytes.Equal(rw.Hash(), b.Header.RWHash):
+		err = fmt.Errorf("RW log mismatch at height %d", h)
+	case rejected != b.Header.Rejected:
+		err = fmt.Errorf("operation at height %d: rejected=%v, header says %v", h, rejected, b.Header.Rejected)
+	case root != hex.EncodeToString(b.Header.DataHash):
+		err = fmt.Errorf("ADS root mismatch at height %d", h)
+	}
+	if err != nil {
+		l.m.Rollback(h)
+	}
+	return err
+}
+
+func (l *Ledger) ProposalTip() block.Block {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tip := l.chain[len(l.chain)-1]
+	for {
+		p, ok := l.proposed[tip.Header.Height+1]
+		if !ok || !bytes.Equal(p.Header.PrevHash, block.HashHeader(tip.Header)) {
+			return tip
+		}
+		tip = p
+	}
+}
+
+func (l *Ledger) DropProposal(h int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.drop(h)
+}
+
+// drop abandons the proposals from height h up and rolls their writes back.
+func (l *Ledger) drop(h int64) {
+	low := int64(-1)
+	for ph := range l.proposed {
+		if ph >= h {
+			delete(l.proposed, ph)
+			if low < 0 || ph < low {
+				low = ph
+			}
+		}
+	}
+	if low >= 0 {
+		l.m.Rollback(low)
+	}
+}
+
+func (l *Ledger) Speculate(b block.Block) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := b.Header.Height
+	if p, ok := l.proposed[h]; ok && bytes.Equal(block.HashHeader(p.Header), block.HashHeader(b.Header)) {
+		return nil
+	}
+	l.drop(h)
+	parent := l.chain[len(l.chain)-1]
+	if p, ok := l.proposed[h-1]; ok {
+		parent = p
+	}
+	if err := l.apply(parent, b); err != nil {
+		return err
+	}
+	l.proposed[h] = b
+	return nil
+}
+
+func (l *Ledger) CommitBlock(b block.Block, rule block.CommitRule) error {
+	if err := block.VerifyBlock(b, l.ValidatorsAt(b.Header.Height), rule); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tip := l.chain[len(l.chain)-1]
+	h := b.Header.Height
+	if h <= tip.Header.Height {
+		return nil
+	}
+	if p, ok := l.proposed[h]; ok && bytes.Equal(block.HashHeader(p.Header), block.HashHeader(b.Header)) {
+		if !bytes.Equal(b.Header.PrevHash, block.HashHeader(tip.Header)) {
+			return fmt.Errorf("block %d does not extend %d", h, tip.Header.Height)
+		}
+	} else {
+		l.drop(h)
+		if err := l.apply(tip, b); err != nil {
+			return err
+		}
+	}
+	delete(l.proposed, h)
+	l.m.Validators.Track(b)
+	l.m.Replays.Prune(h)
+	l.chain = append(l.chain, b)
+	return nil
+}
+
+// Snapshot writes the committed chain as JSON.
+func (l *Ledger) Snapshot(w io.Writer) error {
+	return json.NewEncoder(w).Encode(l.Chain())
+}
+
+// Restore loads a snapshot into an empty ledger, checking every link and
+// commit certificate and executing every block.
+func (l *Ledger) Restore(r io.ReadSeeker, rule block.CommitRule) error {
+	var chain []block.Block
+	if err := json.NewDecoder(r).Decode(&chain); err != nil {
+		return err
+	}
+	if len(chain) == 0 {
+		return errors.New("empty snapshot")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.chain) > 1 {
+		return fmt.Errorf("restore target is not empty (height %d)", len(l.chain))
+	}
+	fresh := NewLedger(l.genesis)
+	for i := 1; i < len(chain); i++ {
+		if err := block.VerifyBlock(chain[i], fresh.ValidatorsAt(chain[i].Header.Height), rule); err != nil {
+			return err
+		}
+		if err := fresh.apply(chain[i-1], chain[i]); err != nil {
+			return err
+		}
+		fresh.m.Validators.Track(chain[i])
+	}
+	l.m, l.chain, l.proposed = fresh.m, chain, map[int64]block.Block{}
+	return nil
+}
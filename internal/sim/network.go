@@ -0,0 +1,162 @@
+package sim
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/network"
+)
+
+// Network delivers messages between simulated nodes after a random delay
+// in [MinDelay, MaxDelay], so messages overtake each other, and loses a
+// Drop fraction of them. Every link draws from its own generator, seeded
+// from the network seed and the link, so one node sending more does not
+// change the fate of messages on other links.
+type Network struct {
+	Drop     float64
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	clock *Clock
+	seed  int64
+
+	mu    sync.Mutex
+	nodes map[string]*network.Node
+	links map[string]*rand.Rand
+	group map[string]int // partition of each node, nil when healed
+	down  map[string]bool
+
+	Sent, Dropped, Delivered int64
+	trace                    hash.Hash
+}
+
+func NewNetwork(clock *Clock, seed int64) *Network {
+	return &Network{
+		MinDelay: 5 * time.Millisecond,
+		MaxDelay: 50 * time.Millisecond,
+		clock:    clock,
+		seed:     seed,
+		nodes:    map[string]*network.Node{},
+		links:    map[string]*rand.Rand{},
+		down:     map[string]bool{},
+		trace:    sha256.New(),
+	}
+}
+
+// Attach makes n reachable and returns its end of the network.
+func (nw *Network) Attach(n *network.Node) network.Transport {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.nodes[n.ID] = n
+	return endpoint{nw, n.ID}
+}
+
+// Partition splits the nodes into groups that cannot reach each other.
+// Nodes in no group are cut off from everyone.
+func (nw *Network) Partition(groups ...[]string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.group = map[string]int{}
+	for i, g := range groups {
+		for _, id := range g {
+			nw.group[id] = i + 1
+		}
+	}
+}
+
+// Heal removes the partition.
+func (nw *Network) Heal() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.group = nil
+}
+
+// SetDown stops or resumes delivery to and from id, as if it crashed.
+func (nw *Network) SetDown(id string, down bool) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.down[id] = down
+}
+
+// Digest summarizes every delivery so far; two runs with the same seed
+// have the same digest.
+func (nw *Network) Digest() []byte {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	return nw.trace.Sum(nil)
+}
+
+func (nw *Network) connected(from, to string) bool {
+	if nw.down[from] || nw.down[to] {
+		return false
+	}
+	if nw.group == nil {
+		return true
+	}
+	g := nw.group[from]
+	return g != 0 && g == nw.group[to]
+}
+
+func (nw *Network) link(from, to string) *rand.Rand {
+	key := from + ">" + to
+	r, ok := nw.links[key]
+	if !ok {
+		sum := sha256.Sum256([]byte(key))
+		r = rand.New(rand.NewSource(nw.seed ^ int64(binary.BigEndian.Uint64(sum[:]))))
+		nw.links[key] = r
+	}
+	return r
+}
+
+func (nw *Network) send(from, to, kind string, body []byte) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.Sent++
+	r := nw.link(from, to)
+	lost := r.Float64() < nw.Drop
+	delay := nw.MinDelay
+	if span := nw.MaxDelay - nw.MinDelay; span > 0 {
+		delay += time.Duration(r.Int63n(int64(span)))
+	}
+	if lost || !nw.connected(from, to) {
+		nw.Dropped++
+		return
+	}
+	body = append([]byte(nil), body...)
+	nw.clock.schedule("msg/"+from+">"+to, delay, func() {
+		nw.deliver(from, to, kind, body)
+	})
+}
+
+func (nw *Network) deliver(from, to, kind string, body []byte) {
+	nw.mu.Lock()
+	n, ok := nw.nodes[to]
+	if !ok || !nw.connected(from, to) {
+		nw.Dropped++
+		nw.mu.Unlock()
+		return
+	}
+	nw.Delivered++
+	var at [8]byte
+	binary.BigEndian.PutUint64(at[:], uint64(nw.clock.Elapsed()))
+	sum := sha256.Sum256(body)
+	nw.trace.Write(at[:])
+	nw.trace.Write([]byte(from + ">" + to + ":" + kind))
+	nw.trace.Write(sum[:])
+	nw.mu.Unlock()
+
+	n.Receive(kind, body)
+}
+
+type endpoint struct {
+	nw *Network
+	id string
+}
+
+func (e endpoint) Send(to, kind string, body []byte) {
+	e.nw.send(e.id, to, kind, body)
+}
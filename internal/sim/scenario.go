@@ -0,0 +1,144 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+// Scenario is a workload for a cluster: Writes writes submitted through
+// the validators in turn, with the leader cut off for Partition halfway
+// through.
+type Scenario struct {
+	Writes    int
+	Partition time.Duration
+}
+
+// Unsafe marks a safety violation, as opposed to a run that stalled.
+type Unsafe struct{ error }
+
+// writeTimeout is how long a write may take before it is submitted again.
+const writeTimeout = 10 * time.Second
+
+// Run drives the cluster through s. It checks safety after every write, and
+// that every honest validator reaches the same height and state once the
+// network heals; a violation is returned as Unsafe.
+func (c *Cluster) Run(s Scenario) error {
+	var isolated string
+	for w := 0; w < s.Writes; w++ {
+		if s.Partition > 0 && w == s.Writes/2 {
+			isolated = c.Nodes[0].Engine().Leader()
+			var rest []string
+			for _, n := range c.Nodes {
+				if n.ID != isolated {
+					rest = append(rest, n.ID)
+				}
+			}
+			c.Net.Partition(rest)
+			c.Clock.For("partition").AfterFunc(s.Partition, func() {
+				c.Net.Heal()
+				isolated = ""
+			})
+		}
+		if err := c.write(w, isolated); err != nil {
+			return err
+		}
+		if err := c.CheckSafety(); err != nil {
+			return Unsafe{err}
+		}
+	}
+	c.Net.Heal()
+
+	c.Clock.RunUntil(c.converged, time.Minute)
+	if err := c.CheckSafety(); err != nil {
+		return Unsafe{err}
+	}
+	if !c.converged() {
+		return fmt.Errorf("validators did not converge: %v", c.Heights())
+	}
+	if err := c.CheckState(); err != nil {
+		return Unsafe{err}
+	}
+	return nil
+}
+
+// converged reports whether the honest validators are at one height.
+func (c *Cluster) converged() bool {
+	h := int64(-1)
+	for i, l := range c.Ledgers {
+		if c.Nodes[i].Faults != 0 {
+			continue
+		}
+		if tip := l.Tip().Header.Height; h < 0 {
+			h = tip
+		} else if tip != h {
+			return false
+		}
+	}
+	return true
+}
+
+// write submits write w through a reachable validator, and again through
+// the next one when it takes too long, until enough validators to certify
+// it committed one of the copies.
+func (c *Cluster) write(w int, isolated string) error {
+	op := block.Operation{Key: fmt.Sprintf("k%d", w%7), Value: []byte(fmt.Sprintf("v%d", w))}
+	watch := c.watch()
+	deadline := c.Clock.Elapsed() + 2*time.Minute
+	for attempt := 0; c.Clock.Elapsed() < deadline; attempt++ {
+		via := c.Nodes[(w+attempt)%len(c.Nodes)].ID
+		if via == isolated {
+			continue
+		}
+		id, err := c.Submit(via, op)
+		if err != nil {
+			c.Clock.RunFor(100 * time.Millisecond)
+			continue
+		}
+		watch.ids[id] = true
+		if c.Clock.RunUntil(watch.committed, writeTimeout) {
+			return nil
+		}
+	}
+	return fmt.Errorf("write %d not committed, heights %v", w, c.Heights())
+}
+
+// commitWatch looks for a block carrying one of the request ids of a
+// write, scanning each ledger's blocks once.
+type commitWatch struct {
+	c       *Cluster
+	ids     map[string]bool
+	scanned []int64
+	found   []bool
+}
+
+func (c *Cluster) watch() *commitWatch {
+	return &commitWatch{
+		c:       c,
+		ids:     map[string]bool{},
+		scanned: c.Heights(),
+		found:   make([]bool, len(c.Ledgers)),
+	}
+}
+
+// committed reports whether enough validators to certify it committed a
+// block carrying one of the request ids. Request ids are watched before
+// the clock runs again, so no block scanned earlier can carry one.
+func (w *commitWatch) committed() bool {
+	count := 0
+	for i, l := range w.c.Ledgers {
+		for _, b := range l.Since(w.scanned[i]) {
+			var op block.Operation
+			if !w.found[i] && json.Unmarshal(b.Content, &op) == nil && w.ids[op.Nonce] {
+				w.found[i] = true
+			}
+			w.scanned[i] = b.Header.Height
+		}
+		if w.found[i] {
+			count++
+		}
+	}
+	return count >= w.c.Nodes[0].CommitRule()(len(w.c.Ledgers))
+}
@@ -0,0 +1,119 @@
+package sim
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mauzec/falcondb/internal/block"
+)
+
+var sweep = flag.Bool("sweep", false, "run every scenario over more seeds and writes")
+
+// runs is how many seeds a test tries and how many writes each run makes:
+// a couple of short runs by default, one under -short, and the long sweep
+// under -sweep.
+func runs() (seeds int64, writes int) {
+	switch {
+	case *sweep:
+		return 5, 20
+	case testing.Short():
+		return 1, 6
+	}
+	return 2, 8
+}
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func runSeed(t *testing.T, cfg Config, s Scenario) *Cluster {
+	t.Helper()
+	c, err := NewCluster(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Run(s); err != nil {
+		kind := "stalled"
+		if errors.As(err, new(Unsafe)) {
+			kind = "unsafe"
+		}
+		replay := fmt.Sprintf("-engine %s -validators %d -drop %g -writes %d -partition %s -seed %d",
+			cfg.Engine, cfg.Validators, cfg.Drop, s.Writes, s.Partition, cfg.Seed)
+		if f := cfg.Byzantine[NodeID(1)]; f != 0 {
+			replay += fmt.Sprintf(" -byzantine %d -faults %s", len(cfg.Byzantine), f)
+		}
+		t.Errorf("seed %d %s: %v (replay: go run ./cmd/sim %s -v)", cfg.Seed, kind, err, replay)
+	}
+	return c
+}
+
+// Every engine stays safe and converges over a range of seeds, on a lossy
+// network and with the leader cut off for a while.
+func TestEngines(t *testing.T) {
+	seeds, writes := runs()
+	cases := []struct {
+		name       string
+		validators int
+		drop       float64
+		partition  time.Duration
+	}{
+		{"lossy", 4, 0.05, 0},
+		{"very lossy", 4, 0.15, 0},
+		{"partition", 4, 0, 5 * time.Second},
+		{"seven", 7, 0.05, 0},
+	}
+	for _, engine := range []string{"pbft", "hotstuff", "raft"} {
+		for _, tc := range cases {
+			t.Run(engine+"/"+tc.name, func(t *testing.T) {
+				for s := int64(1); s <= seeds; s++ {
+					cfg := Config{Seed: s, Validators: tc.validators, Engine: engine, Drop: tc.drop}
+					runSeed(t, cfg, Scenario{Writes: writes, Partition: tc.partition})
+				}
+			})
+		}
+	}
+}
+
+// A seed replays the same run: the message trace and the chains.
+func TestReplay(t *testing.T) {
+	for _, engine := range []string{"pbft", "hotstuff", "raft"} {
+		t.Run(engine, func(t *testing.T) {
+			cfg := Config{Seed: 7, Validators: 4, Engine: engine, Drop: 0.1}
+			s := Scenario{Writes: 6, Partition: 3 * time.Second}
+			a, b := runSeed(t, cfg, s), runSeed(t, cfg, s)
+			if a.Digest() != b.Digest() {
+				t.Fatalf("seed %d ran differently: %s, then %s", cfg.Seed, a.Digest(), b.Digest())
+			}
+			cfg.Seed++
+			if c := runSeed(t, cfg, s); c.Digest() == a.Digest() {
+				t.Fatalf("seeds %d and %d ran the same", cfg.Seed-1, cfg.Seed)
+			}
+		})
+	}
+}
+
+// A validator on package block, the ledger of a real node, stays in step
+// with the simulated ones: its blocks go through real execution,
+// speculation, rollback of the proposals that lose, and storage, and its
+// state matches theirs.
+func TestBlockLedger(t *testing.T) {
+	_, writes := runs()
+	for _, engine := range []string{"pbft", "hotstuff", "raft"} {
+		t.Run(engine, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Cleanup(func() { block.Close() })
+			cfg := Config{Seed: 3, Validators: 4, Engine: engine, Drop: 0.1, BlockDir: dir}
+			c := runSeed(t, cfg, Scenario{Writes: writes, Partition: 3 * time.Second})
+			if h := block.Tip().Header.Height; h != c.Heights()[0] {
+				t.Fatalf("package block at height %d, the cluster at %v", h, c.Heights())
+			}
+		})
+	}
+}
@@ -9,6 +9,9 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type MerkleNode struct {
@@ -28,11 +31,17 @@ type Version struct {
 }
 
 // ADS теперь хранит историю по каждому ключу
+//
+// Queries rebuild the tree at the height they ask for, so every method
+// holds mu, and callers share an ADS without locking it themselves.
 type ADS struct {
+	mu            sync.Mutex
 	Data          map[string][]Version
 	Leaves        []*MerkleNode
 	Root          *MerkleNode
 	CurrentHeight int64
+
+	db *leveldb.DB // where the versions persist, nil for NewMemADS
 }
 type ProofNode struct {
 	Hash []byte `json:"hash"`
@@ -48,29 +57,61 @@ type ProofNode struct {
 
 // return root hash (delta)
 func (a *ADS) Sum() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sum()
+}
+
+func (a *ADS) sum() string {
 	if a.Root == nil {
 		return ""
 	}
 	return hex.EncodeToString(a.Root.Hash)
 }
 
+// Write is one key change of a block; Delete closes the key's active
+// version without opening a new one.
+type Write struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
 // server update
 func (a *ADS) UpdS(key string, value []byte, height int64) (string, error) {
-	vers := a.Data[key]
-	if len(vers) > 0 {
-		vers[len(vers)-1].VT = height
-	}
-	v := Version{Value: value, VF: height, VT: InfVT}
-	a.Data[key] = append(a.Data[key], v)
-	if adsDB != nil {
-		dbKey := fmt.Sprintf("ver:%s:%s", key, padVF(height))
-		raw, _ := json.Marshal(v)
-		adsDB.Put([]byte(dbKey), raw, nil)
+	return a.UpdM([]Write{{Key: key, Value: value}}, height)
+}
+
+// UpdM applies all writes of one block at height and returns the new root.
+func (a *ADS) UpdM(writes []Write, height int64) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, w := range writes {
+		vers := a.Data[w.Key]
+		if n := len(vers); n > 0 && vers[n-1].VT == InfVT {
+			vers[n-1].VT = height
+			a.persist(w.Key, vers[n-1])
+		}
+		if w.Delete {
+			continue
+		}
+		v := Version{Value: w.Value, VF: height, VT: InfVT}
+		a.Data[w.Key] = append(a.Data[w.Key], v)
+		a.persist(w.Key, v)
 	}
 
 	a.CurrentHeight = height
 	a.buildTree()
-	return a.Sum(), nil
+	return a.sum(), nil
+}
+
+func (a *ADS) persist(key string, v Version) {
+	if a.db == nil {
+		return
+	}
+	dbKey := fmt.Sprintf("ver:%s:%s", key, padVF(v.VF))
+	raw, _ := json.Marshal(v)
+	a.db.Put([]byte(dbKey), raw, nil)
 }
 
 func (a *ADS) UpdC(newDigest string) error {
@@ -81,6 +122,8 @@ func (a *ADS) UpdC(newDigest string) error {
 }
 
 func (a *ADS) Qry(key string, height int64) ([]byte, []ProofNode, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.CurrentHeight = height
 	a.buildTree()
 	vers, ok := a.Data[key]
@@ -101,6 +144,19 @@ func (a *ADS) Qry(key string, height int64) ([]byte, []ProofNode, error) {
 	return nil, nil, errors.New("no active version at this height")
 }
 
+// Get returns the version of key active at height, without touching the tree.
+func (a *ADS) Get(key string, height int64) (Version, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	vers := a.Data[key]
+	for i := len(vers) - 1; i >= 0; i-- {
+		if v := vers[i]; v.VF <= height && height < v.VT {
+			return v, true
+		}
+	}
+	return Version{}, false
+}
+
 func VerifyQry(digest string, key string, value []byte, proof [][]byte) bool {
 	leafHash := sha256.Sum256(append([]byte(key), value...))
 	curr := leafHash[:]
@@ -111,6 +167,19 @@ func VerifyQry(digest string, key string, value []byte, proof [][]byte) bool {
 	return hex.EncodeToString(curr) == digest
 }
 
+// VerifyProof checks a proof as returned by Qry, honouring sibling sides.
+func VerifyProof(digest string, key string, value []byte, proof []ProofNode) bool {
+	curr := sha256.Sum256(append([]byte(key), value...))
+	for _, p := range proof {
+		if p.Left {
+			curr = sha256.Sum256(append(append([]byte{}, p.Hash...), curr[:]...))
+		} else {
+			curr = sha256.Sum256(append(curr[:], p.Hash...))
+		}
+	}
+	return hex.EncodeToString(curr[:]) == digest
+}
+
 func (a *ADS) buildTree() {
 	a.Leaves = nil
 	seen := map[string]bool{}
@@ -149,6 +218,7 @@ func (a *ADS) buildTree() {
 		}
 		nodes = next
 	}
+	a.Root = nil
 	if len(nodes) == 1 {
 		a.Root = nodes[0]
 	}
@@ -175,6 +245,8 @@ func (a *ADS) genProof(leaf *MerkleNode) []ProofNode {
 }
 
 func (a *ADS) SumAt(h int64) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.CurrentHeight = h
 	a.buildTree()
 	if a.Root == nil {
@@ -183,12 +255,31 @@ func (a *ADS) SumAt(h int64) string {
 	return hex.EncodeToString(a.Root.Hash)
 }
 
+// Len returns the number of keys with stored versions.
+func (a *ADS) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.Data)
+}
+
 type Record struct {
 	Key   string
 	Value []byte
 }
 
+// Root returns the root a state made of recs would have, without
+// storing anything.
+func Root(recs []Record) string {
+	a := &ADS{Data: make(map[string][]Version, len(recs))}
+	for _, r := range recs {
+		a.Data[r.Key] = append(a.Data[r.Key], Version{Value: r.Value, VT: InfVT})
+	}
+	return a.SumAt(0)
+}
+
 func (a *ADS) Scan(prefix string, height int64) ([]Record, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.CurrentHeight = height
 	a.buildTree()
 
@@ -5,27 +5,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var adsDB *leveldb.DB
 
-func init() {
-	if os.Getenv("MODE") == "client" {
-		log.Printf("[ads-persist] skip LevelDB open (client mode)")
-		return
-	}
-	path := os.Getenv("ADS_PATH")
+// Open stores the versions in the LevelDB at path; NewADS loads them from
+// there afterwards. Without it every ADS lives in memory.
+func Open(path string) error {
 	log.Printf("[ads-persist] Opening ADS DB at %s", path)
 	var err error
 	adsDB, err = leveldb.OpenFile(path, nil)
 	if err != nil {
-		log.Fatalf("[ads-persist] cannot open ads.db: %v", err)
+		return fmt.Errorf("cannot open ads.db: %w", err)
 	}
 	iter := adsDB.NewIterator(nil, nil)
 	if !iter.Next() {
@@ -38,10 +35,22 @@ func init() {
 		raw, _ := json.Marshal(v)
 		key := fmt.Sprintf("ver:__genesis__:%s", padVF(0))
 		if err := adsDB.Put([]byte(key), raw, nil); err != nil {
-			log.Fatalf("[ads-persist] seed genesis: %v", err)
+			iter.Release()
+			return fmt.Errorf("seed genesis: %w", err)
 		}
 	}
 	iter.Release()
+	return nil
+}
+
+// Close closes the database Open opened; later ADSs live in memory.
+func Close() error {
+	if adsDB == nil {
+		return nil
+	}
+	err := adsDB.Close()
+	adsDB = nil
+	return err
 }
 
 func NewADS() *ADS {
@@ -51,10 +60,7 @@ func NewADS() *ADS {
 	data := make(map[string][]Version)
 	iter := adsDB.NewIterator(nil, nil)
 	for iter.Next() {
-		key := string(iter.Key()) // "ver:{k}:{vf}"
-		parts := strings.Split(key, ":")
-		k, vf := parts[1], parseVF(parts[2])
-
+		k, vf := splitVerKey(string(iter.Key()))
 		if k == "__genesis__" {
 			continue
 		}
@@ -70,7 +76,18 @@ func NewADS() *ADS {
 			return data[k][i].VF < data[k][j].VF
 		})
 	}
-	return &ADS{Data: data}
+	return &ADS{Data: data, db: adsDB}
+}
+
+// splitVerKey splits a stored "ver:{k}:{vf}" key on its last separator,
+// since k may contain ':' itself.
+func splitVerKey(key string) (string, int64) {
+	key = strings.TrimPrefix(key, "ver:")
+	i := strings.LastIndex(key, ":")
+	if i < 0 {
+		return key, 0
+	}
+	return key[:i], parseVF(key[i+1:])
 }
 
 func padVF(vf int64) string {
@@ -87,3 +104,65 @@ func NewMemADS() *ADS {
 		Data: make(map[string][]Version),
 	}
 }
+
+// EachVersion calls fn for every stored version in key order.
+func EachVersion(fn func(key string, v Version) error) error {
+	iter := adsDB.NewIterator(util.BytesPrefix([]byte("ver:")), nil)
+	defer iter.Release()
+	for iter.Next() {
+		k, vf := splitVerKey(string(iter.Key()))
+		if k == "__genesis__" {
+			continue
+		}
+		var v Version
+		if err := json.Unmarshal(iter.Value(), &v); err != nil {
+			return err
+		}
+		v.VF = vf
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// Restore adds a stored version as is, e.g. from an archive.
+func (a *ADS) Restore(key string, v Version) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Data[key] = append(a.Data[key], v)
+	sort.Slice(a.Data[key], func(i, j int) bool {
+		return a.Data[key][i].VF < a.Data[key][j].VF
+	})
+	a.persist(key, v)
+}
+
+// Rollback undoes every write made at or above height: versions opened
+// there are dropped and versions closed there are active again.
+func (a *ADS) Rollback(height int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, vers := range a.Data {
+		kept := vers[:0]
+		for _, v := range vers {
+			if v.VF >= height {
+				if a.db != nil {
+					a.db.Delete([]byte(fmt.Sprintf("ver:%s:%s", key, padVF(v.VF))), nil)
+				}
+				continue
+			}
+			if v.VT != InfVT && v.VT >= height {
+				v.VT = InfVT
+				a.persist(key, v)
+			}
+			kept = append(kept, v)
+		}
+		if len(kept) == 0 {
+			delete(a.Data, key)
+		} else {
+			a.Data[key] = kept
+		}
+	}
+	a.CurrentHeight = height - 1
+	a.buildTree()
+}
@@ -0,0 +1,39 @@
+package storage
+
+import "testing"
+
+// Keys containing ':' survive a reload and an export with their versions.
+func TestPersistColonKeys(t *testing.T) {
+	dir := t.TempDir()
+	if err := Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	a := NewADS()
+	if _, err := a.UpdS("user:42", []byte("ann"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.UpdS("user:42", []byte("bob"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewADS()
+	if v, ok := b.Get("user:42", 3); !ok || string(v.Value) != "bob" || v.VF != 3 {
+		t.Fatalf("reloaded user:42 = %q at VF %d, %v", v.Value, v.VF, ok)
+	}
+	if v, ok := b.Get("user:42", 2); !ok || string(v.Value) != "ann" {
+		t.Fatalf("reloaded user:42 at height 2 = %q, %v", v.Value, ok)
+	}
+
+	var got []string
+	err := EachVersion(func(key string, v Version) error {
+		got = append(got, key+"="+string(v.Value))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "user:42=ann" || got[1] != "user:42=bob" {
+		t.Fatalf("exported %v", got)
+	}
+}
@@ -1,4 +1,4 @@
-rm -rf data/val1 data/val2 data/node1 data/node2 data/node3
+rm -rf data/val1 data/val2 data/val3 data/val4 data/node1 data/node2 data/node3
 
 ADS_PATH=data/val1/ads.db BLK_PATH=data/val1/blockchain.db \
   go run cmd/test/main.go --id=validator1 --port=8081
@@ -6,9 +6,21 @@ ADS_PATH=data/val1/ads.db BLK_PATH=data/val1/blockchain.db \
 ADS_PATH=data/val2/ads.db BLK_PATH=data/val2/blockchain.db \
   go run cmd/test/main.go --id=validator2 --port=8082
 
+ADS_PATH=data/val3/ads.db BLK_PATH=data/val3/blockchain.db \
+  go run cmd/test/main.go --id=validator3 --port=8083
+
+ADS_PATH=data/val4/ads.db BLK_PATH=data/val4/blockchain.db \
+  go run cmd/test/main.go --id=validator4 --port=8084
+
 ADS_PATH=data/node1/ads.db BLK_PATH=data/node1/blockchain.db \
   go run cmd/test/main.go --id=node1 --port=8091
 ADS_PATH=data/node2/ads.db BLK_PATH=data/node2/blockchain.db \
   go run cmd/test/main.go --id=node2 --port=8092
 ADS_PATH=data/node3/ads.db BLK_PATH=data/node3/blockchain.db \
-  go run cmd/test/main.go --id=node3 --port=8093
\ No newline at end of file
+  go run cmd/test/main.go --id=node3 --port=8093
+# a read replica only needs one seed to find the rest of the cluster
+ADS_PATH=data/replica1/ads.db BLK_PATH=data/replica1/blockchain.db \
+  go run cmd/test/main.go --id=replica1 --port=8101 --seeds=127.0.0.1:8081
+# a replica joining a long chain downloads the state instead of replaying it
+ADS_PATH=data/replica2/ads.db BLK_PATH=data/replica2/blockchain.db \
+  go run cmd/test/main.go --id=replica2 --port=8102 --seeds=127.0.0.1:8081 --state-sync